@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/client"
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("httpc: ")
+
+	var fields, trailers headers.Fields
+	method := flag.String("X", "", "request method, GET or POST when there's a body")
+	flag.Var(&fields, "H", "request header as Name: value, can be given more than once")
+	data := flag.String("d", "", "request body, @file reads it from a file and @- from stdin")
+	chunked := flag.Bool("chunked", false, "send the body chunked instead of with a Content-Length")
+	flag.Var(&trailers, "trailer", "request trailer as Name: value, the body is sent chunked, can be given more than once")
+	verbose := flag.Bool("v", false, "print the raw bytes of the request and the response with timings to stderr")
+	follow := flag.Bool("L", false, "follow redirects")
+	maxRedirects := flag.Int("max-redirects", 10, "how many redirects -L follows")
+	insecure := flag.Bool("k", false, "don't verify the server's certificate")
+	timeout := flag.Duration("timeout", 0, "how long the whole request can take, zero is no limit")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: httpc [flags] url")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	body, err := readBody(*data)
+	if err != nil {
+		log.Fatalf("Error reading body: %v", err)
+	}
+
+	if *method == "" {
+		*method = "GET"
+		if *data != "" {
+			*method = "POST"
+		}
+	}
+
+	req, err := client.NewRequest(*method, flag.Arg(0), body)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fields.AddTo(req.Headers)
+	trailers.AddTo(req.Trailers)
+	if *chunked {
+		req.Headers.Delete("Transfer-Encoding")
+		req.Headers.Set("Transfer-Encoding", "chunked")
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	req.SetContext(ctx)
+
+	opts := []client.Option{client.WithMaxRedirects(0)}
+	if *follow {
+		opts = append(opts, client.WithMaxRedirects(*maxRedirects))
+	}
+	if *insecure {
+		opts = append(opts, client.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	}
+
+	start := time.Now()
+	var trace *tracer
+	if *verbose {
+		trace = newTracer(os.Stderr, start)
+		opts = append(opts, client.WithTrace(trace.hooks()))
+	}
+
+	res, err := client.New(opts...).Do(req)
+	if err != nil {
+		if trace != nil {
+			trace.flush()
+		}
+		log.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(os.Stdout, res.Body)
+	if trace != nil {
+		trace.flush()
+		trace.printf("response done after %s", time.Since(start))
+	}
+	if err != nil {
+		log.Fatalf("Error reading body: %v", err)
+	}
+
+	// the verbose output shows them as they came already
+	if trace == nil {
+		for _, key := range sortedKeys(res.Trailers) {
+			for _, value := range res.Trailers[key] {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", headers.CanonicalName(key), value)
+			}
+		}
+	}
+}
+
+// readBody returns the body the -d flag names
+func readBody(data string) ([]byte, error) {
+	switch {
+	case data == "@-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		return os.ReadFile(data[1:])
+	default:
+		return []byte(data), nil
+	}
+}
+
+func sortedKeys(h headers.Headers) []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+// tracer prints what the client sends and reads like curl -v does, "* " lines are
+// timings and connections, "> " lines what was sent and "< " lines what came back
+type tracer struct {
+	w        io.Writer
+	start    time.Time
+	sent     *lineWriter
+	read     *lineWriter
+	readAny  bool
+	hopStart time.Time
+}
+
+func newTracer(w io.Writer, start time.Time) *tracer {
+	return &tracer{
+		w:     w,
+		start: start,
+		sent:  &lineWriter{w: w, prefix: "> "},
+		read:  &lineWriter{w: w, prefix: "< "},
+	}
+}
+
+func (t *tracer) hooks() *client.Trace {
+	return &client.Trace{
+		GotConn: func(addr string, reused bool) {
+			// a redirect's response is done once the next connection is picked
+			t.flush()
+			t.readAny = false
+			t.hopStart = time.Now()
+
+			if reused {
+				t.printf("reusing connection to %s", addr)
+			} else {
+				t.printf("connected to %s after %s", addr, time.Since(t.start))
+			}
+		},
+		WroteRequest: func(data []byte) {
+			t.sent.Write(data)
+			t.sent.flush()
+			t.printf("request written after %s", time.Since(t.start))
+		},
+		ReadResponse: func(data []byte) {
+			if !t.readAny {
+				t.readAny = true
+				t.printf("first byte after %s, %s once the connection was there", time.Since(t.start), time.Since(t.hopStart))
+			}
+			t.read.Write(data)
+		},
+	}
+}
+
+func (t *tracer) printf(format string, args ...any) {
+	fmt.Fprintf(t.w, "* "+format+"\n", args...)
+}
+
+func (t *tracer) flush() {
+	t.sent.flush()
+	t.read.flush()
+}
+
+// lineWriter prints the lines written to it with prefix in front, a line split over
+// writes is printed once it's complete. Lines that aren't text are printed quoted.
+type lineWriter struct {
+	w      io.Writer
+	prefix string
+	line   []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.line = append(lw.line, p...)
+
+	for {
+		idx := bytes.IndexByte(lw.line, '\n')
+		if idx == -1 {
+			return len(p), nil
+		}
+
+		lw.printLine(lw.line[:idx])
+		lw.line = lw.line[idx+1:]
+	}
+}
+
+// flush prints what's left of a line that didn't end
+func (lw *lineWriter) flush() {
+	if len(lw.line) > 0 {
+		lw.printLine(lw.line)
+		lw.line = nil
+	}
+}
+
+func (lw *lineWriter) printLine(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if !isText(line) {
+		fmt.Fprintf(lw.w, "%s%s\n", lw.prefix, strconv.Quote(string(line)))
+		return
+	}
+
+	fmt.Fprintf(lw.w, "%s%s\n", lw.prefix, line)
+}
+
+func isText(line []byte) bool {
+	if !utf8.Valid(line) {
+		return false
+	}
+
+	for _, r := range string(line) {
+		if r != '\t' && !unicode.IsPrint(r) {
+			return false
+		}
+	}
+
+	return true
+}
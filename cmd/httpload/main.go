@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+)
+
+// config is what every worker needs to send its requests
+type config struct {
+	target    *url.URL
+	method    string
+	raw       []byte
+	keepAlive bool
+	pipeline  int
+	timeout   time.Duration
+	insecure  bool
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("httpload: ")
+
+	var fields headers.Fields
+	connections := flag.Int("c", 10, "how many connections send requests at once")
+	requests := flag.Int("n", 1000, "how many requests to send, ignored when -duration is set")
+	duration := flag.Duration("duration", 0, "send requests for this long instead of a fixed number")
+	rate := flag.Float64("rate", 0, "requests per second over all connections, as fast as possible when not given")
+	keepAlive := flag.Bool("keepalive", true, "send more than one request on a connection while the server keeps it open")
+	pipeline := flag.Int("pipeline", 1, "how many requests a connection sends before reading the responses, needs -keepalive")
+	method := flag.String("X", "GET", "request method")
+	flag.Var(&fields, "H", "request header as Name: value, can be given more than once")
+	data := flag.String("d", "", "request body, @file reads it from a file")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long a request can take before it counts as failed")
+	insecure := flag.Bool("k", false, "don't verify the server's certificate")
+	asJSON := flag.Bool("json", false, "print the report as json")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: httpload [flags] url")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// a rate that's given has to be one, NaN included
+	invalidRate := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "rate" && !(*rate > 0) {
+			invalidRate = true
+		}
+	})
+
+	if flag.NArg() != 1 || *connections < 1 || *pipeline < 1 || invalidRate {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !*keepAlive {
+		*pipeline = 1
+	}
+
+	cfg, err := newConfig(flag.Arg(0), *method, fields, *data, *keepAlive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.pipeline = *pipeline
+	cfg.timeout = *timeout
+	cfg.insecure = *insecure
+
+	total := *requests
+	var deadline time.Time
+	if *duration > 0 {
+		total = -1
+		deadline = time.Now().Add(*duration)
+	}
+
+	tickets := schedule(total, *rate, deadline)
+
+	start := time.Now()
+	results := make([]*stats, *connections)
+	wg := sync.WaitGroup{}
+	for i := range results {
+		results[i] = newStats()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work(cfg, tickets, results[i])
+		}()
+	}
+	wg.Wait()
+
+	summary := newStats()
+	for _, result := range results {
+		summary.merge(result)
+	}
+	report := summary.report(time.Since(start))
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+
+	report.print(os.Stdout)
+}
+
+// newConfig builds the request every worker sends, it's written out once up front
+func newConfig(rawURL, method string, fields headers.Fields, data string, keepAlive bool) (*config, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("want an http or https url, got %q", rawURL)
+	}
+
+	body := []byte(data)
+	if path, ok := strings.CutPrefix(data, "@"); ok {
+		body, err = os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: target.RequestURI(),
+			HttpVersion:   "1.1",
+		},
+		Headers:  headers.NewHeaders(),
+		Body:     body,
+		Trailers: headers.NewHeaders(),
+	}
+	fields.AddTo(req.Headers)
+	req.Headers.Delete("Host")
+	req.Headers.Set("Host", target.Host)
+	if !keepAlive {
+		req.Headers.Delete("Connection")
+		req.Headers.Set("Connection", "close")
+	}
+
+	raw := &bytes.Buffer{}
+	_, err = req.WriteTo(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config{target: target, method: method, raw: raw.Bytes(), keepAlive: keepAlive}, nil
+}
+
+// schedule hands out a ticket for every request to send, at rate per second when it's
+// set. The channel is closed once total tickets went out, or at the deadline when total
+// is negative.
+func schedule(total int, rate float64, deadline time.Time) <-chan struct{} {
+	tickets := make(chan struct{})
+
+	go func() {
+		defer close(tickets)
+
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		var ticks <-chan time.Time
+		if rate > 0 {
+			// past a billion a second the interval rounds down to nothing, which the ticker refuses
+			interval := max(time.Duration(float64(time.Second)/rate), time.Nanosecond)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+
+		for sent := 0; total < 0 || sent < total; sent++ {
+			if ticks != nil {
+				select {
+				case <-ticks:
+				case <-expired:
+					return
+				}
+			}
+
+			select {
+			case tickets <- struct{}{}:
+			case <-expired:
+				return
+			}
+		}
+	}()
+
+	return tickets
+}
+
+// work sends requests on a connection of its own until the tickets run out. With
+// pipelining up to that many requests are written before the responses are read, the
+// ones left unanswered when the server closes the connection go again on a new one.
+func work(cfg *config, tickets <-chan struct{}, s *stats) {
+	var conn *countingConn
+	var last *response.Response
+	pending := 0
+
+	defer func() {
+		if conn != nil {
+			s.add(conn)
+			conn.Close()
+		}
+	}()
+
+	for {
+		// the first ticket is waited for, the rest of a batch only taken when they're there
+		for pending == 0 {
+			_, ok := <-tickets
+			if !ok {
+				return
+			}
+			pending++
+		}
+	batch:
+		for pending < cfg.pipeline {
+			select {
+			case _, ok := <-tickets:
+				if !ok {
+					break batch
+				}
+				pending++
+			default:
+				break batch
+			}
+		}
+
+		if conn == nil {
+			dialed, err := dial(cfg)
+			if err != nil {
+				s.fail("dial", err)
+				pending--
+				continue
+			}
+
+			conn = dialed
+			last = nil
+		}
+
+		conn.SetDeadline(time.Now().Add(cfg.timeout))
+		sent := time.Now()
+
+		_, err := conn.Write(bytes.Repeat(cfg.raw, pending))
+		if err != nil {
+			s.fail("write", err)
+			pending--
+			s.add(conn)
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		answered, reuse := 0, true
+		for answered < pending && reuse {
+			var res *response.Response
+			if last == nil {
+				res, err = response.ResponseFromReader(conn, cfg.method)
+			} else {
+				res, err = last.Next(cfg.method)
+			}
+			if err == nil {
+				_, err = io.Copy(io.Discard, res.Body)
+			}
+			if err != nil {
+				s.fail("read", err)
+				answered++
+				reuse = false
+				break
+			}
+
+			s.done(res.StatusLine.StatusCode, time.Since(sent))
+			answered++
+			last = res
+			reuse = cfg.keepAlive && keepsOpen(res, cfg.method)
+		}
+		pending -= answered
+
+		if !reuse {
+			s.add(conn)
+			conn.Close()
+			conn = nil
+			if pending > 0 {
+				s.retried += pending
+			}
+		}
+	}
+}
+
+// keepsOpen follows the rules of the response's KeepAlive, which can't be asked since the
+// pipelined responses already read behind this one count against it there
+func keepsOpen(res *response.Response, method string) bool {
+	if res.StatusLine.StatusCode == response.StatusSwitchingProtocols {
+		return false
+	}
+
+	options := []string{}
+	for _, option := range res.Headers.Values("Connection") {
+		options = append(options, strings.ToLower(option))
+	}
+	if res.StatusLine.HttpVersion == "1.0" && !slices.Contains(options, "keep-alive") || slices.Contains(options, "close") {
+		return false
+	}
+
+	// a body without a length ends with the connection
+	_, hasLength := res.Headers.Get("Content-Length")
+	_, hasEncoding := res.Headers.Get("Transfer-Encoding")
+	code := res.StatusLine.StatusCode
+	return hasLength || hasEncoding || method == "HEAD" || code == 204 || code == 304
+}
+
+func dial(cfg *config) (*countingConn, error) {
+	port := cfg.target.Port()
+	if port == "" {
+		port = "80"
+		if cfg.target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(cfg.target.Hostname(), port)
+
+	dialer := &net.Dialer{Timeout: cfg.timeout}
+	var conn net.Conn
+	var err error
+	if cfg.target.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+			ServerName:         cfg.target.Hostname(),
+			InsecureSkipVerify: cfg.insecure,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingConn{Conn: conn}, nil
+}
+
+// countingConn counts the bytes that go over the connection both ways
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// stats is what a worker saw, they're merged into one for the report
+type stats struct {
+	latencies   []time.Duration
+	statuses    map[response.StatusCode]int
+	errors      map[string]int
+	connections int
+	retried     int
+	sent        int64
+	received    int64
+}
+
+func newStats() *stats {
+	return &stats{statuses: map[response.StatusCode]int{}, errors: map[string]int{}}
+}
+
+func (s *stats) done(code response.StatusCode, latency time.Duration) {
+	s.statuses[code]++
+	s.latencies = append(s.latencies, latency)
+}
+
+// fail counts err under the step it happened in and what kind of error it is, the
+// messages themselves have addresses and ports in them that would split the counts
+func (s *stats) fail(step string, err error) {
+	var netErr net.Error
+	var opErr *net.OpError
+
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		step += ": timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		step += ": connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		step += ": connection reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		step += ": connection closed"
+	case errors.As(err, &opErr):
+		step += ": " + opErr.Err.Error()
+	default:
+		step += ": " + err.Error()
+	}
+
+	s.errors[step]++
+}
+
+// add counts the bytes of a connection that's done with
+func (s *stats) add(conn *countingConn) {
+	s.connections++
+	s.sent += conn.written
+	s.received += conn.read
+}
+
+func (s *stats) merge(other *stats) {
+	s.latencies = append(s.latencies, other.latencies...)
+	for code, n := range other.statuses {
+		s.statuses[code] += n
+	}
+	for kind, n := range other.errors {
+		s.errors[kind] += n
+	}
+	s.connections += other.connections
+	s.retried += other.retried
+	s.sent += other.sent
+	s.received += other.received
+}
+
+// report is the summary of a run, latencies are in milliseconds
+type report struct {
+	Requests      int            `json:"requests"`
+	Errors        int            `json:"errors"`
+	Seconds       float64        `json:"seconds"`
+	Throughput    float64        `json:"requests_per_second"`
+	Statuses      map[string]int `json:"statuses"`
+	ErrorKinds    map[string]int `json:"error_kinds"`
+	Latency       latency        `json:"latency_ms"`
+	Connections   int            `json:"connections"`
+	Retried       int            `json:"retried"`
+	BytesSent     int64          `json:"bytes_sent"`
+	BytesReceived int64          `json:"bytes_received"`
+}
+
+type latency struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func (s *stats) report(elapsed time.Duration) *report {
+	r := &report{
+		Requests:      len(s.latencies),
+		Seconds:       elapsed.Seconds(),
+		Statuses:      map[string]int{},
+		ErrorKinds:    s.errors,
+		Connections:   s.connections,
+		Retried:       s.retried,
+		BytesSent:     s.sent,
+		BytesReceived: s.received,
+	}
+
+	for code, n := range s.statuses {
+		r.Statuses[fmt.Sprint(code)] = n
+	}
+	for _, n := range s.errors {
+		r.Errors += n
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(r.Requests) / elapsed.Seconds()
+	}
+
+	if len(s.latencies) == 0 {
+		return r
+	}
+
+	slices.Sort(s.latencies)
+	total := time.Duration(0)
+	for _, l := range s.latencies {
+		total += l
+	}
+
+	r.Latency = latency{
+		Mean: ms(total / time.Duration(len(s.latencies))),
+		P50:  ms(percentile(s.latencies, 0.50)),
+		P90:  ms(percentile(s.latencies, 0.90)),
+		P99:  ms(percentile(s.latencies, 0.99)),
+		Max:  ms(s.latencies[len(s.latencies)-1]),
+	}
+
+	return r
+}
+
+// percentile takes the nearest rank of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r *report) print(w io.Writer) {
+	fmt.Fprintf(w, "requests:     %d in %.2fs, %.1f per second\n", r.Requests, r.Seconds, r.Throughput)
+	fmt.Fprintf(w, "latency:      mean %.2fms, p50 %.2fms, p90 %.2fms, p99 %.2fms, max %.2fms\n",
+		r.Latency.Mean, r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+	fmt.Fprintf(w, "status codes: %s\n", counts(r.Statuses))
+	if r.Errors > 0 {
+		fmt.Fprintf(w, "errors:       %d, %s\n", r.Errors, counts(r.ErrorKinds))
+	} else {
+		fmt.Fprintln(w, "errors:       0")
+	}
+	fmt.Fprintf(w, "connections:  %d, %d requests sent again after a close\n", r.Connections, r.Retried)
+	fmt.Fprintf(w, "transferred:  %d bytes sent, %d bytes received\n", r.BytesSent, r.BytesReceived)
+}
+
+// counts formats the counts by key, the largest first
+func counts(m map[string]int) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if m[a] != m[b] {
+			return m[b] - m[a]
+		}
+		return strings.Compare(a, b)
+	})
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s x%d", key, m[key]))
+	}
+
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/capture"
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+)
+
+// options are the flags every replayed connection needs
+type options struct {
+	target   *url.URL
+	speed    float64
+	timeout  time.Duration
+	insecure bool
+	ignore   []string
+}
+
+// result is how a replayed connection went, one exchange per response that was recorded
+type result struct {
+	conn      *capture.Conn
+	exchanges []exchange
+	err       error
+}
+
+type exchange struct {
+	request     string
+	differences []string
+	err         error
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("httpreplay: ")
+
+	rawTarget := flag.String("target", "http://localhost:42069", "url of the server the captured requests are sent to, only its scheme and host are used")
+	speed := flag.Float64("speed", 1, "how much faster than recorded requests are sent, zero sends them one connection at a time as fast as possible")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long a replayed connection can take")
+	insecure := flag.Bool("k", false, "don't verify the server's certificate")
+	ignore := flag.String("ignore-header", "Date", "comma separated headers left out of the comparison")
+	verbose := flag.Bool("v", false, "list the responses that matched too")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: httpreplay [flags] capture-file")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *speed < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	target, err := url.Parse(*rawTarget)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		log.Fatalf("want an http or https target url, got %q", *rawTarget)
+	}
+
+	captureFile, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	conns, err := capture.ReadConns(captureFile)
+	captureFile.Close()
+	if err != nil {
+		log.Fatalf("Error reading capture: %v", err)
+	}
+
+	opts := &options{target: target, speed: *speed, timeout: *timeout, insecure: *insecure}
+	for _, name := range strings.Split(*ignore, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			opts.ignore = append(opts.ignore, strings.ToLower(name))
+		}
+	}
+
+	results := replayAll(conns, opts)
+
+	same, different, failed := 0, 0, 0
+	for _, res := range results {
+		fmt.Print(res.format(*verbose))
+
+		if res.err != nil {
+			failed++
+		}
+		for _, ex := range res.exchanges {
+			switch {
+			case ex.err != nil:
+				failed++
+			case len(ex.differences) > 0:
+				different++
+			default:
+				same++
+			}
+		}
+	}
+
+	fmt.Printf("replayed %d connections: %d responses the same, %d different, %d failed\n", len(results), same, different, failed)
+	if different > 0 || failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// replayAll replays the connections starting as far apart as they did when recorded,
+// scaled by the speed, or one after the other when the speed is zero
+func replayAll(conns []*capture.Conn, opts *options) []*result {
+	results := make([]*result, len(conns))
+
+	if opts.speed == 0 {
+		for i, conn := range conns {
+			results[i] = replay(conn, opts)
+		}
+
+		return results
+	}
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i, conn := range conns {
+		time.Sleep(time.Until(start.Add(opts.scale(conn.Opened.Sub(conns[0].Opened)))))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = replay(conn, opts)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (o *options) scale(d time.Duration) time.Duration {
+	if o.speed == 0 {
+		return 0
+	}
+
+	return time.Duration(float64(d) / o.speed)
+}
+
+// replay sends what the client sent on a new connection, with the same pauses between
+// reads the server saw, and compares the responses that come back with the recorded ones
+func replay(captured *capture.Conn, opts *options) *result {
+	res := &result{conn: captured}
+
+	methods, targets := parseRequests(captured.Inbound())
+	recorded := parseResponses(captured.Outbound(), methods)
+	if len(recorded) == 0 {
+		res.err = fmt.Errorf("no response was recorded")
+		return res
+	}
+
+	conn, err := dial(opts)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(opts.timeout))
+
+	start := time.Now()
+	done := make(chan struct{})
+	sendErr := make(chan error, 1)
+	go func() {
+		for _, e := range captured.Events {
+			if e.Kind != capture.KindIn {
+				continue
+			}
+
+			select {
+			case <-time.After(time.Until(start.Add(opts.scale(e.Time.Sub(captured.Opened))))):
+			case <-done:
+				sendErr <- nil
+				return
+			}
+
+			_, err := conn.Write(e.Data)
+			if err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- nil
+	}()
+
+	var live *response.Response
+	for i, want := range recorded {
+		ex := exchange{request: "unparsable request"}
+		if i < len(targets) {
+			ex.request = methods[i] + " " + targets[i]
+		}
+
+		if live == nil {
+			live, err = response.ResponseFromReader(conn, methodAt(methods, i))
+		} else {
+			live, err = live.Next(methodAt(methods, i))
+		}
+		var body []byte
+		if err == nil {
+			body, err = live.ReadBody()
+		}
+		if err != nil {
+			ex.err = err
+			res.exchanges = append(res.exchanges, ex)
+			break
+		}
+		live.Body = io.NopCloser(bytes.NewReader(body))
+
+		ex.differences = compare(want, live, opts.ignore)
+		res.exchanges = append(res.exchanges, ex)
+	}
+
+	// what the client sent after the last response doesn't matter anymore
+	close(done)
+	conn.Close()
+	<-sendErr
+
+	return res
+}
+
+// parseRequests reads the methods and the targets of the requests the client sent,
+// up to the first one that didn't parse
+func parseRequests(data []byte) ([]string, []string) {
+	methods := []string{}
+	targets := []string{}
+
+	// every request is read from where the last one ended, part of that is in its buffer
+	// and the rest is still on the reader
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		_, err := reader.Peek(1)
+		if err != nil {
+			break
+		}
+
+		req, err := request.RequestFromReader(reader)
+		if err != nil || req.RequestLine.Method == "" {
+			break
+		}
+
+		methods = append(methods, req.RequestLine.Method)
+		targets = append(targets, req.RequestLine.RequestTarget)
+
+		reader = bufio.NewReader(req.Rest())
+	}
+
+	return methods, targets
+}
+
+// parseResponses reads the recorded responses, the ones past the parsed requests are
+// taken as answers to GET
+func parseResponses(data []byte, methods []string) []*response.Response {
+	responses := []*response.Response{}
+
+	var res *response.Response
+	var err error
+	for i := 0; ; i++ {
+		if res == nil {
+			res, err = response.ResponseFromReader(bytes.NewReader(data), methodAt(methods, i))
+		} else {
+			res, err = res.Next(methodAt(methods, i))
+		}
+		if err != nil {
+			return responses
+		}
+
+		body, err := res.ReadBody()
+		if err != nil {
+			return responses
+		}
+		// the body is read off the recording to get to the next response, it's kept for the comparison
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		responses = append(responses, res)
+
+		// a switched protocol isn't http anymore
+		if res.StatusLine.StatusCode == response.StatusSwitchingProtocols {
+			return responses
+		}
+	}
+}
+
+func methodAt(methods []string, i int) string {
+	if i < len(methods) {
+		return methods[i]
+	}
+
+	return "GET"
+}
+
+// compare lists what's different between the recorded response and the live one, both
+// bodies are read
+func compare(want, live *response.Response, ignore []string) []string {
+	differences := []string{}
+
+	if want.StatusLine != live.StatusLine {
+		differences = append(differences, fmt.Sprintf("status: %s -> %s", formatStatus(want.StatusLine), formatStatus(live.StatusLine)))
+	}
+
+	differences = append(differences, compareFields("header", want.Headers, live.Headers, ignore)...)
+	differences = append(differences, compareFields("trailer", want.Trailers, live.Trailers, ignore)...)
+
+	wantBody, _ := want.ReadBody()
+	liveBody, _ := live.ReadBody()
+
+	if !bytes.Equal(wantBody, liveBody) {
+		offset := 0
+		for offset < len(wantBody) && offset < len(liveBody) && wantBody[offset] == liveBody[offset] {
+			offset++
+		}
+		differences = append(differences, fmt.Sprintf("body: %d bytes -> %d bytes, first difference at offset %d", len(wantBody), len(liveBody), offset))
+	}
+
+	return differences
+}
+
+func formatStatus(line response.StatusLine) string {
+	return strings.TrimSpace(fmt.Sprintf("HTTP/%s %d %s", line.HttpVersion, line.StatusCode, line.ReasonPhrase))
+}
+
+// compareFields compares the fields under their lowercased names, parsed fields are
+// stored that way already
+func compareFields(kind string, want, live headers.Headers, ignore []string) []string {
+	names := []string{}
+	for _, h := range []headers.Headers{want, live} {
+		for key := range h {
+			name := strings.ToLower(key)
+			if !slices.Contains(names, name) && !slices.Contains(ignore, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+
+	differences := []string{}
+	for _, name := range names {
+		wantValue, inWant := want.Get(name)
+		liveValue, inLive := live.Get(name)
+
+		switch {
+		case !inLive:
+			differences = append(differences, fmt.Sprintf("%s %s: %q -> missing", kind, headers.CanonicalName(name), wantValue))
+		case !inWant:
+			differences = append(differences, fmt.Sprintf("%s %s: missing -> %q", kind, headers.CanonicalName(name), liveValue))
+		case wantValue != liveValue:
+			differences = append(differences, fmt.Sprintf("%s %s: %q -> %q", kind, headers.CanonicalName(name), wantValue, liveValue))
+		}
+	}
+
+	return differences
+}
+
+func dial(opts *options) (net.Conn, error) {
+	host := opts.target.Host
+	if opts.target.Port() == "" {
+		port := "80"
+		if opts.target.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(opts.target.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: opts.timeout}
+	if opts.target.Scheme == "https" {
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{
+			ServerName:         opts.target.Hostname(),
+			InsecureSkipVerify: opts.insecure,
+		})
+	}
+
+	return dialer.Dial("tcp", host)
+}
+
+func (r *result) format(verbose bool) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "conn %d from %s", r.conn.ID, r.conn.Remote)
+
+	if r.err != nil {
+		fmt.Fprintf(b, ": %v\n", r.err)
+		return b.String()
+	}
+
+	header := b.String()
+	b.Reset()
+	for _, ex := range r.exchanges {
+		switch {
+		case ex.err != nil:
+			fmt.Fprintf(b, "%s, %s: failed: %v\n", header, ex.request, ex.err)
+		case len(ex.differences) > 0:
+			fmt.Fprintf(b, "%s, %s: different\n", header, ex.request)
+			for _, difference := range ex.differences {
+				fmt.Fprintf(b, "    %s\n", difference)
+			}
+		case verbose:
+			fmt.Fprintf(b, "%s, %s: same\n", header, ex.request)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRequests(t *testing.T) {
+	// Test: Pipelined requests are all read, past what the parser buffered with the first one
+	data := "GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /notes HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 26\r\n\r\n" +
+		strings.Repeat("note ", 5) + "\n" +
+		"PUT /notes/1 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n" +
+		"DELETE /notes/1 HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	methods, targets := parseRequests([]byte(data))
+	assert.Equal(t, []string{"GET", "POST", "PUT", "DELETE"}, methods)
+	assert.Equal(t, []string{"/first", "/notes", "/notes/1", "/notes/1"}, targets)
+
+	// Test: Reading stops at the first request that doesn't parse
+	methods, targets = parseRequests([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\nNOT A REQUEST\r\n\r\n"))
+	assert.Equal(t, []string{"GET"}, methods)
+	assert.Equal(t, []string{"/"}, targets)
+}
@@ -1,26 +1,114 @@
 package main
 
 import (
-	"crypto/sha256"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/magicznykacpur/httpfromtcp/internal/capture"
+	"github.com/magicznykacpur/httpfromtcp/internal/digest"
+	"github.com/magicznykacpur/httpfromtcp/internal/har"
 	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/httpbin"
+	"github.com/magicznykacpur/httpfromtcp/internal/proxy"
 	"github.com/magicznykacpur/httpfromtcp/internal/request"
 	"github.com/magicznykacpur/httpfromtcp/internal/response"
 	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/magicznykacpur/httpfromtcp/internal/sse"
+	"github.com/magicznykacpur/httpfromtcp/internal/websocket"
 )
 
 const port = 42069
 
+// httpbinHandler serves /httpbin/, either locally or by proxying to the upstreams
+var httpbinHandler server.Handler
+
+// forward handles absolute-form and CONNECT requests, it's nil unless forward proxying is on
+var forward *proxy.Forward
+
 func main() {
-	server, err := server.Serve(port, handler)
+	localHttpbin := flag.Bool("local-httpbin", false, "serve /httpbin/ locally instead of proxying it")
+	upstreams := flag.String("upstream", "https://httpbin.org", "comma separated upstreams /httpbin/ is proxied to")
+	balance := flag.String("balance", "round-robin", "how requests are spread over the upstreams: round-robin, least-connections or consistent-hash")
+	healthPath := flag.String("health-check", "", "path probed on every upstream to eject unhealthy ones, probing is off when empty")
+	forwardAllow := flag.String("forward-allow", "", "comma separated host or host:port destinations the server forwards to as an http proxy, forwarding is off when empty")
+	proxyAuth := flag.String("proxy-auth", "", "user:password clients of the forward proxy have to authenticate with")
+	capturePath := flag.String("capture", "", "file the bytes of every connection are recorded to for httpreplay, nothing is recorded when empty")
+	harPath := flag.String("har", "", "file every request and its response are written to as an HTTP Archive, nothing is written when empty")
+	harMaxBody := flag.Int("har-max-body", 1024*1024, "bytes of a request or response body kept in the archive")
+	harMaxSize := flag.Int64("har-max-size", 0, "bytes the archive can grow to before requests stop being added, zero is no limit")
+	harRedact := flag.String("har-redact", "Authorization,Proxy-Authorization,Cookie,Set-Cookie", "comma separated headers whose values are redacted in the archive")
+	flag.Parse()
+
+	if *localHttpbin {
+		httpbinHandler = httpbin.Handler("/httpbin")
+	} else {
+		p, err := newProxy(*upstreams, *balance, *healthPath)
+		if err != nil {
+			log.Fatalf("Error configuring proxy: %v", err)
+		}
+		defer p.Close()
+		httpbinHandler = digest.Middleware(p.Handle)
+	}
+
+	if *forwardAllow != "" {
+		forwardOpts := []proxy.ForwardOption{proxy.WithAllowedDestinations(strings.Split(*forwardAllow, ",")...)}
+		if *proxyAuth != "" {
+			username, password, _ := strings.Cut(*proxyAuth, ":")
+			forwardOpts = append(forwardOpts, proxy.WithProxyAuth(username, password))
+		}
+
+		forward = proxy.NewForward(forwardOpts...)
+	}
+
+	serverOpts := []server.Option{}
+	if *capturePath != "" {
+		captureFile, err := os.Create(*capturePath)
+		if err != nil {
+			log.Fatalf("Error creating capture file: %v", err)
+		}
+		defer captureFile.Close()
+
+		serverOpts = append(serverOpts, server.WithCapture(capture.NewRecorder(captureFile)))
+	}
+
+	if *harPath != "" {
+		if *harMaxBody < 0 || *harMaxSize < 0 {
+			log.Fatalf("Error: -har-max-body and -har-max-size can't be negative")
+		}
+
+		harFile, err := os.Create(*harPath)
+		if err != nil {
+			log.Fatalf("Error creating har file: %v", err)
+		}
+		defer harFile.Close()
+
+		redacted := []string{}
+		for _, name := range strings.Split(*harRedact, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				redacted = append(redacted, name)
+			}
+		}
+
+		recorder, err := har.NewRecorder(harFile,
+			har.WithMaxBodySize(*harMaxBody),
+			har.WithMaxFileSize(*harMaxSize),
+			har.WithRedactedHeaders(redacted...),
+		)
+		if err != nil {
+			log.Fatalf("Error writing har file: %v", err)
+		}
+
+		serverOpts = append(serverOpts, server.WithHAR(recorder))
+	}
+
+	server, err := server.Serve(port, handler, serverOpts...)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
@@ -33,99 +121,73 @@ func main() {
 	log.Println("Server gracefully stopped")
 }
 
-func handler(w response.Writer, r *request.Request) *server.HandlerError {
-	if r.RequestLine.RequestTarget == "/video" {
-		handlerGetVideo(w)
-		return nil
-	}
+func handler(w *response.Writer, r *request.Request) *server.HandlerError {
+	if r.RequestLine.Method == "CONNECT" || proxy.IsAbsoluteForm(r.RequestLine.RequestTarget) {
+		if forward == nil {
+			return handlerNotForwarding(r)
+		}
 
-	if strings.HasPrefix(r.RequestLine.RequestTarget, "/httpbin/") {
-		proxyHandler(w, r)
-		return nil
+		return forward.Handle(w, r)
 	}
 
-	if r.RequestLine.RequestTarget == "/yourproblem" {
-		handler400()
-		return nil
+	if r.RequestLine.RequestTarget == "/video" {
+		return handlerGetVideo(w)
 	}
 
-	if r.RequestLine.RequestTarget == "/myproblem" {
-		handler500()
-		return nil
+	if strings.HasPrefix(r.RequestLine.RequestTarget, "/httpbin/") {
+		return httpbinHandler(w, r)
 	}
 
-	handler200(w)
-	return nil
-}
-
-func proxyHandler(w response.Writer, r *request.Request) *server.HandlerError {
-	target := strings.TrimPrefix(r.RequestLine.RequestTarget, "/httpbin/")
-
-	res, err := http.Get(fmt.Sprintf("https://httpbin.org/%s", target))
-	if err != nil {
-		return getUnknownHandlerError(err)
+	if r.RequestLine.RequestTarget == "/ws/echo" {
+		return handlerEcho(w, r)
 	}
-	defer res.Body.Close()
 
-	err = w.WriteStatusLine(response.StatusOk)
-	if err != nil {
-		getUnknownHandlerError(err)
+	if r.RequestLine.RequestTarget == "/sse/clock" {
+		return handlerClock(w, r)
 	}
 
-	resHeaders := headers.NewHeaders()
-	resHeaders.Set("Transfer-Encoding", "chunked")
-	resHeaders.Set("Connection", "close")
-	resHeaders.Set("Trailer", "X-Content-Sha256, X-Content-Length")
-
-	err = w.WriteHeaders(resHeaders)
-	if err != nil {
-		return getUnknownHandlerError(err)
+	if r.RequestLine.RequestTarget == "/yourproblem" {
+		return handler400()
 	}
 
-	buff := make([]byte, 1024)
-	fullBody := make([]byte, 0)
-	for {
-		n, err := res.Body.Read(buff)
-
-		if n > 0 {
-			_, err := w.WriteChunkedBody(buff[:n])
-			if err != nil {
-				fmt.Println("Error writing chunked body:", err)
-				break
-			}
-
-			fullBody = append(fullBody, buff[:n]...)
-		}
+	if r.RequestLine.RequestTarget == "/myproblem" {
+		return handler500()
+	}
 
-		if err == io.EOF {
-			break
-		}
+	return handler200(w)
+}
 
+func newProxy(rawUpstreams, balance, healthPath string) (*proxy.Proxy, error) {
+	upstreams := []*proxy.Upstream{}
+	for _, rawURL := range strings.Split(rawUpstreams, ",") {
+		upstream, err := proxy.NewUpstream(strings.TrimSpace(rawURL))
 		if err != nil {
-			fmt.Println("Error reading response body:", err)
-			break
+			return nil, err
 		}
-
+		upstreams = append(upstreams, upstream)
 	}
 
-	_, err = w.WriteChunkedBodyDone()
-	if err != nil {
-		return getUnknownHandlerError(err)
+	var balancer proxy.Balancer
+	switch balance {
+	case "round-robin":
+		balancer = proxy.NewRoundRobin(upstreams)
+	case "least-connections":
+		balancer = proxy.NewLeastConnections(upstreams)
+	case "consistent-hash":
+		balancer = proxy.NewConsistentHash(upstreams, nil)
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %s", balance)
 	}
 
-	trailerHeaders := headers.NewHeaders()
-	trailerHeaders.Set("X-Content-Sha256", fmt.Sprintf("%x", sha256.Sum256(fullBody)))
-	trailerHeaders.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-
-	err = w.WriteTrailers(trailerHeaders)
-	if err != nil {
-		return getUnknownHandlerError(err)
+	opts := []proxy.Option{proxy.WithStripPrefix("/httpbin")}
+	if healthPath != "" {
+		opts = append(opts, proxy.WithHealthCheck(proxy.HealthCheck{Path: healthPath}))
 	}
 
-	return nil
+	return proxy.New(balancer, opts...), nil
 }
 
-func handlerGetVideo(w response.Writer) *server.HandlerError {
+func handlerGetVideo(w *response.Writer) *server.HandlerError {
 	err := w.WriteStatusLine(response.StatusOk)
 	if err != nil {
 		return getUnknownHandlerError(err)
@@ -152,6 +214,47 @@ func handlerGetVideo(w response.Writer) *server.HandlerError {
 	return nil
 }
 
+// handlerEcho sends every websocket message straight back
+func handlerEcho(w *response.Writer, r *request.Request) *server.HandlerError {
+	conn, hErr := websocket.Upgrade(w, r)
+	if hErr != nil {
+		return hErr
+	}
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil
+		}
+
+		err = conn.WriteMessage(messageType, data)
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// handlerClock streams the time every second as server-sent events
+func handlerClock(w *response.Writer, r *request.Request) *server.HandlerError {
+	stream, err := sse.NewStream(w, r)
+	if err != nil {
+		return getUnknownHandlerError(err)
+	}
+	defer stream.Close()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stream.Done():
+			return nil
+		case now := <-ticker.C:
+			stream.Send(sse.Event{ID: strconv.FormatInt(now.Unix(), 10), Event: "tick", Data: now.UTC().Format(time.RFC3339)})
+		}
+	}
+}
+
 func handler400() *server.HandlerError {
 	errorHeaders := headers.NewHeaders()
 	errorHeaders.Set("Content-Type", "text/html")
@@ -163,6 +266,24 @@ func handler400() *server.HandlerError {
 	}
 }
 
+// handlerNotForwarding answers proxy requests while -forward-allow is off, a 200 to CONNECT
+// would tell the client its tunnel is up
+func handlerNotForwarding(r *request.Request) *server.HandlerError {
+	errorHeaders := headers.NewHeaders()
+	errorHeaders.Set("Content-Type", "text/plain")
+
+	statusCode := response.StatusForbidden
+	if r.RequestLine.Method == "CONNECT" {
+		statusCode = response.StatusNotImplemented
+	}
+
+	return &server.HandlerError{
+		StatusCode: response.StatusCode(statusCode),
+		Headers:    errorHeaders,
+		Body:       []byte("forwarding is off"),
+	}
+}
+
 func handler500() *server.HandlerError {
 	errorHeaders := headers.NewHeaders()
 	errorHeaders.Set("Content-Type", "text/html")
@@ -174,14 +295,14 @@ func handler500() *server.HandlerError {
 	}
 }
 
-func handler200(w response.Writer) *server.HandlerError {
+func handler200(w *response.Writer) *server.HandlerError {
 	err := w.WriteStatusLine(response.StatusOk)
 	if err != nil {
 		return getUnknownHandlerError(err)
 	}
 
-	headers := response.GetDefaultHeaders(len(okRequest))
-	headers.OverrideHeader("Content-Type", "text/html")
+	headers := headers.NewHeaders()
+	headers.Set("Content-Type", "text/html")
 
 	err = w.WriteHeaders(headers)
 	if err != nil {
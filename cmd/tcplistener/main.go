@@ -1,20 +1,75 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/magicznykacpur/httpfromtcp/internal/capture"
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
 	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
 )
 
+// readSize is how much a single read from the connection asks for, large enough that
+// the sizes reads come back with are the ones the client's segments arrived in
+const readSize = 64 * 1024
+
+// reply is the canned response sent back once a request is read, nil sends nothing
+type reply struct {
+	status  response.StatusCode
+	headers headers.Headers
+	body    []byte
+	// raw is sent as it is instead, for responses the writer wouldn't produce
+	raw []byte
+}
+
+// output keeps the reports of connections handled at the same time from interleaving
+var output sync.Mutex
+
 func main() {
-	listener, err := net.Listen("tcp", ":42069")
+	var replyFields headers.Fields
+	addr := flag.String("addr", ":42069", "address to listen on")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long a connection can stay quiet before the request is given up on")
+	replyStatus := flag.Int("reply", 0, "status code of a response sent back to every request, nothing is sent when zero")
+	flag.Var(&replyFields, "reply-header", "header of the -reply response as Name: value, can be given more than once")
+	replyBody := flag.String("reply-body", "", "body of the -reply response")
+	replyRaw := flag.String("reply-raw", "", "file sent back byte for byte to every request instead of -reply")
+	capturePath := flag.String("capture", "", "file the bytes of every connection are recorded to for httpreplay, nothing is recorded when empty")
+	flag.Parse()
+
+	canned, err := newReply(*replyStatus, replyFields, *replyBody, *replyRaw)
+	if err != nil {
+		log.Fatalf("Invalid reply: %v", err)
+	}
+
+	var recorder *capture.Recorder
+	if *capturePath != "" {
+		captureFile, err := os.Create(*capturePath)
+		if err != nil {
+			log.Fatalf("Couldn't create capture file: %v", err)
+		}
+		defer captureFile.Close()
+
+		recorder = capture.NewRecorder(captureFile)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
-		log.Fatalf("Couldn't open tcp listener on port 42069: %v", err)
+		log.Fatalf("Couldn't open tcp listener on %s: %v", *addr, err)
 	}
 
-	log.Println("listening for tcp request on :42069")
+	log.Println("listening for tcp request on", listener.Addr())
 
 	defer listener.Close()
 
@@ -24,20 +79,217 @@ func main() {
 			log.Fatalf("Couldn't accept connection: %v", err)
 		}
 
-		req, err := request.RequestFromReader(connection)
+		if recorder != nil {
+			connection = recorder.Wrap(connection)
+		}
+
+		go inspect(connection, *timeout, canned)
+	}
+}
+
+func newReply(status int, fields headers.Fields, body, rawPath string) (*reply, error) {
+	if rawPath != "" {
+		raw, err := os.ReadFile(rawPath)
 		if err != nil {
-			log.Printf("%v", err)
+			return nil, err
+		}
+
+		return &reply{raw: raw}, nil
+	}
+
+	if status == 0 {
+		return nil, nil
+	}
+
+	if status < 200 || status > 599 {
+		return nil, fmt.Errorf("status code %d can't be sent as a reply", status)
+	}
+
+	h := headers.NewHeaders()
+	fields.AddTo(h)
+
+	return &reply{status: response.StatusCode(status), headers: h, body: []byte(body)}, nil
+}
+
+// inspect reads a request off conn and prints what came in: every read with its size
+// and timing, the parsed request or the error, and a dump of the raw bytes
+func inspect(conn net.Conn, timeout time.Duration, canned *reply) {
+	defer conn.Close()
+
+	rec := &recorder{conn: conn, timeout: timeout, start: time.Now()}
+	req, parseErr := request.RequestFromReader(rec)
+
+	var replyErr error
+	if canned != nil {
+		replyErr = canned.send(conn, req)
+	}
+
+	report := &bytes.Buffer{}
+	fmt.Fprintf(report, "Connection from %s at %s\n", conn.RemoteAddr(), rec.start.Format(time.TimeOnly+".000"))
+
+	fmt.Fprintln(report, "Reads:")
+	for i, read := range rec.reads {
+		fmt.Fprintf(report, "- #%d: %d bytes at offset %d after %s\n", i+1, read.size, read.offset, read.at)
+	}
+	if rec.err != nil && !errors.Is(rec.err, io.EOF) {
+		fmt.Fprintf(report, "- stopped: %v\n", rec.err)
+	}
+
+	offset := -1
+	if parseErr != nil {
+		fmt.Fprintf(report, "Error: %v\n", parseErr)
+
+		var syntaxErr *request.ParseError
+		if errors.As(parseErr, &syntaxErr) {
+			offset = syntaxErr.Offset
+			fmt.Fprintf(report, "Parsing failed at offset %d (0x%x)\n", offset, offset)
 		}
+	} else {
+		printRequest(report, req)
+	}
 
-		fmt.Println("Request line:")
-		fmt.Printf("- Method: %s\n", req.RequestLine.Method)
-		fmt.Printf("- Target: %s\n", req.RequestLine.RequestTarget)
-		fmt.Printf("- Version: %s\n", req.RequestLine.HttpVersion)
-		fmt.Println("Headers:")
-		for key, value := range req.Headers {
-			fmt.Printf("- %s: %s\n", key, value)
+	fmt.Fprintf(report, "Raw bytes (%d):\n", len(rec.data))
+	report.WriteString(dump(rec.data, offset))
+
+	if canned != nil {
+		if replyErr != nil {
+			fmt.Fprintf(report, "Reply failed: %v\n", replyErr)
+		} else {
+			fmt.Fprintln(report, "Reply sent")
 		}
-		fmt.Println("Body:")
-		fmt.Println(string(req.Body))
 	}
+
+	output.Lock()
+	defer output.Unlock()
+	fmt.Println(report.String())
+}
+
+func printRequest(w io.Writer, req *request.Request) {
+	fmt.Fprintln(w, "Request line:")
+	fmt.Fprintf(w, "- Method: %s\n", req.RequestLine.Method)
+	fmt.Fprintf(w, "- Target: %s\n", req.RequestLine.RequestTarget)
+	fmt.Fprintf(w, "- Version: %s\n", req.RequestLine.HttpVersion)
+	fmt.Fprintln(w, "Headers:")
+	printFields(w, req.Headers)
+	fmt.Fprintln(w, "Body:")
+	fmt.Fprintln(w, string(req.Body))
+	if len(req.Trailers) > 0 {
+		fmt.Fprintln(w, "Trailers:")
+		printFields(w, req.Trailers)
+	}
+}
+
+func printFields(w io.Writer, h headers.Headers) {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		for _, value := range h[key] {
+			fmt.Fprintf(w, "- %s: %s\n", key, value)
+		}
+	}
+}
+
+// dump is a hex and ascii dump of data, a caret under the hex column marks offset
+// when it's in range
+func dump(data []byte, offset int) string {
+	lines := strings.SplitAfter(hex.Dump(data), "\n")
+
+	b := &strings.Builder{}
+	for i, line := range lines {
+		b.WriteString(line)
+
+		if offset >= 0 && offset < len(data) && offset/16 == i {
+			// the hex column starts after the 8 digit offset and two spaces, with an extra space halfway
+			column := offset % 16
+			padding := 10 + column*3
+			if column >= 8 {
+				padding++
+			}
+			fmt.Fprintf(b, "%s^^ here\n", strings.Repeat(" ", padding))
+		}
+	}
+
+	if offset >= len(data) {
+		fmt.Fprintf(b, "%08x  ^^ here, past the last byte\n", offset)
+	}
+
+	return b.String()
+}
+
+// send writes the canned response, the writer doesn't know the request when it didn't parse
+func (r *reply) send(conn net.Conn, req *request.Request) error {
+	if r.raw != nil {
+		_, err := conn.Write(r.raw)
+		return err
+	}
+
+	w := response.NewWriter(conn)
+	w.Request = req
+	w.CloseConnection = true
+
+	err := w.WriteStatusLine(r.status)
+	if err != nil {
+		return err
+	}
+
+	err = w.WriteHeaders(r.headers)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.WriteBody(r.body)
+	if err != nil {
+		return err
+	}
+
+	return w.Finish()
+}
+
+// recorder reads from the connection in large reads, keeps every byte and notes when
+// each read came back and how big it was. The parser's own smaller reads are served
+// from what was kept.
+type recorder struct {
+	conn    net.Conn
+	timeout time.Duration
+	start   time.Time
+	data    []byte
+	pos     int
+	reads   []read
+	err     error
+}
+
+type read struct {
+	offset int
+	size   int
+	at     time.Duration
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	if r.pos == len(r.data) {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+		buf := make([]byte, readSize)
+		n, err := r.conn.Read(buf)
+		if n > 0 {
+			r.reads = append(r.reads, read{offset: len(r.data), size: n, at: time.Since(r.start)})
+			r.data = append(r.data, buf[:n]...)
+		}
+		if err != nil {
+			r.err = err
+		}
+		if n == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.data[r.pos:])
+	r.pos += n
+	return n, nil
 }
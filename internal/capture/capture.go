@@ -0,0 +1,193 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindOpen  Kind = "open"
+	KindIn    Kind = "in"
+	KindOut   Kind = "out"
+	KindClose Kind = "close"
+)
+
+// Event is a line of a capture file, something that happened on a connection. Data is
+// what was read from the client for in events and what was written to it for out events.
+type Event struct {
+	Conn   uint64    `json:"conn"`
+	Time   time.Time `json:"time"`
+	Kind   Kind      `json:"kind"`
+	Remote string    `json:"remote,omitempty"`
+	Data   []byte    `json:"data,omitempty"`
+}
+
+// Recorder writes the events of the connections it wraps to a capture file, one json
+// object per line. Connections are numbered in the order they're wrapped.
+type Recorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	nextID uint64
+	now    func() time.Time
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w), now: time.Now}
+}
+
+// Wrap returns conn with everything read from it and written to it recorded, and its
+// opening and closing.
+func (r *Recorder) Wrap(conn net.Conn) net.Conn {
+	r.mu.Lock()
+	r.nextID++
+	id := r.nextID
+	r.mu.Unlock()
+
+	r.record(Event{Conn: id, Kind: KindOpen, Remote: conn.RemoteAddr().String()})
+
+	return &recordedConn{Conn: conn, id: id, recorder: r}
+}
+
+// record stamps and writes e, a capture that can't be written is given up on rather
+// than failing the connection it's recording
+func (r *Recorder) record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e.Time = r.now()
+	r.enc.Encode(e)
+}
+
+type recordedConn struct {
+	net.Conn
+	id       uint64
+	recorder *Recorder
+	closed   sync.Once
+}
+
+func (c *recordedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.recorder.record(Event{Conn: c.id, Kind: KindIn, Data: slices.Clone(p[:n])})
+	}
+
+	return n, err
+}
+
+func (c *recordedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.recorder.record(Event{Conn: c.id, Kind: KindOut, Data: slices.Clone(p[:n])})
+	}
+
+	return n, err
+}
+
+// CloseWrite passes a half close on to the recorded connection
+func (c *recordedConn) CloseWrite() error {
+	halfCloser, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("connection can't be half closed")
+	}
+
+	return halfCloser.CloseWrite()
+}
+
+func (c *recordedConn) Close() error {
+	c.closed.Do(func() {
+		c.recorder.record(Event{Conn: c.id, Kind: KindClose})
+	})
+
+	return c.Conn.Close()
+}
+
+// Conn is a recorded connection with its in and out events in the order they happened.
+type Conn struct {
+	ID     uint64
+	Remote string
+	Opened time.Time
+	// Closed is zero when the capture ended before the connection did.
+	Closed time.Time
+	Events []Event
+}
+
+// Inbound is everything the client sent.
+func (c *Conn) Inbound() []byte {
+	return c.data(KindIn)
+}
+
+// Outbound is everything the client was sent.
+func (c *Conn) Outbound() []byte {
+	return c.data(KindOut)
+}
+
+func (c *Conn) data(kind Kind) []byte {
+	data := []byte{}
+	for _, e := range c.Events {
+		if e.Kind == kind {
+			data = append(data, e.Data...)
+		}
+	}
+
+	return data
+}
+
+// ReadConns reads a capture file and groups its events by connection, in the order the
+// connections were opened.
+func ReadConns(r io.Reader) ([]*Conn, error) {
+	conns := []*Conn{}
+	byID := map[uint64]*Conn{}
+
+	scanner := bufio.NewScanner(r)
+	// an event holds a whole read or write, those can be large
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var e Event
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event on line %d: %v", line, err)
+		}
+
+		conn, ok := byID[e.Conn]
+		if !ok {
+			if e.Kind != KindOpen {
+				return nil, fmt.Errorf("event on line %d is for connection %d that wasn't opened", line, e.Conn)
+			}
+
+			conn = &Conn{ID: e.Conn, Remote: e.Remote, Opened: e.Time}
+			byID[e.Conn] = conn
+			conns = append(conns, conn)
+			continue
+		}
+
+		switch e.Kind {
+		case KindIn, KindOut:
+			conn.Events = append(conn.Events, e)
+		case KindClose:
+			conn.Closed = e.Time
+		default:
+			return nil, fmt.Errorf("unexpected %s event on line %d", e.Kind, line)
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return conns, nil
+}
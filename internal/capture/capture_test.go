@@ -0,0 +1,84 @@
+package capture
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	captured := &bytes.Buffer{}
+	recorder := NewRecorder(captured)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	recorder.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	// Test: Connections are recorded separately and in order
+	client, server := net.Pipe()
+	defer client.Close()
+	first := recorder.Wrap(server)
+	other, otherServer := net.Pipe()
+	defer other.Close()
+	second := recorder.Wrap(otherServer)
+
+	go func() {
+		client.Write([]byte("hello "))
+		client.Write([]byte("there"))
+		buf := make([]byte, 16)
+		client.Read(buf)
+	}()
+
+	buf := make([]byte, 16)
+	n, err := first.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello ", string(buf[:n]))
+	n, err = first.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "there", string(buf[:n]))
+	_, err = first.Write([]byte("hi"))
+	require.NoError(t, err)
+	first.Close()
+	first.Close()
+
+	conns, err := ReadConns(bytes.NewReader(captured.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, conns, 2)
+	assert.Equal(t, uint64(1), conns[0].ID)
+	assert.Equal(t, "hello there", string(conns[0].Inbound()))
+	assert.Equal(t, "hi", string(conns[0].Outbound()))
+	require.Len(t, conns[0].Events, 3)
+	assert.Equal(t, KindIn, conns[0].Events[0].Kind)
+	assert.True(t, conns[0].Events[1].Time.After(conns[0].Events[0].Time))
+	assert.False(t, conns[0].Closed.IsZero())
+	assert.Equal(t, 1, strings.Count(captured.String(), `"kind":"close"`))
+
+	// Test: Connection still open when the capture ends
+	assert.Equal(t, uint64(2), conns[1].ID)
+	assert.Empty(t, conns[1].Events)
+	assert.True(t, conns[1].Closed.IsZero())
+	second.Close()
+}
+
+func TestReadConns(t *testing.T) {
+	// Test: Invalid json
+	_, err := ReadConns(strings.NewReader(`{"conn":1,"kind":"open"}` + "\n" + `{"conn":`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid event on line 2")
+
+	// Test: Event for a connection that wasn't opened
+	_, err = ReadConns(strings.NewReader(`{"conn":3,"kind":"in","data":"aGk="}`))
+	require.Error(t, err)
+	assert.Equal(t, "event on line 1 is for connection 3 that wasn't opened", err.Error())
+
+	// Test: Data is base64 in the file
+	conns, err := ReadConns(strings.NewReader(`{"conn":1,"kind":"open"}` + "\n\n" + `{"conn":1,"kind":"in","data":"aGk="}`))
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(conns[0].Inbound()))
+}
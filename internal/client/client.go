@@ -0,0 +1,531 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+)
+
+const defaultDialTimeout = 10 * time.Second
+const defaultMaxIdleConnsPerHost = 4
+const defaultIdleTimeout = 90 * time.Second
+const defaultMaxRedirects = 10
+
+// maxRedirectDrain is how much of a redirect's body is read to keep its connection,
+// anything longer isn't worth the wait and the connection is closed instead
+const maxRedirectDrain = 4 * 1024
+
+// managedHeaders are written by the client itself, from the url and the body
+var managedHeaders = []string{"host", "content-length", "transfer-encoding", "connection"}
+
+// idempotentMethods can be sent again when a reused connection turns out to be closed,
+// retrying anything else could apply the request twice
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+// Client sends requests over its own connections and reads the responses with the
+// response package. Connections are kept open for the next request to the same host
+// once a response is read to the end.
+type Client struct {
+	dialTimeout     time.Duration
+	headerTimeout   time.Duration
+	tlsConfig       *tls.Config
+	maxIdlePerHost  int
+	maxConnsPerHost int
+	idleTimeout     time.Duration
+	maxRedirects    int
+	jar             *Jar
+	trace           *Trace
+	pool            *pool
+}
+
+type Option func(*Client)
+
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = timeout
+	}
+}
+
+// WithResponseHeaderTimeout limits how long the server has to send the response head
+// once the request is written, zero waits as long as the request's context allows.
+func WithResponseHeaderTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.headerTimeout = timeout
+	}
+}
+
+// WithTLSConfig sets the configuration https connections are made with.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// WithMaxIdleConnsPerHost sets how many unused connections are kept open for each host,
+// zero turns keep-alive off and every request gets a connection of its own.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(c *Client) {
+		c.maxIdlePerHost = n
+	}
+}
+
+// WithMaxConnsPerHost limits how many connections to a host are in use at once, requests
+// past the limit wait for one to be free. Zero is no limit.
+func WithMaxConnsPerHost(n int) Option {
+	return func(c *Client) {
+		c.maxConnsPerHost = n
+	}
+}
+
+// WithIdleTimeout sets how long an unused connection is kept open, zero keeps it until
+// the server closes it.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.idleTimeout = timeout
+	}
+}
+
+// WithMaxRedirects sets how many redirects a request follows before Do gives up,
+// zero returns redirects as they are.
+func WithMaxRedirects(n int) Option {
+	return func(c *Client) {
+		c.maxRedirects = n
+	}
+}
+
+// WithJar stores the cookies from every response in jar and sends the matching ones
+// with every request, redirects included.
+func WithJar(jar *Jar) Option {
+	return func(c *Client) {
+		c.jar = jar
+	}
+}
+
+func New(opts ...Option) *Client {
+	c := &Client{
+		dialTimeout:    defaultDialTimeout,
+		maxIdlePerHost: defaultMaxIdleConnsPerHost,
+		idleTimeout:    defaultIdleTimeout,
+		maxRedirects:   defaultMaxRedirects,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.pool = newPool(c.maxIdlePerHost, c.maxConnsPerHost, c.idleTimeout)
+
+	return c
+}
+
+// CloseIdleConnections closes the connections kept for later requests, the ones in use
+// are closed once their response is done.
+func (c *Client) CloseIdleConnections() {
+	c.pool.closeIdle()
+}
+
+// NewRequest builds a request for Do, the target stays the absolute url and Do
+// sends it in origin-form to the host in it.
+func NewRequest(method, rawURL string, body []byte) (*request.Request, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme %q", target.Scheme)
+	}
+
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: target.String(),
+			HttpVersion:   "1.1",
+		},
+		Headers:  headers.NewHeaders(),
+		Body:     body,
+		Trailers: headers.NewHeaders(),
+	}, nil
+}
+
+// Do sends req to the server in its absolute-form target and returns the response as
+// soon as its head is read. The body streams from the connection, it has to be closed,
+// which reading it to the end does as well. Cancelling the request's context aborts it.
+// Redirects are followed up to the limit set with WithMaxRedirects. The body is sent
+// with a Content-Length, or chunked when the request has trailers or a Transfer-Encoding
+// ending in chunked.
+func (c *Client) Do(req *request.Request) (*response.Response, error) {
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("request target must be an absolute http or https url")
+	}
+
+	body, err := req.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+
+	for redirects := 0; ; redirects++ {
+		res, err := c.send(req, target, body)
+		if err != nil {
+			return nil, err
+		}
+
+		location, ok := res.Headers.Get("Location")
+		if !ok || !isRedirect(res.StatusLine.StatusCode) || c.maxRedirects <= 0 {
+			return res, nil
+		}
+
+		if redirects == c.maxRedirects {
+			res.Body.Close()
+			return nil, fmt.Errorf("stopped after %d redirects", c.maxRedirects)
+		}
+
+		next, err := target.Parse(location)
+		if err != nil || (next.Scheme != "http" && next.Scheme != "https") {
+			res.Body.Close()
+			return nil, fmt.Errorf("invalid redirect location %q", location)
+		}
+
+		// what's left of the redirect's body is read so its connection can carry the next request
+		io.CopyN(io.Discard, res.Body, maxRedirectDrain)
+		res.Body.Close()
+
+		req, body = redirectRequest(req, res.StatusLine.StatusCode, target, next, body)
+		target = next
+	}
+}
+
+func isRedirect(code response.StatusCode) bool {
+	return code == 301 || code == 302 || code == 303 || code == 307 || code == 308
+}
+
+// redirectRequest builds the request that follows a redirect to next. 303 turns anything
+// but HEAD into a GET, so do 301 and 302 for POST like browsers do, 307 and 308 keep the
+// method and the body. Credentials aren't passed on to another host, nor sent in the clear
+// when an https request is redirected to http.
+func redirectRequest(req *request.Request, code response.StatusCode, target, next *url.URL, body []byte) (*request.Request, []byte) {
+	method := req.RequestLine.Method
+	if code == 303 && method != "HEAD" || (code == 301 || code == 302) && method == "POST" {
+		method = "GET"
+		body = nil
+	}
+
+	nextReq := cloneRequest(req, method, next.String(), body)
+	dropCredentials := next.Host != target.Host || target.Scheme == "https" && next.Scheme == "http"
+	for key := range nextReq.Headers {
+		lower := strings.ToLower(key)
+		if body == nil && (strings.HasPrefix(lower, "content-") || lower == "transfer-encoding") {
+			delete(nextReq.Headers, key)
+		}
+
+		if dropCredentials && slices.Contains([]string{"authorization", "proxy-authorization", "cookie"}, lower) {
+			delete(nextReq.Headers, key)
+		}
+	}
+	if body == nil {
+		nextReq.Trailers = headers.NewHeaders()
+	}
+
+	return nextReq, body
+}
+
+// send makes a single round trip, on another connection when a reused one turns out to be closed
+func (c *Client) send(req *request.Request, target *url.URL, body []byte) (*response.Response, error) {
+	if c.jar != nil {
+		req = c.withCookies(req, target, body)
+	}
+
+	ctx := req.Context()
+	for {
+		pc, err := c.conn(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.trace != nil && c.trace.GotConn != nil {
+			c.trace.GotConn(pc.RemoteAddr().String(), pc.reused)
+		}
+
+		res, err := c.roundTrip(pc, req, target, body)
+
+		// the server may close an idle connection just as it's picked up, nothing
+		// came back so the request is sent again on another one when that's safe
+		if err != nil && pc.reused && pc.read == 0 && ctx.Err() == nil &&
+			slices.Contains(idempotentMethods, req.RequestLine.Method) {
+			continue
+		}
+
+		if err == nil && c.jar != nil {
+			c.jar.SetCookies(target, res.Headers.Values("Set-Cookie"))
+		}
+
+		return res, err
+	}
+}
+
+// withCookies returns a copy of req with the jar's cookies for target added to its own
+func (c *Client) withCookies(req *request.Request, target *url.URL, body []byte) *request.Request {
+	cookies := c.jar.Cookies(target)
+	if len(cookies) == 0 {
+		return req
+	}
+
+	withCookies := cloneRequest(req, req.RequestLine.Method, req.RequestLine.RequestTarget, body)
+
+	value := cookieHeader(cookies)
+	if prior, ok := req.Headers.Get("Cookie"); ok {
+		value = prior + "; " + value
+	}
+	withCookies.Headers.Delete("Cookie")
+	withCookies.Headers.Set("Cookie", value)
+
+	return withCookies
+}
+
+// cloneRequest copies req's headers, trailers and context into a new request, the caller's stays as it was
+func cloneRequest(req *request.Request, method, target string, body []byte) *request.Request {
+	clone := &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: target,
+			HttpVersion:   "1.1",
+		},
+		Headers:  req.Headers.Clone(),
+		Body:     body,
+		Trailers: req.Trailers.Clone(),
+	}
+	clone.SetContext(req.Context())
+
+	return clone
+}
+
+// conn returns an idle connection to the target's host or dials a new one
+func (c *Client) conn(ctx context.Context, target *url.URL) (*persistConn, error) {
+	key := target.Scheme + "://" + hostPort(target)
+
+	err := c.pool.acquire(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := c.pool.take(key)
+	if pc != nil {
+		return pc, nil
+	}
+
+	conn, err := c.dial(ctx, target)
+	if err != nil {
+		c.pool.release(key)
+		return nil, err
+	}
+
+	return &persistConn{Conn: conn, key: key, pool: c.pool}, nil
+}
+
+func (c *Client) roundTrip(pc *persistConn, req *request.Request, target *url.URL, body []byte) (*response.Response, error) {
+	ctx := req.Context()
+	keepAlive := c.maxIdlePerHost > 0 && !requestCloses(req)
+	pc.read = 0
+
+	// closing the connection is the only way to interrupt a read or write in progress
+	stop := context.AfterFunc(ctx, func() { pc.Conn.Close() })
+
+	done := false
+	finish := func(reuse bool) {
+		if done {
+			return
+		}
+		done = true
+		pc.onRead = nil
+
+		if stop() && reuse {
+			c.pool.put(pc)
+		} else {
+			pc.Conn.Close()
+		}
+		c.pool.release(pc.key)
+	}
+
+	fail := func(err error) (*response.Response, error) {
+		finish(false)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	var w io.Writer = pc
+	var sent *bytes.Buffer
+	if c.trace != nil && c.trace.WroteRequest != nil {
+		sent = &bytes.Buffer{}
+		w = io.MultiWriter(pc, sent)
+	}
+	if c.trace != nil {
+		pc.onRead = c.trace.ReadResponse
+	}
+
+	err := writeRequest(w, req, target, body, keepAlive)
+	if sent != nil {
+		c.trace.WroteRequest(sent.Bytes())
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if c.headerTimeout > 0 {
+		pc.SetReadDeadline(time.Now().Add(c.headerTimeout))
+	}
+
+	res, err := response.ResponseFromReader(pc, req.RequestLine.Method)
+	if err != nil {
+		return fail(err)
+	}
+	pc.SetReadDeadline(time.Time{})
+
+	res.Body = &connBody{
+		body:   res.Body,
+		ctx:    ctx,
+		finish: func() { finish(keepAlive && res.KeepAlive()) },
+	}
+	if res.Done() {
+		res.Body.Close()
+	}
+
+	return res, nil
+}
+
+func hostPort(target *url.URL) string {
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	return net.JoinHostPort(target.Hostname(), port)
+}
+
+func (c *Client) dial(ctx context.Context, target *url.URL) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort(target))
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Scheme == "http" {
+		return conn, nil
+	}
+
+	config := &tls.Config{}
+	if c.tlsConfig != nil {
+		config = c.tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = target.Hostname()
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// requestCloses reports whether the caller asked for the connection to be closed after req
+func requestCloses(req *request.Request) bool {
+	for _, value := range req.Headers.Values("Connection") {
+		for _, option := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "close") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// writeRequest writes req in origin-form, the framing headers are the client's to pick
+// except for a Transfer-Encoding the caller asked for a chunked body with
+func writeRequest(w io.Writer, req *request.Request, target *url.URL, body []byte, keepAlive bool) error {
+	path := target.RequestURI()
+	if req.RequestLine.Method == "OPTIONS" && target.Path == "" && target.RawQuery == "" {
+		path = "*"
+	}
+
+	transferEncoding, _ := req.Headers.Get("Transfer-Encoding")
+	codings := strings.Split(transferEncoding, ",")
+	chunked := strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+
+	out := cloneRequest(req, req.RequestLine.Method, path, body)
+	for _, key := range managedHeaders {
+		out.Headers.Delete(key)
+	}
+	out.Headers.Set("Host", target.Host)
+	if chunked {
+		out.Headers.Set("Transfer-Encoding", transferEncoding)
+	}
+
+	// without keep-alive telling the server saves it the wait for another request
+	if !keepAlive {
+		out.Headers.Set("Connection", "close")
+	}
+
+	_, err := out.WriteTo(w)
+	return err
+}
+
+// connBody hands the connection back once the body is read to the end, or closes it
+// when the body is closed before that
+type connBody struct {
+	body   io.ReadCloser
+	ctx    context.Context
+	finish func()
+	closed bool
+}
+
+func (b *connBody) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, io.EOF
+	}
+
+	n, err := b.body.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.Close()
+		return n, err
+	}
+
+	if err != nil && b.ctx.Err() != nil {
+		return n, b.ctx.Err()
+	}
+
+	return n, err
+}
+
+func (b *connBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	b.finish()
+	return nil
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+// startRaw answers every connection with reply as it is, once the request head is in
+func startRaw(t *testing.T, reply string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				request.HeadFromReader(conn)
+				io.WriteString(conn, reply)
+			}()
+		}
+	}()
+
+	return "http://" + listener.Addr().String()
+}
+
+// echo answers with the method, the target and the body it got
+func echo(w *response.Writer, r *request.Request) *server.HandlerError {
+	body, err := r.ReadBody()
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusBadRequest, Headers: headers.NewHeaders(), Body: []byte(err.Error())}
+	}
+
+	custom, _ := r.Headers.Get("X-Custom")
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteBody([]byte(fmt.Sprintf("%s %s %s %s", r.RequestLine.Method, r.RequestLine.RequestTarget, custom, body)))
+	return nil
+}
+
+func do(t *testing.T, c *Client, method, target string, body []byte) (*response.Response, string) {
+	req, err := NewRequest(method, target, body)
+	require.NoError(t, err)
+	req.Headers.Set("X-Custom", "custom")
+
+	res, err := c.Do(req)
+	require.NoError(t, err)
+	data, err := res.ReadBody()
+	require.NoError(t, err)
+	res.Body.Close()
+
+	return res, string(data)
+}
+
+func TestClient(t *testing.T) {
+	c := New()
+	target := startServer(t, echo)
+
+	// Test: GET
+	res, body := do(t, c, "GET", target+"/path?a=b", nil)
+	assert.Equal(t, response.StatusCode(response.StatusOk), res.StatusLine.StatusCode)
+	assert.Equal(t, "OK", res.StatusLine.ReasonPhrase)
+	assert.Equal(t, "GET /path?a=b custom ", body)
+
+	// Test: POST with a body
+	_, body = do(t, c, "POST", target+"/", []byte("hello world"))
+	assert.Equal(t, "POST / custom hello world", body)
+
+	// Test: HEAD has no body
+	res, body = do(t, c, "HEAD", target+"/", nil)
+	assert.Equal(t, response.StatusCode(response.StatusOk), res.StatusLine.StatusCode)
+	assert.Equal(t, "", body)
+	assert.True(t, res.Done())
+
+	// Test: Chunked body with trailers
+	target = startServer(t, func(w *response.Writer, r *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusOk)
+		w.DeclareTrailer("X-Checksum")
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte("hello "))
+		w.Flush()
+		w.WriteBody([]byte("world"))
+		w.SetTrailer("X-Checksum", "abc")
+		return nil
+	})
+	req, err := NewRequest("GET", target+"/", nil)
+	require.NoError(t, err)
+	req.Headers.Set("TE", "trailers")
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	data, err := res.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	transferEncoding, _ := res.Headers.Get("Transfer-Encoding")
+	assert.Equal(t, "chunked", transferEncoding)
+	checksum, _ := res.Trailers.Get("X-Checksum")
+	assert.Equal(t, "abc", checksum)
+
+	// Test: Body that lasts until the connection closes
+	target = startRaw(t, "HTTP/1.0 200 Fine\r\nContent-Type: text/plain\r\n\r\nuntil the end")
+	res, body = do(t, c, "GET", target+"/", nil)
+	assert.Equal(t, "1.0", res.StatusLine.HttpVersion)
+	assert.Equal(t, "Fine", res.StatusLine.ReasonPhrase)
+	assert.Equal(t, "until the end", body)
+
+	// Test: Truncated body
+	target = startRaw(t, "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\nshort")
+	req, err = NewRequest("GET", target+"/", nil)
+	require.NoError(t, err)
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	_, err = res.ReadBody()
+	require.Error(t, err)
+	assert.Equal(t, "not enough content provided", err.Error())
+
+	// Test: Unsupported scheme
+	_, err = NewRequest("GET", "ftp://localhost/", nil)
+	require.Error(t, err)
+	assert.Equal(t, `unsupported url scheme "ftp"`, err.Error())
+}
+
+func TestClientTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	target := startServer(t, func(w *response.Writer, r *request.Request) *server.HandlerError {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		return echo(w, r)
+	})
+
+	// Test: Response head taking too long
+	c := New(WithResponseHeaderTimeout(20 * time.Millisecond))
+	req, err := NewRequest("GET", target+"/", nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	require.Error(t, err)
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout())
+
+	// Test: Request context cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err = NewRequest("GET", target+"/", nil)
+	require.NoError(t, err)
+	req.SetContext(ctx)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = New().Do(req)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestClientTLS(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	t.Cleanup(tlsServer.Close)
+
+	// Test: Certificate the client doesn't trust
+	req, err := NewRequest("GET", tlsServer.URL+"/secure", nil)
+	require.NoError(t, err)
+	_, err = New().Do(req)
+	require.Error(t, err)
+
+	// Test: Trusted certificate
+	pool := x509.NewCertPool()
+	pool.AddCert(tlsServer.Certificate())
+	c := New(WithTLSConfig(&tls.Config{RootCAs: pool}))
+	res, body := do(t, c, "GET", tlsServer.URL+"/secure", nil)
+	assert.Equal(t, response.StatusCode(response.StatusOk), res.StatusLine.StatusCode)
+	assert.Equal(t, "GET /secure", body)
+}
+
+func TestClientTrace(t *testing.T) {
+	target := startServer(t, func(w *response.Writer, r *request.Request) *server.HandlerError {
+		body, _ := r.ReadBody()
+		transferEncoding, _ := r.Headers.Get("Transfer-Encoding")
+		checksum, _ := r.Trailers.Get("X-Checksum")
+
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte(fmt.Sprintf("%s %s %s", transferEncoding, checksum, body)))
+		return nil
+	})
+
+	conns := []bool{}
+	sent := ""
+	read := ""
+	c := New(WithTrace(&Trace{
+		GotConn:      func(addr string, reused bool) { conns = append(conns, reused) },
+		WroteRequest: func(data []byte) { sent += string(data) },
+		ReadResponse: func(data []byte) { read += string(data) },
+	}))
+
+	// Test: Raw bytes of the round trip
+	_, body := do(t, c, "POST", target+"/", []byte("hi"))
+	assert.Equal(t, "  hi", body)
+	assert.Equal(t, []bool{false}, conns)
+	assert.Contains(t, sent, "POST / HTTP/1.1\r\nHost: ")
+	assert.Contains(t, sent, "X-Custom: custom\r\nContent-Length: 2\r\n\r\nhi")
+	assert.Contains(t, read, "HTTP/1.1 200 OK")
+	assert.True(t, strings.HasSuffix(read, "\r\n\r\n  hi"))
+
+	// Test: Chunked upload with trailers
+	sent = ""
+	req, err := NewRequest("PUT", target+"/", []byte("hello"))
+	require.NoError(t, err)
+	req.Trailers.Set("X-Checksum", "abc")
+	res, err := c.Do(req)
+	require.NoError(t, err)
+	data, err := res.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "chunked abc hello", string(data))
+	assert.Contains(t, sent, "Transfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n5\r\nhello\r\n0\r\nX-Checksum: abc\r\n\r\n")
+
+	// Test: Chunked upload asked for with Transfer-Encoding
+	req, err = NewRequest("POST", target+"/", []byte("hello"))
+	require.NoError(t, err)
+	req.Headers.Set("Transfer-Encoding", "chunked")
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	data, err = res.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "chunked  hello", string(data))
+}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"cmp"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cookieDateFormats are the Expires formats servers still send, RFC 1123 first
+var cookieDateFormats = []string{
+	"Mon, 02 Jan 2006 15:04:05 GMT",
+	"Mon, 02-Jan-2006 15:04:05 GMT",
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// Cookie is a cookie kept by a Jar.
+type Cookie struct {
+	Name   string
+	Value  string
+	Domain string
+	Path   string
+	// Expires is zero for a session cookie, it lasts as long as the jar does.
+	Expires time.Time
+	Secure  bool
+	// HttpOnly cookies are sent with requests like any other, the flag is kept for
+	// whoever reads the jar to keep them away from scripts.
+	HttpOnly bool
+	// HostOnly is set when the server didn't name a domain, the cookie then only goes
+	// back to the exact host that set it.
+	HostOnly bool
+
+	// created orders the cookies by when they were first stored
+	created uint64
+}
+
+// Jar stores the cookies servers set and picks the ones that go with a request,
+// following the storage and retrieval rules of RFC 6265 section 5.3 and 5.4.
+// There's no public suffix list, a Domain attribute has to have a dot in it at least.
+type Jar struct {
+	mu      sync.Mutex
+	cookies map[string]*Cookie
+	created uint64
+	now     func() time.Time
+}
+
+func NewJar() *Jar {
+	return &Jar{cookies: map[string]*Cookie{}, now: time.Now}
+}
+
+// SetCookies stores the cookies from the Set-Cookie values of a response to u,
+// the ones that aren't valid for u are ignored.
+func (j *Jar) SetCookies(u *url.URL, setCookies []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := j.now()
+	for _, setCookie := range setCookies {
+		cookie, ok := parseSetCookie(setCookie, u, now)
+		if !ok {
+			continue
+		}
+
+		key := cookie.Domain + ";" + cookie.Path + ";" + cookie.Name
+		if !cookie.Expires.IsZero() && !cookie.Expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+
+		// a replaced cookie keeps its place in the order cookies are sent in
+		if old, ok := j.cookies[key]; ok {
+			cookie.created = old.created
+		} else {
+			j.created++
+			cookie.created = j.created
+		}
+		j.cookies[key] = cookie
+	}
+}
+
+// Cookies returns the cookies to send with a request to u, the ones with longer paths first.
+func (j *Jar) Cookies(u *url.URL) []Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	host := canonicalHost(u)
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	now := j.now()
+	selected := []Cookie{}
+	for key, cookie := range j.cookies {
+		if !cookie.Expires.IsZero() && !cookie.Expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+
+		if cookie.HostOnly && host != cookie.Domain || !cookie.HostOnly && !domainMatch(host, cookie.Domain) {
+			continue
+		}
+
+		if !pathMatch(path, cookie.Path) || cookie.Secure && u.Scheme != "https" {
+			continue
+		}
+
+		selected = append(selected, *cookie)
+	}
+
+	slices.SortFunc(selected, func(a, b Cookie) int {
+		if len(a.Path) != len(b.Path) {
+			return len(b.Path) - len(a.Path)
+		}
+
+		return cmp.Compare(a.created, b.created)
+	})
+
+	return selected
+}
+
+// cookieHeader joins cookies into the value of a Cookie header
+func cookieHeader(cookies []Cookie) string {
+	pairs := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+
+	return strings.Join(pairs, "; ")
+}
+
+// parseSetCookie follows RFC 6265 section 5.2, attributes it doesn't know are skipped
+func parseSetCookie(setCookie string, u *url.URL, now time.Time) (*Cookie, bool) {
+	parts := strings.Split(setCookie, ";")
+
+	name, value, ok := strings.Cut(parts[0], "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return nil, false
+	}
+
+	cookie := &Cookie{
+		Name:  name,
+		Value: strings.Trim(strings.TrimSpace(value), `"`),
+	}
+
+	host := canonicalHost(u)
+	domain := ""
+	path := ""
+	maxAgeSet := false
+
+	for _, attribute := range parts[1:] {
+		key, val, _ := strings.Cut(attribute, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.TrimSpace(val)
+
+		switch key {
+		case "expires":
+			// Max-Age wins whichever order they come in
+			if maxAgeSet {
+				continue
+			}
+
+			for _, format := range cookieDateFormats {
+				expires, err := time.Parse(format, val)
+				if err == nil {
+					cookie.Expires = expires
+					break
+				}
+			}
+		case "max-age":
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				continue
+			}
+
+			maxAgeSet = true
+			if seconds <= 0 {
+				cookie.Expires = time.Unix(0, 0)
+			} else {
+				cookie.Expires = now.Add(time.Duration(seconds) * time.Second)
+			}
+		case "domain":
+			domain = strings.ToLower(strings.TrimPrefix(val, "."))
+		case "path":
+			path = val
+		case "secure":
+			cookie.Secure = true
+		case "httponly":
+			cookie.HttpOnly = true
+		}
+	}
+
+	// a secure cookie can only be set over a secure connection
+	if cookie.Secure && u.Scheme != "https" {
+		return nil, false
+	}
+
+	if domain == "" || domain == host {
+		cookie.Domain = host
+		cookie.HostOnly = domain == ""
+	} else {
+		if !strings.Contains(domain, ".") || !domainMatch(host, domain) {
+			return nil, false
+		}
+
+		cookie.Domain = domain
+	}
+
+	cookie.Path = path
+	if !strings.HasPrefix(path, "/") {
+		cookie.Path = defaultPath(u.Path)
+	}
+
+	return cookie, true
+}
+
+func canonicalHost(u *url.URL) string {
+	return strings.ToLower(u.Hostname())
+}
+
+// domainMatch is the domain matching of RFC 6265 section 5.1.3, ip addresses only match themselves
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+
+	return strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil
+}
+
+// pathMatch is the path matching of RFC 6265 section 5.1.4
+func pathMatch(path, cookiePath string) bool {
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+
+	return len(path) == len(cookiePath) || strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/'
+}
+
+// defaultPath is the directory of the request path, RFC 6265 section 5.1.4
+func defaultPath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/"
+	}
+
+	idx := strings.LastIndex(path, "/")
+	if idx == 0 {
+		return "/"
+	}
+
+	return path[:idx]
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustURL(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	return u
+}
+
+// cookiesFor returns the Cookie header the jar would send to rawURL
+func cookiesFor(t *testing.T, jar *Jar, rawURL string) string {
+	return cookieHeader(jar.Cookies(mustURL(t, rawURL)))
+}
+
+func TestJarDomains(t *testing.T) {
+	// Test: Host-only cookie
+	jar := NewJar()
+	jar.SetCookies(mustURL(t, "http://www.example.com/"), []string{"a=1"})
+	assert.Equal(t, "a=1", cookiesFor(t, jar, "http://www.example.com/"))
+	assert.Equal(t, "a=1", cookiesFor(t, jar, "http://WWW.example.com:8080/"))
+	assert.Equal(t, "", cookiesFor(t, jar, "http://sub.www.example.com/"))
+	assert.Equal(t, "", cookiesFor(t, jar, "http://example.com/"))
+
+	// Test: Domain cookie goes to subdomains
+	jar = NewJar()
+	jar.SetCookies(mustURL(t, "http://www.example.com/"), []string{"a=1; Domain=.Example.com"})
+	assert.Equal(t, "a=1", cookiesFor(t, jar, "http://example.com/"))
+	assert.Equal(t, "a=1", cookiesFor(t, jar, "http://api.example.com/"))
+	assert.Equal(t, "", cookiesFor(t, jar, "http://notexample.com/"))
+
+	// Test: Domain the host isn't in
+	jar = NewJar()
+	jar.SetCookies(mustURL(t, "http://www.example.com/"), []string{"a=1; Domain=other.com", "b=2; Domain=api.example.com"})
+	assert.Empty(t, jar.Cookies(mustURL(t, "http://other.com/")))
+	assert.Empty(t, jar.Cookies(mustURL(t, "http://api.example.com/")))
+
+	// Test: Domain without a dot
+	jar = NewJar()
+	jar.SetCookies(mustURL(t, "http://www.example.com/"), []string{"a=1; Domain=com"})
+	assert.Empty(t, jar.Cookies(mustURL(t, "http://www.example.com/")))
+
+	// Test: Ip addresses only match themselves
+	jar = NewJar()
+	jar.SetCookies(mustURL(t, "http://127.0.0.1/"), []string{"a=1; Domain=0.0.1", "b=2; Domain=127.0.0.1"})
+	assert.Equal(t, "b=2", cookiesFor(t, jar, "http://127.0.0.1/"))
+
+	// Test: Invalid cookies
+	jar = NewJar()
+	jar.SetCookies(mustURL(t, "http://example.com/"), []string{"novalue", "=1", ""})
+	assert.Empty(t, jar.Cookies(mustURL(t, "http://example.com/")))
+}
+
+func TestJarPaths(t *testing.T) {
+	// Test: Default path is the directory of the request path
+	jar := NewJar()
+	jar.SetCookies(mustURL(t, "http://example.com/docs/page"), []string{"a=1", "b=2; Path=nope"})
+	assert.Equal(t, "a=1; b=2", cookiesFor(t, jar, "http://example.com/docs"))
+	assert.Equal(t, "a=1; b=2", cookiesFor(t, jar, "http://example.com/docs/other"))
+	assert.Equal(t, "", cookiesFor(t, jar, "http://example.com/docsy"))
+	assert.Equal(t, "", cookiesFor(t, jar, "http://example.com/"))
+
+	// Test: Longer paths go first
+	jar = NewJar()
+	jar.SetCookies(mustURL(t, "http://example.com/"), []string{"root=1; Path=/", "api=2; Path=/api/", "v1=3; Path=/api/v1"})
+	assert.Equal(t, "v1=3; api=2; root=1", cookiesFor(t, jar, "http://example.com/api/v1/users"))
+	assert.Equal(t, "root=1", cookiesFor(t, jar, "http://example.com/api"))
+
+	// Test: Same name on different paths are different cookies
+	jar = NewJar()
+	jar.SetCookies(mustURL(t, "http://example.com/"), []string{"a=1; Path=/", "a=2; Path=/x"})
+	assert.Equal(t, "a=2; a=1", cookiesFor(t, jar, "http://example.com/x"))
+}
+
+func TestJarExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	jar := NewJar()
+	jar.now = func() time.Time { return now }
+	u := mustURL(t, "http://example.com/")
+
+	// Test: Max-Age and Expires
+	jar.SetCookies(u, []string{
+		"session=1",
+		"short=2; Max-Age=60",
+		"dated=3; Expires=Thu, 01 Jan 2026 12:30:00 GMT",
+		"both=4; Max-Age=60; Expires=Fri, 01 Jan 2027 00:00:00 GMT",
+		"old=5; Expires=Thu, 01-Jan-1970 00:00:00 GMT",
+	})
+	assert.Equal(t, "session=1; short=2; dated=3; both=4", cookiesFor(t, jar, "http://example.com/"))
+
+	now = now.Add(10 * time.Minute)
+	assert.Equal(t, "session=1; dated=3", cookiesFor(t, jar, "http://example.com/"))
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, "session=1", cookiesFor(t, jar, "http://example.com/"))
+
+	// Test: Replaced cookie keeps its place
+	jar.SetCookies(u, []string{"later=6", "session=7"})
+	assert.Equal(t, "session=7; later=6", cookiesFor(t, jar, "http://example.com/"))
+
+	// Test: Max-Age of zero deletes the cookie
+	jar.SetCookies(u, []string{"session=; Max-Age=0"})
+	assert.Equal(t, "later=6", cookiesFor(t, jar, "http://example.com/"))
+}
+
+func TestJarFlags(t *testing.T) {
+	// Test: Secure cookies are only set and sent over https
+	jar := NewJar()
+	jar.SetCookies(mustURL(t, "http://example.com/"), []string{"plain=1; Secure"})
+	jar.SetCookies(mustURL(t, "https://example.com/"), []string{"secure=2; Secure"})
+	assert.Equal(t, "secure=2", cookiesFor(t, jar, "https://example.com/"))
+	assert.Equal(t, "", cookiesFor(t, jar, "http://example.com/"))
+
+	// Test: HttpOnly cookies are sent and flagged
+	jar = NewJar()
+	jar.SetCookies(mustURL(t, "http://example.com/"), []string{`token="abc"; HttpOnly; Path=/`})
+	cookies := jar.Cookies(mustURL(t, "http://example.com/"))
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "abc", cookies[0].Value)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.True(t, cookies[0].HostOnly)
+	assert.Equal(t, "example.com", cookies[0].Domain)
+}
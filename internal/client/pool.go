@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// pool keeps the connections that finished a response open for the next request to the
+// same host, and limits how many can be in use at once when there's a limit per host.
+type pool struct {
+	maxIdle     int
+	maxPerHost  int
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	idle  map[string][]*persistConn
+	slots map[string]chan struct{}
+}
+
+func newPool(maxIdle, maxPerHost int, idleTimeout time.Duration) *pool {
+	return &pool{
+		maxIdle:     maxIdle,
+		maxPerHost:  maxPerHost,
+		idleTimeout: idleTimeout,
+		idle:        map[string][]*persistConn{},
+		slots:       map[string]chan struct{}{},
+	}
+}
+
+// acquire waits for a connection to key to be free when there's a limit to how many there can be
+func (p *pool) acquire(ctx context.Context, key string) error {
+	if p.maxPerHost <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	slots, ok := p.slots[key]
+	if !ok {
+		slots = make(chan struct{}, p.maxPerHost)
+		p.slots[key] = slots
+	}
+	p.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pool) release(key string) {
+	if p.maxPerHost <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	slots := p.slots[key]
+	p.mu.Unlock()
+
+	<-slots
+}
+
+// take returns an idle connection to key that's still open, or nil when there's none.
+// The most recently used one goes first, it's the least likely to have been timed out.
+func (p *pool) take(key string) *persistConn {
+	for {
+		p.mu.Lock()
+		conns := p.idle[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+
+		pc := conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+		p.mu.Unlock()
+
+		if pc.unwatch() {
+			return pc
+		}
+	}
+}
+
+// put keeps pc for the next request, or closes it when enough are kept already
+func (p *pool) put(pc *persistConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[pc.key]) >= p.maxIdle {
+		pc.Conn.Close()
+		return
+	}
+
+	p.idle[pc.key] = append(p.idle[pc.key], pc)
+	pc.watch()
+}
+
+func (p *pool) remove(pc *persistConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.idle[pc.key] = slices.DeleteFunc(p.idle[pc.key], func(c *persistConn) bool { return c == pc })
+}
+
+func (p *pool) closeIdle() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = map[string][]*persistConn{}
+	p.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, pc := range conns {
+			pc.Conn.Close()
+		}
+	}
+}
+
+// persistConn is a connection that can carry more than one request. While it sits in
+// the pool a read is kept waiting on it, so a server closing the connection or the idle
+// timeout running out is noticed there and the connection leaves the pool.
+type persistConn struct {
+	net.Conn
+	key  string
+	pool *pool
+	// reused is set once the connection carried a request before the current one
+	reused bool
+	// read counts the bytes of the current response, a request that failed before
+	// any arrived never reached the server or was dropped by it unseen
+	read int
+	// onRead is given the bytes of the current response as they're read, for a Trace
+	onRead func([]byte)
+
+	mu     sync.Mutex
+	done   chan struct{}
+	taking bool
+	stale  bool
+}
+
+func (pc *persistConn) Read(p []byte) (int, error) {
+	n, err := pc.Conn.Read(p)
+	pc.read += n
+	if n > 0 && pc.onRead != nil {
+		pc.onRead(p[:n])
+	}
+	return n, err
+}
+
+// watch starts the background read, it's called with the pool locked
+func (pc *persistConn) watch() {
+	pc.done = make(chan struct{})
+	pc.taking = false
+
+	if pc.pool.idleTimeout > 0 {
+		pc.Conn.SetReadDeadline(time.Now().Add(pc.pool.idleTimeout))
+	}
+
+	go func() {
+		defer close(pc.done)
+
+		buf := make([]byte, 1)
+		_, err := pc.Conn.Read(buf)
+
+		pc.mu.Lock()
+		taking := pc.taking
+		// the deadline set by unwatch isn't the connection's doing, anything else
+		// means it was closed, timed out or got bytes nobody asked for
+		pc.stale = !(taking && errors.Is(err, os.ErrDeadlineExceeded))
+		pc.mu.Unlock()
+
+		if pc.stale {
+			if !taking {
+				pc.pool.remove(pc)
+			}
+			pc.Conn.Close()
+		}
+	}()
+}
+
+// unwatch ends the background read and reports whether the connection can still be used
+func (pc *persistConn) unwatch() bool {
+	pc.mu.Lock()
+	pc.taking = true
+	pc.mu.Unlock()
+
+	pc.Conn.SetReadDeadline(time.Now())
+	<-pc.done
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.stale {
+		return false
+	}
+
+	pc.Conn.SetReadDeadline(time.Time{})
+	pc.reused = true
+
+	return true
+}
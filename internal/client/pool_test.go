@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startKeepAlive starts a server that keeps connections open, it counts the ones it accepted
+func startKeepAlive(t *testing.T) (string, *atomic.Int32) {
+	conns := &atomic.Int32{}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, r.Header.Get("Connection"))
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	return ts.URL, conns
+}
+
+func get(t *testing.T, c *Client, target string) string {
+	_, body := do(t, c, "GET", target, nil)
+	return body
+}
+
+func TestPoolReuse(t *testing.T) {
+	// Test: Connection is reused
+	target, conns := startKeepAlive(t)
+	c := New()
+	for range 3 {
+		assert.Equal(t, "GET /reused ", get(t, c, target+"/reused"))
+	}
+	assert.Equal(t, int32(1), conns.Load())
+
+	// Test: Keep-alive turned off
+	target, conns = startKeepAlive(t)
+	c = New(WithMaxIdleConnsPerHost(0))
+	for range 3 {
+		assert.Equal(t, "GET /closed close", get(t, c, target+"/closed"))
+	}
+	assert.Equal(t, int32(3), conns.Load())
+
+	// Test: Body closed before its end takes the connection with it
+	target, conns = startKeepAlive(t)
+	c = New()
+	req, err := NewRequest("GET", target+"/", nil)
+	require.NoError(t, err)
+	res, err := c.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	get(t, c, target+"/")
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: Idle connection timed out
+	target, conns = startKeepAlive(t)
+	c = New(WithIdleTimeout(20 * time.Millisecond))
+	get(t, c, target+"/")
+	time.Sleep(50 * time.Millisecond)
+	get(t, c, target+"/")
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: Idle connections closed by the client
+	target, conns = startKeepAlive(t)
+	c = New()
+	get(t, c, target+"/")
+	c.CloseIdleConnections()
+	get(t, c, target+"/")
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: Server announcing the close
+	target = startServer(t, echo)
+	c = New()
+	for range 3 {
+		assert.Equal(t, "GET / custom ", get(t, c, target+"/"))
+	}
+	assert.Empty(t, c.pool.idle)
+}
+
+func TestPoolStaleConnection(t *testing.T) {
+	// Test: Server closing a connection it didn't say it would close
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+
+			buf := make([]byte, 1024)
+			conn.Read(buf)
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			conn.Close()
+		}
+	}()
+
+	c := New()
+	target := "http://" + listener.Addr().String()
+	for range 3 {
+		assert.Equal(t, "ok", get(t, c, target+"/"))
+	}
+	assert.Equal(t, int32(3), accepted.Load())
+}
+
+func TestPoolMaxConnsPerHost(t *testing.T) {
+	target, conns := startKeepAlive(t)
+	c := New(WithMaxConnsPerHost(1))
+
+	req, err := NewRequest("GET", target+"/first", nil)
+	require.NoError(t, err)
+	first, err := c.Do(req)
+	require.NoError(t, err)
+
+	// Test: Request waits while the only connection is in use
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	req, err = NewRequest("GET", target+"/second", nil)
+	require.NoError(t, err)
+	req.SetContext(ctx)
+	_, err = c.Do(req)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Test: Request goes out once the connection is free
+	second := make(chan string)
+	go func() {
+		req, _ := NewRequest("GET", target+"/second", nil)
+		res, err := c.Do(req)
+		if err != nil {
+			second <- err.Error()
+			return
+		}
+		data, _ := res.ReadBody()
+		second <- string(data)
+	}()
+
+	data, err := first.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "GET /first ", string(data))
+	assert.Equal(t, "GET /second ", <-second)
+	assert.Equal(t, int32(1), conns.Load())
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/httpbin"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// redirector redirects /to/{code}?location to location, anything else is answered
+// with what the request looked like
+func redirector(w *response.Writer, r *request.Request) *server.HandlerError {
+	path, query, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	if code, ok := strings.CutPrefix(path, "/to/"); ok {
+		status, _ := strconv.Atoi(code)
+		h := headers.NewHeaders()
+		h.Set("Location", query)
+
+		w.WriteStatusLine(response.StatusCode(status))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("redirecting"))
+		return nil
+	}
+
+	body, _ := r.ReadBody()
+	contentType, _ := r.Headers.Get("Content-Type")
+	authorization, _ := r.Headers.Get("Authorization")
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteBody([]byte(fmt.Sprintf("%s %s body=%s type=%s auth=%s", r.RequestLine.Method, path, body, contentType, authorization)))
+	return nil
+}
+
+func send(t *testing.T, c *Client, method, target, body string) (*response.Response, string) {
+	req, err := NewRequest(method, target, []byte(body))
+	require.NoError(t, err)
+	req.Headers.Set("Content-Type", "text/plain")
+	req.Headers.Set("Authorization", "Bearer secret")
+
+	res, err := c.Do(req)
+	require.NoError(t, err)
+	data, err := res.ReadBody()
+	require.NoError(t, err)
+
+	return res, string(data)
+}
+
+func TestRedirects(t *testing.T) {
+	c := New()
+	bin := startServer(t, httpbin.Handler(""))
+
+	// Test: Chain of redirects
+	res, body := send(t, c, "GET", bin+"/redirect/3", "")
+	assert.Equal(t, response.StatusCode(response.StatusOk), res.StatusLine.StatusCode)
+	assert.Contains(t, body, `"url"`)
+
+	// Test: Too many redirects
+	req, err := NewRequest("GET", bin+"/redirect/3", nil)
+	require.NoError(t, err)
+	_, err = New(WithMaxRedirects(2)).Do(req)
+	require.Error(t, err)
+	assert.Equal(t, "stopped after 2 redirects", err.Error())
+
+	// Test: Redirects returned as they are
+	res, _ = send(t, New(WithMaxRedirects(0)), "GET", bin+"/redirect/1", "")
+	assert.Equal(t, response.StatusCode(response.StatusFound), res.StatusLine.StatusCode)
+	location, _ := res.Headers.Get("Location")
+	assert.Equal(t, "/get", location)
+
+	target := startServer(t, redirector)
+
+	// Test: 301 and 302 turn POST into GET
+	_, body = send(t, c, "POST", target+"/to/301?/echo", "hello")
+	assert.Equal(t, "GET /echo body= type= auth=Bearer secret", body)
+	_, body = send(t, c, "POST", target+"/to/302?/echo", "hello")
+	assert.Equal(t, "GET /echo body= type= auth=Bearer secret", body)
+
+	// Test: 302 keeps other methods
+	_, body = send(t, c, "DELETE", target+"/to/302?/echo", "")
+	assert.Equal(t, "DELETE /echo body= type=text/plain auth=Bearer secret", body)
+
+	// Test: 303 turns anything into GET
+	_, body = send(t, c, "PUT", target+"/to/303?/echo", "hello")
+	assert.Equal(t, "GET /echo body= type= auth=Bearer secret", body)
+
+	// Test: 307 and 308 keep the method and the body
+	_, body = send(t, c, "POST", target+"/to/307?/echo", "hello")
+	assert.Equal(t, "POST /echo body=hello type=text/plain auth=Bearer secret", body)
+	_, body = send(t, c, "PUT", target+"/to/308?/echo", "hello")
+	assert.Equal(t, "PUT /echo body=hello type=text/plain auth=Bearer secret", body)
+
+	// Test: Relative location
+	_, body = send(t, c, "GET", target+"/to/302?../nested/echo", "")
+	assert.Equal(t, "GET /nested/echo body= type=text/plain auth=Bearer secret", body)
+
+	// Test: Authorization isn't passed on to another host
+	other := startServer(t, redirector)
+	_, body = send(t, c, "GET", target+"/to/307?"+other+"/echo", "")
+	assert.Equal(t, "GET /echo body= type=text/plain auth=", body)
+
+	// Test: Credentials aren't sent in the clear after a redirect from https
+	req, err = NewRequest("GET", "https://example.com/login", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Authorization", "Bearer secret")
+	req.Headers.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Headers.Set("Cookie", "session=secret")
+	req.Headers.Set("Accept", "*/*")
+	from, _ := url.Parse("https://example.com/login")
+	to, _ := url.Parse("http://example.com/home")
+	nextReq, _ := redirectRequest(req, response.StatusFound, from, to, nil)
+	assert.Equal(t, headers.Headers{"Accept": {"*/*"}}, nextReq.Headers)
+
+	// Test: Changing the headers of the next hop leaves the caller's request alone
+	nextReq.Headers["Accept"][0] = "text/html"
+	assert.Equal(t, []string{"*/*"}, req.Headers["Accept"])
+
+	// Test: Location that isn't http
+	req, err = NewRequest("GET", target+"/to/302?ftp://localhost/", nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	require.Error(t, err)
+	assert.Equal(t, `invalid redirect location "ftp://localhost/"`, err.Error())
+}
+
+func TestClientCookies(t *testing.T) {
+	c := New(WithJar(NewJar()))
+	bin := startServer(t, httpbin.Handler(""))
+
+	readCookies := func(body string) map[string]string {
+		var parsed struct {
+			Cookies map[string]string `json:"cookies"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &parsed))
+		return parsed.Cookies
+	}
+
+	// Test: Cookies set on the way through a redirect are sent back
+	_, body := send(t, c, "GET", bin+"/cookies/set?a=1&b=2", "")
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, readCookies(body))
+
+	// Test: Deleted cookie isn't sent anymore
+	_, body = send(t, c, "GET", bin+"/cookies/delete?a", "")
+	assert.Equal(t, map[string]string{"b": "2"}, readCookies(body))
+
+	// Test: Cookies added to the ones the request has
+	req, err := NewRequest("GET", bin+"/cookies", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Cookie", "own=yes")
+	res, err := c.Do(req)
+	require.NoError(t, err)
+	data, err := res.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"own": "yes", "b": "2"}, readCookies(string(data)))
+	cookie, _ := req.Headers.Get("Cookie")
+	assert.Equal(t, "own=yes", cookie)
+
+	// Test: Client without a jar
+	_, body = send(t, New(), "GET", bin+"/cookies/set?a=1", "")
+	assert.Equal(t, map[string]string{}, readCookies(body))
+}
@@ -0,0 +1,23 @@
+package client
+
+// Trace has hooks into the round trips Do makes, for tools that show what goes over the
+// wire. The hooks that are nil aren't called, the others are called again for every
+// round trip, the ones following redirects included.
+type Trace struct {
+	// GotConn is called with the address of the connection a request is about to be
+	// written to, reused is set when it carried a request before.
+	GotConn func(addr string, reused bool)
+	// WroteRequest is called with the bytes of the request that made it to the
+	// connection, all of them unless writing failed.
+	WroteRequest func(data []byte)
+	// ReadResponse is called with the bytes of the response as they're read from the
+	// connection, up to the end of its body.
+	ReadResponse func(data []byte)
+}
+
+// WithTrace calls the hooks of trace through every round trip the client makes.
+func WithTrace(trace *Trace) Option {
+	return func(c *Client) {
+		c.trace = trace
+	}
+}
@@ -0,0 +1,181 @@
+package digest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+)
+
+var algorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// algorithmOrder keeps the field values stable, map iteration order isn't
+var algorithmOrder = []string{"sha-256", "sha-512"}
+
+// Middleware adds RFC 9530 Content-Digest and Repr-Digest fields to the responses of next.
+// The digests are computed while the body is written, a response that's complete before
+// anything is sent gets them as headers, a streamed one gets them as trailers and is sent
+// chunked even when the handler set a Content-Length. HTTP/1.0 clients get no digest for a
+// streamed response, they can't be sent trailers.
+//
+// A request carrying a Content-Digest, as a header or a trailer, is checked against its body
+// first and answered with 400 when they don't match.
+func Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) *server.HandlerError {
+		err := Verify(r)
+		if err != nil {
+			errorHeaders := headers.NewHeaders()
+			errorHeaders.Set("Content-Type", "text/plain")
+
+			return &server.HandlerError{
+				StatusCode: response.StatusBadRequest,
+				Headers:    errorHeaders,
+				Body:       []byte(err.Error()),
+			}
+		}
+
+		hashes := newHashes()
+		w.TeeBody(hashes)
+
+		streamed := false
+		w.BeforeHead(func(complete bool) {
+			if complete {
+				w.SetHeader("Content-Digest", hashes.fieldValue())
+				w.SetHeader("Repr-Digest", hashes.fieldValue())
+				return
+			}
+
+			streamed = true
+			w.DeclareTrailer("Content-Digest", "Repr-Digest")
+		})
+		w.BeforeFinish(func() {
+			if streamed {
+				w.SetTrailer("Content-Digest", hashes.fieldValue())
+				w.SetTrailer("Repr-Digest", hashes.fieldValue())
+			}
+		})
+
+		return next(w, r)
+	}
+}
+
+// Verify reads the body of r and checks it against the Content-Digest the client sent,
+// algorithms we don't know are skipped. A request without a digest is always fine.
+func Verify(r *request.Request) error {
+	_, hasDigest := r.Headers.Get("Content-Digest")
+	_, hasDigestTrailer := r.Trailers.Get("Content-Digest")
+	if !hasDigest && !hasDigestTrailer && !declaresTrailer(r) {
+		return nil
+	}
+
+	body, err := r.ReadBody()
+	if err != nil {
+		return err
+	}
+
+	value, ok := r.Headers.Get("Content-Digest")
+	if !ok {
+		value, ok = r.Trailers.Get("Content-Digest")
+	}
+	if !ok {
+		return nil
+	}
+
+	digests, err := Parse(value)
+	if err != nil {
+		return err
+	}
+
+	for _, alg := range algorithmOrder {
+		expected, ok := digests[alg]
+		if !ok {
+			continue
+		}
+
+		h := algorithms[alg]()
+		h.Write(body)
+		if subtle.ConstantTimeCompare(h.Sum(nil), expected) != 1 {
+			return fmt.Errorf("content-digest mismatch for %s", alg)
+		}
+	}
+
+	return nil
+}
+
+// Parse reads a Content-Digest or Repr-Digest field value, a dictionary of
+// algorithm=:base64 digest: members, into the raw digests keyed by algorithm.
+func Parse(value string) (map[string][]byte, error) {
+	digests := map[string][]byte{}
+
+	for _, member := range strings.Split(value, ",") {
+		alg, encoded, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid digest field")
+		}
+
+		if len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+			return nil, fmt.Errorf("invalid digest field")
+		}
+
+		digest, err := base64.StdEncoding.DecodeString(encoded[1 : len(encoded)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest field")
+		}
+
+		digests[strings.ToLower(alg)] = digest
+	}
+
+	return digests, nil
+}
+
+// Format builds a digest field value for data with every supported algorithm.
+func Format(data []byte) string {
+	h := newHashes()
+	h.Write(data)
+
+	return h.fieldValue()
+}
+
+func declaresTrailer(r *request.Request) bool {
+	declared, ok := r.Headers.Get("Trailer")
+	return ok && strings.Contains(strings.ToLower(declared), "content-digest")
+}
+
+type hashes map[string]hash.Hash
+
+func newHashes() hashes {
+	h := hashes{}
+	for alg, newHash := range algorithms {
+		h[alg] = newHash()
+	}
+
+	return h
+}
+
+func (h hashes) Write(p []byte) (int, error) {
+	for _, hash := range h {
+		hash.Write(p)
+	}
+
+	return len(p), nil
+}
+
+func (h hashes) fieldValue() string {
+	members := make([]string, 0, len(h))
+	for _, alg := range algorithmOrder {
+		members = append(members, fmt.Sprintf("%s=:%s:", alg, base64.StdEncoding.EncodeToString(h[alg].Sum(nil))))
+	}
+
+	return strings.Join(members, ", ")
+}
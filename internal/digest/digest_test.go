@@ -0,0 +1,163 @@
+package digest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const helloDigest = "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:, " +
+	"sha-512=:m3HSJL1i83hdltRq0+o9czGb+8KJDKra4t/3JRlnPKcjI8PZm6XBHXx6zG4UuMXaDEZjR1wuXDre9G9zvN7AQw==:"
+
+func helloHandler(w *response.Writer, _ *request.Request) *server.HandlerError {
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteBody([]byte("hello"))
+	return nil
+}
+
+func streamingHelloHandler(w *response.Writer, _ *request.Request) *server.HandlerError {
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteBody([]byte("hel"))
+	w.Flush()
+	w.WriteBody([]byte("lo"))
+	return nil
+}
+
+// lengthStreamingHelloHandler frames the body itself and streams it, like a proxied
+// response with a Content-Length
+func lengthStreamingHelloHandler(w *response.Writer, _ *request.Request) *server.HandlerError {
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte("hel"))
+	w.Flush()
+	w.WriteBody([]byte("lo"))
+	return nil
+}
+
+func TestFormatAndParse(t *testing.T) {
+	assert.Equal(t, helloDigest, Format([]byte("hello")))
+
+	digests, err := Parse(helloDigest)
+	require.NoError(t, err)
+	assert.Len(t, digests, 2)
+	assert.Len(t, digests["sha-256"], 32)
+	assert.Len(t, digests["sha-512"], 64)
+
+	_, err = Parse("sha-256=LPJNul")
+	require.Error(t, err)
+	assert.Equal(t, "invalid digest field", err.Error())
+}
+
+func TestMiddlewareResponse(t *testing.T) {
+	// Test: Buffered response gets the digests as headers
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	r, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nTE: trailers\r\n\r\n"))
+	require.NoError(t, err)
+	w.Request = r
+	require.Nil(t, Middleware(helloHandler)(w, r))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Content-Digest: "+helloDigest+"\r\n")
+	assert.Contains(t, buf.String(), "Repr-Digest: "+helloDigest+"\r\n")
+	assert.NotContains(t, buf.String(), "Trailer:")
+
+	// Test: Streamed response gets the digests as trailers
+	buf = &bytes.Buffer{}
+	w = response.NewWriter(buf)
+	w.Request = r
+	require.Nil(t, Middleware(streamingHelloHandler)(w, r))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Trailer: Content-Digest, Repr-Digest\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\nContent-Digest: "+helloDigest+"\r\nRepr-Digest: "+helloDigest+"\r\n\r\n") ||
+		strings.HasSuffix(buf.String(), "0\r\nRepr-Digest: "+helloDigest+"\r\nContent-Digest: "+helloDigest+"\r\n\r\n"))
+
+	// Test: Streamed response with a Content-Length is sent chunked to carry the trailers
+	buf = &bytes.Buffer{}
+	w = response.NewWriter(buf)
+	w.Request = r
+	require.Nil(t, Middleware(lengthStreamingHelloHandler)(w, r))
+	require.NoError(t, w.Finish())
+	res, err := response.ResponseFromReader(bytes.NewReader(buf.Bytes()), "GET")
+	require.NoError(t, err)
+	body, err := res.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	_, ok := res.Headers.Get("Content-Length")
+	assert.False(t, ok)
+	value, _ := res.Trailers.Get("Content-Digest")
+	assert.Equal(t, helloDigest, value)
+	value, _ = res.Trailers.Get("Repr-Digest")
+	assert.Equal(t, helloDigest, value)
+
+	// Test: Clients that can't take chunked keep the Content-Length and get no trailers announced
+	r10, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	buf = &bytes.Buffer{}
+	w = response.NewWriter(buf)
+	w.Request = r10
+	require.Nil(t, Middleware(lengthStreamingHelloHandler)(w, r10))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Content-Length: 5\r\n")
+	assert.NotContains(t, buf.String(), "Trailer:")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+}
+
+func TestMiddlewareRequest(t *testing.T) {
+	// Test: Matching digest
+	r, err := request.RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n" +
+		"Content-Length: 5\r\n" +
+		"Content-Digest: " + helloDigest + "\r\n" +
+		"\r\n" +
+		"hello"))
+	require.NoError(t, err)
+	w := response.NewWriter(&bytes.Buffer{})
+	assert.Nil(t, Middleware(helloHandler)(w, r))
+
+	// Test: Mismatched digest
+	r, err = request.RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n" +
+		"Content-Length: 5\r\n" +
+		"Content-Digest: " + helloDigest + "\r\n" +
+		"\r\n" +
+		"jello"))
+	require.NoError(t, err)
+	w = response.NewWriter(&bytes.Buffer{})
+	hErr := Middleware(helloHandler)(w, r)
+	require.NotNil(t, hErr)
+	assert.Equal(t, response.StatusCode(response.StatusBadRequest), hErr.StatusCode)
+	assert.Equal(t, "content-digest mismatch for sha-256", string(hErr.Body))
+
+	// Test: Mismatched digest in a trailer
+	r, err = request.RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Trailer: Content-Digest\r\n" +
+		"\r\n" +
+		"5\r\njello\r\n0\r\n" +
+		"Content-Digest: sha-512=:m3HSJL1i83hdltRq0+o9czGb+8KJDKra4t/3JRlnPKcjI8PZm6XBHXx6zG4UuMXaDEZjR1wuXDre9G9zvN7AQw==:\r\n" +
+		"\r\n"))
+	require.NoError(t, err)
+	w = response.NewWriter(&bytes.Buffer{})
+	hErr = Middleware(helloHandler)(w, r)
+	require.NotNil(t, hErr)
+	assert.Equal(t, "content-digest mismatch for sha-512", string(hErr.Body))
+
+	// Test: Unknown algorithms are skipped
+	r, err = request.RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n" +
+		"Content-Length: 5\r\n" +
+		"Content-Digest: md5=:XUFAKrxLKna5cZ2REBfFkg==:\r\n" +
+		"\r\n" +
+		"jello"))
+	require.NoError(t, err)
+	w = response.NewWriter(&bytes.Buffer{})
+	assert.Nil(t, Middleware(helloHandler)(w, r))
+}
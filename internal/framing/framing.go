@@ -0,0 +1,54 @@
+package framing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ContentLength reads a Content-Length value, a repeated one is only accepted when every
+// value is the same. The headers package joins repeated fields with ", " so they all end up
+// in one value.
+func ContentLength(value string) (int, error) {
+	length := -1
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return 0, fmt.Errorf("invalid content-length")
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("invalid content-length")
+		}
+
+		if length != -1 && length != n {
+			return 0, fmt.Errorf("conflicting content-length values")
+		}
+		length = n
+	}
+
+	return length, nil
+}
+
+// ChunkSize reads the size line of a chunk without its CRLF. Chunk extensions are allowed
+// by the spec but nothing here has a use for them, they're skipped along with the
+// whitespace that can come before them.
+func ChunkSize(line string) (int, error) {
+	size, _, hasExtension := strings.Cut(line, ";")
+	if hasExtension {
+		size = strings.TrimRight(size, " \t")
+	}
+
+	if size == "" || strings.Trim(size, "0123456789abcdefABCDEF") != "" {
+		return 0, fmt.Errorf("invalid chunk size")
+	}
+
+	n, err := strconv.ParseInt(size, 16, strconv.IntSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk size")
+	}
+
+	return int(n), nil
+}
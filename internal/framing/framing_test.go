@@ -0,0 +1,47 @@
+package framing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentLength(t *testing.T) {
+	// Test: Single and repeated identical values
+	n, err := ContentLength("13")
+	require.NoError(t, err)
+	assert.Equal(t, 13, n)
+	n, err = ContentLength("5, 5")
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	// Test: Conflicting values
+	_, err = ContentLength("5, 6")
+	require.EqualError(t, err, "conflicting content-length values")
+
+	// Test: Anything that isn't only digits
+	for _, value := range []string{"", "+5", "-5", "0x5", "5 5", "5,", "99999999999999999999"} {
+		_, err = ContentLength(value)
+		require.EqualError(t, err, "invalid content-length", value)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	// Test: Sizes are hex, extensions are skipped
+	n, err := ChunkSize("A")
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+	n, err = ChunkSize("7;name=value")
+	require.NoError(t, err)
+	assert.Equal(t, 7, n)
+	n, err = ChunkSize("7 ;name=value")
+	require.NoError(t, err)
+	assert.Equal(t, 7, n)
+
+	// Test: Signs, whitespace without an extension and overflow
+	for _, line := range []string{"", "zz", "-8", "+8", " 8", "8 ", ";ext", "ffffffffffffffff0"} {
+		_, err = ChunkSize(line)
+		require.EqualError(t, err, "invalid chunk size", line)
+	}
+}
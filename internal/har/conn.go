@@ -0,0 +1,347 @@
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+)
+
+// maxHeadSize is how much is kept of a response on top of the body cap, for its head
+// and the framing of a chunked body
+const maxHeadSize = 64 * 1024
+
+// Conn keeps what the server writes to a connection and when, the response of the
+// entry is read back from those bytes once the request is handled.
+type Conn struct {
+	net.Conn
+	recorder *Recorder
+	accepted time.Time
+
+	mu          sync.Mutex
+	requestRead time.Time
+	firstByte   time.Time
+	lastByte    time.Time
+	written     []byte
+	total       int
+}
+
+// Wrap starts following conn, it should be called as soon as the connection is accepted.
+func (r *Recorder) Wrap(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, recorder: r, accepted: time.Now()}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.firstByte.IsZero() {
+		c.firstByte = now
+	}
+	c.lastByte = now
+
+	keep := min(n, max(c.recorder.maxBodySize+maxHeadSize-len(c.written), 0))
+	c.written = append(c.written, p[:keep]...)
+	c.total += n
+
+	return n, err
+}
+
+// CloseWrite passes a half close on to the connection underneath.
+func (c *Conn) CloseWrite() error {
+	halfCloser, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("connection can't be half closed")
+	}
+
+	return halfCloser.CloseWrite()
+}
+
+// RequestRead marks the point the request was read and the response started being worked on.
+func (c *Conn) RequestRead() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.requestRead = time.Now()
+}
+
+// Record adds the entry for req and the response written for it.
+func (c *Conn) Record(req *request.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	requestRead := c.requestRead
+	if requestRead.IsZero() {
+		requestRead = c.accepted
+	}
+	firstByte, lastByte := c.firstByte, c.lastByte
+	if firstByte.IsZero() {
+		firstByte = time.Now()
+		lastByte = firstByte
+	}
+
+	t := timings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		Send:    ms(requestRead.Sub(c.accepted)),
+		Wait:    ms(firstByte.Sub(requestRead)),
+		Receive: ms(lastByte.Sub(firstByte)),
+		SSL:     -1,
+	}
+
+	e := &entry{
+		StartedDateTime: c.accepted.Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            t.Send + t.Wait + t.Receive,
+		Request:         c.recorder.newRequest(req),
+		Response:        c.recorder.newResponse(c.written, c.total, req.RequestLine.Method),
+		Timings:         t,
+		Connection:      req.RemoteAddr,
+	}
+
+	host, _, err := net.SplitHostPort(req.LocalAddr)
+	if err == nil {
+		e.ServerIPAddress = host
+	}
+
+	return c.recorder.add(e)
+}
+
+func (r *Recorder) newRequest(req *request.Request) entryRequest {
+	target := req.RequestLine.RequestTarget
+	host, _ := req.Headers.Get("Host")
+	if strings.HasPrefix(target, "/") {
+		target = "http://" + host + target
+	}
+
+	entryReq := entryRequest{
+		Method:      req.RequestLine.Method,
+		URL:         target,
+		HTTPVersion: "HTTP/" + req.RequestLine.HttpVersion,
+		Cookies:     []cookie{},
+		Headers:     r.fields(req.Headers),
+		QueryString: []nameValue{},
+		HeadersSize: -1,
+		BodySize:    len(req.Body),
+	}
+
+	parsed, err := url.Parse(target)
+	if err == nil {
+		entryReq.QueryString = splitQuery(parsed.RawQuery)
+	}
+
+	if value, ok := req.Headers.Get("Cookie"); ok {
+		for _, pair := range strings.Split(value, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			entryReq.Cookies = append(entryReq.Cookies, cookie{Name: name, Value: r.redactValue("cookie", value)})
+		}
+	}
+
+	if len(req.Body) > 0 {
+		mimeType, _ := req.Headers.Get("Content-Type")
+		post := &postData{MimeType: mimeType}
+		post.Text, post.Encoding, post.Comment = r.bodyText(req.Body, len(req.Body))
+		if strings.HasPrefix(mimeType, "application/x-www-form-urlencoded") {
+			post.Params = splitQuery(string(req.Body))
+		}
+
+		entryReq.PostData = post
+	}
+
+	return entryReq
+}
+
+// newResponse reads the response back from what was written, written holds the first
+// bytes of total when the response was larger than what's kept
+func (r *Recorder) newResponse(written []byte, total int, method string) entryResponse {
+	entryRes := entryResponse{
+		Cookies:     []cookie{},
+		Headers:     []nameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+
+	res, err := response.ResponseFromReader(bytes.NewReader(written), method)
+	if err != nil {
+		entryRes.Comment = fmt.Sprintf("response couldn't be read: %v", err)
+		return entryRes
+	}
+	body, readErr := io.ReadAll(res.Body)
+
+	entryRes.Status = int(res.StatusLine.StatusCode)
+	entryRes.StatusText = res.StatusLine.ReasonPhrase
+	entryRes.HTTPVersion = "HTTP/" + res.StatusLine.HttpVersion
+	entryRes.Headers = r.fields(res.Headers)
+	entryRes.RedirectURL, _ = res.Headers.Get("Location")
+
+	for _, setCookie := range res.Headers.Values("Set-Cookie") {
+		entryRes.Cookies = append(entryRes.Cookies, r.parseSetCookie(setCookie))
+	}
+
+	// the head of the final response ends with the blank line after the interim ones
+	headEnd := 0
+	for range len(res.Interim) + 1 {
+		idx := bytes.Index(written[headEnd:], []byte("\r\n\r\n"))
+		if idx == -1 {
+			break
+		}
+		headEnd += idx + 4
+	}
+	entryRes.HeadersSize = headEnd
+
+	// what follows a switch of protocols isn't the response's body
+	if res.StatusLine.StatusCode == response.StatusSwitchingProtocols {
+		entryRes.BodySize = 0
+		return entryRes
+	}
+	entryRes.BodySize = total - headEnd
+
+	size := len(body)
+	truncated := readErr != nil || total > len(written)
+	if truncated {
+		contentLength, err := strconv.Atoi(fieldValue(res.Headers, "Content-Length"))
+		if err == nil {
+			size = contentLength
+		} else {
+			size = entryRes.BodySize
+		}
+	}
+
+	entryRes.Content = content{Size: size, MimeType: fieldValue(res.Headers, "Content-Type")}
+	entryRes.Content.Text, entryRes.Content.Encoding, entryRes.Content.Comment = r.bodyText(body, size)
+
+	return entryRes
+}
+
+// bodyText is what of body goes into the archive, base64 encoded when it isn't text.
+// size is the whole body's, body can be only the start of it.
+func (r *Recorder) bodyText(body []byte, size int) (text, encoding, comment string) {
+	if r.maxBodySize == 0 {
+		return "", "", "body left out"
+	}
+
+	if len(body) > r.maxBodySize {
+		body = body[:r.maxBodySize]
+	}
+	if len(body) < size {
+		comment = fmt.Sprintf("only the first %d of %d bytes were kept", len(body), size)
+	}
+
+	// a cap in the middle of a multi-byte character doesn't make it binary
+	valid := body
+	for i := 0; i < utf8.UTFMax && len(valid) > 0 && !utf8.Valid(valid) && len(body) < size; i++ {
+		valid = valid[:len(valid)-1]
+	}
+
+	if utf8.Valid(valid) {
+		return string(valid), "", comment
+	}
+
+	return base64.StdEncoding.EncodeToString(body), "base64", comment
+}
+
+// fields lists h sorted under canonical names, with the redacted values replaced
+func (r *Recorder) fields(h headers.Headers) []nameValue {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return strings.Compare(headers.CanonicalName(a), headers.CanonicalName(b))
+	})
+
+	fields := []nameValue{}
+	for _, key := range keys {
+		for _, value := range h[key] {
+			fields = append(fields, nameValue{Name: headers.CanonicalName(key), Value: r.redactValue(key, value)})
+		}
+	}
+
+	return fields
+}
+
+func (r *Recorder) redactValue(name, value string) string {
+	if slices.Contains(r.redact, strings.ToLower(name)) {
+		return redacted
+	}
+
+	return value
+}
+
+func (r *Recorder) parseSetCookie(setCookie string) cookie {
+	parts := strings.Split(setCookie, ";")
+	name, value, _ := strings.Cut(parts[0], "=")
+	c := cookie{Name: strings.TrimSpace(name), Value: r.redactValue("set-cookie", strings.TrimSpace(value))}
+
+	for _, attribute := range parts[1:] {
+		key, val, _ := strings.Cut(attribute, "=")
+		val = strings.TrimSpace(val)
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "path":
+			c.Path = val
+		case "domain":
+			c.Domain = val
+		case "expires":
+			expires, err := time.Parse(response.DateFormat, val)
+			if err == nil {
+				c.Expires = expires.Format(time.RFC3339)
+			}
+		case "httponly":
+			c.HTTPOnly = true
+		case "secure":
+			c.Secure = true
+		}
+	}
+
+	return c
+}
+
+// splitQuery keeps the pairs in the order they came in, url.ParseQuery would lose it
+func splitQuery(query string) []nameValue {
+	pairs := []nameValue{}
+	for _, pair := range strings.Split(query, "&") {
+		if pair == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(pair, "=")
+		pairs = append(pairs, nameValue{Name: unescape(name), Value: unescape(value)})
+	}
+
+	return pairs
+}
+
+func unescape(s string) string {
+	unescaped, err := url.QueryUnescape(s)
+	if err != nil {
+		return s
+	}
+
+	return unescaped
+}
+
+func fieldValue(h headers.Headers, name string) string {
+	value, _ := h.Get(name)
+	return value
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,209 @@
+package har
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const defaultMaxBodySize = 1024 * 1024
+
+// redacted replaces the values of the headers that are redacted
+const redacted = "[redacted]"
+
+// defaultRedactedHeaders carry credentials that shouldn't end up in a file passed around
+var defaultRedactedHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie"}
+
+// footer closes the entries array and the log, every entry is written over the previous
+// footer so the file is a valid archive after each one
+const footer = "\n]}}\n"
+
+// ErrFull is returned for entries that didn't fit in a file capped with WithMaxFileSize.
+var ErrFull = errors.New("har file is full")
+
+// Recorder writes the exchanges of the connections it wraps as entries of an HTTP Archive
+// (HAR 1.2), the format browser devtools import.
+type Recorder struct {
+	mu          sync.Mutex
+	w           io.WriteSeeker
+	offset      int64
+	entries     int
+	maxBodySize int
+	maxFileSize int64
+	redact      []string
+}
+
+type Option func(*Recorder)
+
+// WithMaxBodySize caps how much of a request or response body goes into an entry, the
+// sizes are still the real ones. Zero leaves the bodies out, NewRecorder rejects a negative n.
+func WithMaxBodySize(n int) Option {
+	return func(r *Recorder) {
+		r.maxBodySize = n
+	}
+}
+
+// WithMaxFileSize stops adding entries once the file would grow past n bytes, zero is no limit
+// and NewRecorder rejects a negative n.
+func WithMaxFileSize(n int64) Option {
+	return func(r *Recorder) {
+		r.maxFileSize = n
+	}
+}
+
+// WithRedactedHeaders sets the headers whose values are replaced with [redacted], in
+// place of Authorization, Proxy-Authorization, Cookie and Set-Cookie.
+func WithRedactedHeaders(names ...string) Option {
+	return func(r *Recorder) {
+		r.redact = []string{}
+		for _, name := range names {
+			r.redact = append(r.redact, strings.ToLower(name))
+		}
+	}
+}
+
+// NewRecorder writes an archive without entries to w, they're added as exchanges finish.
+func NewRecorder(w io.WriteSeeker, opts ...Option) (*Recorder, error) {
+	r := &Recorder{
+		w:           w,
+		maxBodySize: defaultMaxBodySize,
+		redact:      defaultRedactedHeaders,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.maxBodySize < 0 {
+		return nil, fmt.Errorf("max body size can't be negative, got %d", r.maxBodySize)
+	}
+	if r.maxFileSize < 0 {
+		return nil, fmt.Errorf("max file size can't be negative, got %d", r.maxFileSize)
+	}
+
+	header := `{"log":{"version":"1.2","creator":{"name":"httpfromtcp","version":"1.0"},"entries":[`
+	_, err := io.WriteString(w, header+footer)
+	if err != nil {
+		return nil, err
+	}
+	r.offset = int64(len(header))
+
+	return r, nil
+}
+
+// add writes e in place of the footer and the footer after it
+func (r *Recorder) add(e *entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	separator := ",\n"
+	if r.entries == 0 {
+		separator = "\n"
+	}
+
+	if r.maxFileSize > 0 && r.offset+int64(len(separator)+len(data)+len(footer)) > r.maxFileSize {
+		return ErrFull
+	}
+
+	_, err = r.w.Seek(r.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(r.w, separator+string(data)+footer)
+	if err != nil {
+		return err
+	}
+
+	r.offset += int64(len(separator) + len(data))
+	r.entries++
+
+	return nil
+}
+
+type entry struct {
+	StartedDateTime string        `json:"startedDateTime"`
+	Time            float64       `json:"time"`
+	Request         entryRequest  `json:"request"`
+	Response        entryResponse `json:"response"`
+	Cache           struct{}      `json:"cache"`
+	Timings         timings       `json:"timings"`
+	ServerIPAddress string        `json:"serverIPAddress,omitempty"`
+	Connection      string        `json:"connection,omitempty"`
+}
+
+type entryRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []cookie    `json:"cookies"`
+	Headers     []nameValue `json:"headers"`
+	QueryString []nameValue `json:"queryString"`
+	PostData    *postData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type entryResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []cookie    `json:"cookies"`
+	Headers     []nameValue `json:"headers"`
+	Content     content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+	Comment     string      `json:"comment,omitempty"`
+}
+
+type nameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type postData struct {
+	MimeType string      `json:"mimeType"`
+	Params   []nameValue `json:"params,omitempty"`
+	Text     string      `json:"text"`
+	// Encoding isn't in HAR 1.2 for post data, custom fields start with an underscore
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// timings are in milliseconds, -1 for the phases that don't apply to a server
+type timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
@@ -0,0 +1,199 @@
+package har
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// discardConn takes whatever is written to it
+type discardConn struct {
+	net.Conn
+}
+
+func (c discardConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+type archive struct {
+	Log struct {
+		Version string  `json:"version"`
+		Entries []entry `json:"entries"`
+	} `json:"log"`
+}
+
+func newTestRecorder(t *testing.T, opts ...Option) (*Recorder, *os.File) {
+	file, err := os.CreateTemp(t.TempDir(), "*.har")
+	require.NoError(t, err)
+	t.Cleanup(func() { file.Close() })
+
+	recorder, err := NewRecorder(file, opts...)
+	require.NoError(t, err)
+
+	return recorder, file
+}
+
+func readArchive(t *testing.T, file *os.File) archive {
+	data, err := os.ReadFile(file.Name())
+	require.NoError(t, err)
+
+	var a archive
+	require.NoError(t, json.Unmarshal(data, &a))
+	return a
+}
+
+// exchange records raw as the request and res, written in the given pieces, as its response
+func exchange(t *testing.T, recorder *Recorder, raw string, res ...string) error {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:50000"
+	req.LocalAddr = "127.0.0.1:42069"
+
+	conn := recorder.Wrap(discardConn{})
+	conn.RequestRead()
+	for _, piece := range res {
+		_, err = conn.Write([]byte(piece))
+		require.NoError(t, err)
+	}
+
+	return conn.Record(req)
+}
+
+func TestRecorder(t *testing.T) {
+	// Test: The file is an archive without entries before anything is recorded
+	recorder, file := newTestRecorder(t)
+	a := readArchive(t, file)
+	assert.Equal(t, "1.2", a.Log.Version)
+	assert.Empty(t, a.Log.Entries)
+
+	// Test: Every entry leaves a valid archive behind
+	err := exchange(t, recorder,
+		"POST /form?b=2&a=%20x HTTP/1.1\r\nHost: localhost:42069\r\nAuthorization: Bearer secret\r\nCookie: session=abc; theme=dark\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 11\r\n\r\nname=a+b&c=",
+		"HTTP/1.1 201 Created\r\nContent-Type: text/plain\r\nSet-Cookie: session=def; Path=/; HttpOnly\r\nContent-Length: 2\r\n\r\n",
+		"ok",
+	)
+	require.NoError(t, err)
+
+	a = readArchive(t, file)
+	require.Len(t, a.Log.Entries, 1)
+	e := a.Log.Entries[0]
+	assert.Equal(t, "127.0.0.1", e.ServerIPAddress)
+	assert.Equal(t, "127.0.0.1:50000", e.Connection)
+	assert.Equal(t, float64(-1), e.Timings.DNS)
+
+	assert.Equal(t, "POST", e.Request.Method)
+	assert.Equal(t, "http://localhost:42069/form?b=2&a=%20x", e.Request.URL)
+	assert.Equal(t, "HTTP/1.1", e.Request.HTTPVersion)
+	assert.Equal(t, []nameValue{{Name: "b", Value: "2"}, {Name: "a", Value: " x"}}, e.Request.QueryString)
+	assert.Contains(t, e.Request.Headers, nameValue{Name: "Authorization", Value: "[redacted]"})
+	assert.Contains(t, e.Request.Headers, nameValue{Name: "Content-Length", Value: "11"})
+	assert.Equal(t, []cookie{{Name: "session", Value: "[redacted]"}, {Name: "theme", Value: "[redacted]"}}, e.Request.Cookies)
+	require.NotNil(t, e.Request.PostData)
+	assert.Equal(t, "name=a+b&c=", e.Request.PostData.Text)
+	assert.Equal(t, []nameValue{{Name: "name", Value: "a b"}, {Name: "c", Value: ""}}, e.Request.PostData.Params)
+	assert.Equal(t, 11, e.Request.BodySize)
+
+	assert.Equal(t, 201, e.Response.Status)
+	assert.Equal(t, "Created", e.Response.StatusText)
+	assert.Contains(t, e.Response.Headers, nameValue{Name: "Set-Cookie", Value: "[redacted]"})
+	assert.Equal(t, []cookie{{Name: "session", Value: "[redacted]", Path: "/", HTTPOnly: true}}, e.Response.Cookies)
+	assert.Equal(t, content{Size: 2, MimeType: "text/plain", Text: "ok"}, e.Response.Content)
+	assert.Equal(t, 112, e.Response.HeadersSize)
+	assert.Equal(t, 2, e.Response.BodySize)
+
+	err = exchange(t, recorder, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n")
+	require.NoError(t, err)
+
+	a = readArchive(t, file)
+	require.Len(t, a.Log.Entries, 2)
+	assert.Equal(t, 204, a.Log.Entries[1].Response.Status)
+	assert.Nil(t, a.Log.Entries[1].Request.PostData)
+}
+
+func TestRecorderContent(t *testing.T) {
+	// Test: Binary bodies are base64 encoded
+	recorder, file := newTestRecorder(t, WithRedactedHeaders("X-Secret"))
+	err := exchange(t, recorder,
+		"GET /image HTTP/1.1\r\nHost: localhost\r\nX-Secret: shh\r\nAuthorization: Basic abc\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Length: 4\r\n\r\n\x89PNG",
+	)
+	require.NoError(t, err)
+
+	e := readArchive(t, file).Log.Entries[0]
+	assert.Equal(t, content{Size: 4, MimeType: "image/png", Text: "iVBORw==", Encoding: "base64"}, e.Response.Content)
+
+	// Test: Only the given headers are redacted
+	assert.Contains(t, e.Request.Headers, nameValue{Name: "X-Secret", Value: "[redacted]"})
+	assert.Contains(t, e.Request.Headers, nameValue{Name: "Authorization", Value: "Basic abc"})
+
+	// Test: Bodies over the cap are cut, with their whole size
+	recorder, file = newTestRecorder(t, WithMaxBodySize(5))
+	err = exchange(t, recorder,
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"a\r\n0123456789\r\n",
+		"0\r\n\r\n",
+	)
+	require.NoError(t, err)
+
+	e = readArchive(t, file).Log.Entries[0]
+	assert.Equal(t, "01234", e.Response.Content.Text)
+	assert.Equal(t, 10, e.Response.Content.Size)
+	assert.Equal(t, "only the first 5 of 10 bytes were kept", e.Response.Content.Comment)
+	assert.Equal(t, 20, e.Response.BodySize)
+
+	// Test: Bodies are left out with no room for them
+	recorder, file = newTestRecorder(t, WithMaxBodySize(0))
+	err = exchange(t, recorder,
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello",
+	)
+	require.NoError(t, err)
+
+	e = readArchive(t, file).Log.Entries[0]
+	assert.Equal(t, content{Size: 5, MimeType: "text/plain", Comment: "body left out"}, e.Response.Content)
+}
+
+func TestRecorderMaxFileSize(t *testing.T) {
+	recorder, file := newTestRecorder(t, WithMaxFileSize(2048))
+
+	// Test: Entries stop being added once the file is full, it stays a valid archive
+	var err error
+	added := 0
+	for range 10 {
+		err = exchange(t, recorder, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+		if err != nil {
+			break
+		}
+		added++
+	}
+	require.ErrorIs(t, err, ErrFull)
+	assert.Greater(t, added, 0)
+
+	info, err := file.Stat()
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(2048))
+	assert.Len(t, readArchive(t, file).Log.Entries, added)
+}
+
+func TestRecorderOptions(t *testing.T) {
+	// Test: Negative sizes are rejected before anything is written
+	file, err := os.CreateTemp(t.TempDir(), "*.har")
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = NewRecorder(file, WithMaxBodySize(-1))
+	require.EqualError(t, err, "max body size can't be negative, got -1")
+	_, err = NewRecorder(file, WithMaxFileSize(-1))
+	require.EqualError(t, err, "max file size can't be negative, got -1")
+
+	info, err := file.Stat()
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"slices"
 	"strings"
-	"unicode"
 )
 
-type Headers map[string]string
+// Headers maps field names to their values. Repeated fields are combined into one comma
+// separated value, except for Set-Cookie whose values each get their own element and are
+// written as separate fields.
+type Headers map[string][]string
 
 func NewHeaders() Headers {
 	return make(Headers)
@@ -27,41 +29,129 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return 2, true, nil
 	}
 
-	headerText := string(data[:idx])
-	parts := strings.Split(strings.TrimSpace(headerText), ": ")
-
-	if len(parts) != 2 || strings.ContainsAny(parts[0], " ") {
+	// a line starting with whitespace continues the previous field (obs-fold) or hides
+	// a field from whoever drops the whitespace, either way it's rejected (RFC 9112 section 5.2)
+	if data[0] == ' ' || data[0] == '\t' {
 		return 0, false, fmt.Errorf("invalid header format")
 	}
 
-	for _, r := range parts[0] {
-		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
-			if !slices.Contains(specialCharacters, string(r)) {
-				return 0, false, fmt.Errorf("invalid header key format")
-			}
-		}
+	// the name ends at the first colon, values can have colons of their own (dates, urls)
+	// and the whitespace after the colon is optional, so is the value (RFC 9110 section 5.5)
+	headerText := strings.TrimSpace(string(data[:idx]))
+	name, value, found := strings.Cut(headerText, ":")
+	value = strings.TrimSpace(value)
+
+	if !found || name == "" || strings.ContainsAny(name, " \t") {
+		return 0, false, fmt.Errorf("invalid header format")
 	}
 
-	key := strings.ToLower(strings.TrimSpace(parts[0]))
-	value := strings.TrimSpace(parts[1])
+	if !isToken(name) {
+		return 0, false, fmt.Errorf("invalid header key format")
+	}
 
-	currentValue, ok := h.Get(key)
-	if ok {
-		h.Set(key, fmt.Sprintf("%s, %s", currentValue, value))
-	} else {
-		h.Set(key, value)
+	// a bare CR or a NUL is read differently by different parsers (RFC 9112 section 2.2)
+	if !ValidFieldValue(value) {
+		return 0, false, fmt.Errorf("invalid header value format")
 	}
 
+	key := strings.ToLower(name)
+
+	h.Add(key, value)
+
 	return len(data[:idx]) + 2, false, nil
 }
 
 func (h Headers) Set(key, value string) {
-	h[key] = value
+	h[key] = []string{value}
 }
 
+// Get looks the key up as is first and falls back to a case insensitive match,
+// parsed headers are stored lowercased while handlers tend to set canonical names.
 func (h Headers) Get(key string) (string, bool) {
-	val, ok := h[key]
-	return val, ok
+	values, ok := h.lookup(key)
+	if !ok {
+		return "", false
+	}
+
+	return strings.Join(values, ", "), true
+}
+
+func (h Headers) lookup(key string) ([]string, bool) {
+	values, ok := h[key]
+	if ok {
+		return values, ok
+	}
+
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+// Add appends a value to a field, repeated fields are combined into a comma separated list.
+// Set-Cookie is the exception (RFC 9110 section 5.3), its values can contain commas themselves,
+// so every one is kept as its own element and written out as a separate field.
+func (h Headers) Add(key, value string) {
+	currentValues, ok := h.lookup(key)
+	if !ok {
+		h.Set(key, value)
+		return
+	}
+
+	values := slices.Clone(currentValues)
+	if strings.EqualFold(key, "set-cookie") {
+		values = append(values, value)
+	} else {
+		values[len(values)-1] += ", " + value
+	}
+
+	h.Delete(key)
+	h[key] = values
+}
+
+// Values returns every value of a field, split the same way Add combined them.
+func (h Headers) Values(key string) []string {
+	currentValues, ok := h.lookup(key)
+	if !ok {
+		return nil
+	}
+
+	if strings.EqualFold(key, "set-cookie") {
+		return slices.Clone(currentValues)
+	}
+
+	values := []string{}
+	for _, value := range currentValues {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+
+	return values
+}
+
+// Clone copies h, the values of the copy can be changed without affecting h.
+func (h Headers) Clone() Headers {
+	clone := make(Headers, len(h))
+	for key, values := range h {
+		clone[key] = slices.Clone(values)
+	}
+
+	return clone
+}
+
+func (h Headers) Delete(key string) {
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
 }
 
 func (h Headers) OverrideHeader(key, value string) error {
@@ -70,6 +160,126 @@ func (h Headers) OverrideHeader(key, value string) error {
 		return fmt.Errorf("header not found")
 	}
 
-	h[key] = value
+	h[key] = []string{value}
 	return nil
-}
\ No newline at end of file
+}
+
+// CanonicalName capitalizes every dash separated part of name, the way field names are
+// usually written: content-type becomes Content-Type.
+func CanonicalName(name string) string {
+	parts := strings.Split(strings.ToLower(name), "-")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+
+	return strings.Join(parts, "-")
+}
+
+// ValidFieldName reports whether name can be written as a header field name as is.
+func ValidFieldName(name string) bool {
+	return name != "" && isToken(name)
+}
+
+// ValidFieldValue reports whether value can be written as a header field value without
+// changing the meaning of the message, a CR or LF in it would end the field early.
+func ValidFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if !isFieldValueByte(value[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// EncodeFieldValue makes any string safe to use as a header field value by percent encoding
+// the bytes that aren't allowed in one, and the percent sign itself so it can be decoded again.
+func EncodeFieldValue(value string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '%' || !isFieldValueByte(c) || c >= 0x80 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// ParseField splits a field written as "Name: value", the way fields are given on a command line.
+func ParseField(field string) (name, value string, err error) {
+	name, value, ok := strings.Cut(field, ":")
+	value = strings.TrimSpace(value)
+	if !ok || !ValidFieldName(name) || !ValidFieldValue(value) {
+		return "", "", fmt.Errorf("want Name: value, got %q", field)
+	}
+
+	return name, value, nil
+}
+
+// Fields collects the "Name: value" fields of a command line flag given more than once,
+// it's meant to be passed to flag.Var.
+type Fields Headers
+
+func (f *Fields) String() string {
+	var fields []string
+	for name, values := range *f {
+		for _, value := range values {
+			fields = append(fields, name+": "+value)
+		}
+	}
+
+	slices.Sort(fields)
+	return strings.Join(fields, ", ")
+}
+
+func (f *Fields) Set(field string) error {
+	name, value, err := ParseField(field)
+	if err != nil {
+		return err
+	}
+
+	if *f == nil {
+		*f = make(Fields)
+	}
+	Headers(*f).Add(name, value)
+	return nil
+}
+
+// AddTo adds every collected field to h.
+func (f Fields) AddTo(h Headers) {
+	for name, values := range f {
+		for _, value := range values {
+			h.Add(name, value)
+		}
+	}
+}
+
+// isToken reports whether s is made of tchars (RFC 9110 section 5.6.2), those are all
+// ascii, a letter from another alphabet isn't allowed in a field name
+func isToken(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isASCIILetter(c) && !(c >= '0' && c <= '9') {
+			if !slices.Contains(specialCharacters, string(c)) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isFieldValueByte(c byte) bool {
+	return c == '\t' || (c >= ' ' && c != 0x7f)
+}
@@ -15,18 +15,18 @@ func TestHeaders(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers["host"])
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
 	// valid single header with extra whitespaces
 	headers = NewHeaders()
-	data = []byte("      Host: localhost:42069            \r\n\r\n")
+	data = []byte("Host:       localhost:42069            \r\n\r\n")
 
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers["host"])
 	assert.Equal(t, 41, n)
 	assert.False(t, done)
 
@@ -38,12 +38,12 @@ func TestHeaders(t *testing.T) {
 	n, done, err = headers.Parse(host)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers["host"])
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 	n, done, err = headers.Parse(authorization)
 	require.NoError(t, err)
-	assert.Equal(t, "Bearer token", headers["authorization"])
+	assert.Equal(t, []string{"Bearer token"}, headers["authorization"])
 	assert.Equal(t, 29, n)
 	assert.False(t, done)
 
@@ -67,6 +67,16 @@ func TestHeaders(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
+	// invalid tab before colon
+	headers = NewHeaders()
+	data = []byte("Host\t: localhost:42069\r\n\r\n")
+
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, "invalid header format", err.Error())
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
 	// invalid special key character
 	headers = NewHeaders()
 	data = []byte("H©st: localhost:42069\r\n\r\n")
@@ -84,7 +94,7 @@ func TestHeaders(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["h!~st"])
+	assert.Equal(t, []string{"localhost:42069"}, headers["h!~st"])
 	assert.Equal(t, 24, n)
 	assert.False(t, done)
 
@@ -97,19 +107,196 @@ func TestHeaders(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "kacpi", headers["set-person"])
+	assert.Equal(t, []string{"kacpi"}, headers["set-person"])
 	assert.Equal(t, 19, n)
 	assert.False(t, done)
 	
 	n, done, err = headers.Parse(moreData)
 	require.NoError(t, err)
-	assert.Equal(t, "kacpi, mati", headers["set-person"])
+	assert.Equal(t, []string{"kacpi, mati"}, headers["set-person"])
 	assert.Equal(t, 18, n)
 	assert.False(t, done)
 	
 	n, done, err = headers.Parse(evenMoreData)
 	require.NoError(t, err)
-	assert.Equal(t, "kacpi, mati, slawek", headers["set-person"])
+	assert.Equal(t, []string{"kacpi, mati, slawek"}, headers["set-person"])
 	assert.Equal(t, 20, n)
 	assert.False(t, done)
+
+	// empty values
+	headers = NewHeaders()
+	data = []byte("X-Empty:\r\nX-Blank:   \r\n\r\n")
+
+	n, done, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{""}, headers["x-empty"])
+	assert.Equal(t, 10, n)
+	assert.False(t, done)
+
+	n, done, err = headers.Parse(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{""}, headers["x-blank"])
+	assert.Equal(t, 13, n)
+	assert.False(t, done)
+
+	// missing name
+	headers = NewHeaders()
+	data = []byte(": value\r\n\r\n")
+
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, "invalid header format", err.Error())
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// values with colons of their own and no space after the colon
+	headers = NewHeaders()
+	data = []byte("Location: http://localhost:42069/a: b\r\nX-Tight:value\r\n\r\n")
+
+	n, done, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://localhost:42069/a: b"}, headers["location"])
+	assert.Equal(t, 39, n)
+	assert.False(t, done)
+
+	n, done, err = headers.Parse(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"value"}, headers["x-tight"])
+	assert.Equal(t, 15, n)
+	assert.False(t, done)
+}
+
+func TestHeadersRejectAmbiguousLines(t *testing.T) {
+	// a folded line isn't read as a field of its own
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("X-Padding: a\r\n Transfer-Encoding: chunked\r\n\r\n"))
+	require.NoError(t, err)
+	_, _, err = headers.Parse([]byte(" Transfer-Encoding: chunked\r\n\r\n"))
+	require.EqualError(t, err, "invalid header format")
+	_, _, err = headers.Parse([]byte("\tTransfer-Encoding: chunked\r\n\r\n"))
+	require.EqualError(t, err, "invalid header format")
+	_, ok := headers.Get("Transfer-Encoding")
+	assert.False(t, ok)
+
+	// bare CR and NUL in a value
+	_, _, err = NewHeaders().Parse([]byte("X-Evil: a\rTransfer-Encoding: chunked\r\n\r\n"))
+	require.EqualError(t, err, "invalid header value format")
+	_, _, err = NewHeaders().Parse([]byte("X-Evil: a\x00b\r\n\r\n"))
+	require.EqualError(t, err, "invalid header value format")
+
+	// tabs and non ascii bytes are fine in a value
+	headers = NewHeaders()
+	_, _, err = headers.Parse([]byte("X-Note: a\tzłoty\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a\tzłoty"}, headers["x-note"])
+}
+
+func TestFieldValidation(t *testing.T) {
+	// valid field name
+	assert.True(t, ValidFieldName("X-Content-Sha256"))
+
+	// empty field name
+	assert.False(t, ValidFieldName(""))
+
+	// field name with injected header
+	assert.False(t, ValidFieldName("X-Forwarded-For: evil\r\nSet-Cookie"))
+
+	// field name with non ascii letters
+	assert.False(t, ValidFieldName("Hést"))
+	assert.False(t, ValidFieldName("X-Ǆ"))
+
+	// valid field value
+	assert.True(t, ValidFieldValue("text/html; charset=utf-8"))
+
+	// field value with tab
+	assert.True(t, ValidFieldValue("a\tb"))
+
+	// field value with injected header
+	assert.False(t, ValidFieldValue("ok\r\nSet-Cookie: session=stolen"))
+
+	// field value with bare line feed
+	assert.False(t, ValidFieldValue("ok\nSet-Cookie: session=stolen"))
+
+	// field value with null byte
+	assert.False(t, ValidFieldValue("ok\x00"))
+
+	// encoding a safe value leaves it alone
+	assert.Equal(t, "text/html", EncodeFieldValue("text/html"))
+
+	// encoding an injected header
+	encoded := EncodeFieldValue("ok\r\nSet-Cookie: session=stolen")
+	assert.Equal(t, "ok%0D%0ASet-Cookie: session=stolen", encoded)
+	assert.True(t, ValidFieldValue(encoded))
+
+	// encoding non ascii and percent signs
+	assert.Equal(t, "100%25 z%C5%82oty", EncodeFieldValue("100% złoty"))
+
+	// canonical names
+	assert.Equal(t, "Content-Type", CanonicalName("content-type"))
+	assert.Equal(t, "X-Forwarded-For", CanonicalName("X-FORWARDED-FOR"))
+	assert.Equal(t, "Te", CanonicalName("TE"))
+}
+
+func TestHeadersAddValues(t *testing.T) {
+	// repeated values are combined
+	headers := NewHeaders()
+	headers.Add("Accept", "text/html")
+	headers.Add("accept", "application/json")
+	value, ok := headers.Get("ACCEPT")
+	assert.True(t, ok)
+	assert.Equal(t, "text/html, application/json", value)
+	assert.Equal(t, []string{"text/html", "application/json"}, headers.Values("Accept"))
+
+	// set-cookie values are kept apart
+	headers = NewHeaders()
+	data := []byte("Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\n\r\n")
+	moreData := []byte("Set-Cookie: b=2\r\n\r\n")
+	_, _, err := headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(moreData)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, headers.Values("set-cookie"))
+
+	// a value with a line feed stays one value, it isn't split into more cookies
+	headers.Add("Set-Cookie", "pref=x\nsession=evil")
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2", "pref=x\nsession=evil"}, headers.Values("set-cookie"))
+
+	// missing key
+	assert.Nil(t, headers.Values("Cookie"))
+
+	// delete is case insensitive
+	headers.Delete("SET-COOKIE")
+	assert.Equal(t, 0, len(headers))
+}
+
+func TestFields(t *testing.T) {
+	// fields are split at the first colon
+	name, value, err := ParseField("Location:  http://localhost:42069/ ")
+	require.NoError(t, err)
+	assert.Equal(t, "Location", name)
+	assert.Equal(t, "http://localhost:42069/", value)
+
+	// the name has to be a token and the colon is required
+	_, _, err = ParseField("X Forwarded: a")
+	require.EqualError(t, err, `want Name: value, got "X Forwarded: a"`)
+	_, _, err = ParseField("Accept")
+	require.EqualError(t, err, `want Name: value, got "Accept"`)
+	_, _, err = ParseField("X-Evil: a\r\nHost: b")
+	require.Error(t, err)
+
+	// a flag given more than once collects every field
+	var fields Fields
+	require.NoError(t, fields.Set("Accept: text/html"))
+	require.NoError(t, fields.Set("Set-Cookie: a=1"))
+	require.NoError(t, fields.Set("Accept: application/json"))
+	require.NoError(t, fields.Set("Set-Cookie: b=2"))
+	require.Error(t, fields.Set(": nameless"))
+	assert.Equal(t, "Accept: text/html, application/json, Set-Cookie: a=1, Set-Cookie: b=2", fields.String())
+
+	headers := NewHeaders()
+	fields.AddTo(headers)
+	value, ok := headers.Get("Accept")
+	assert.True(t, ok)
+	assert.Equal(t, "text/html, application/json", value)
+	assert.Equal(t, []string{"a=1", "b=2"}, headers.Values("Set-Cookie"))
 }
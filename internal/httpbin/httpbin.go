@@ -0,0 +1,600 @@
+package httpbin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+)
+
+const maxDelay = 10
+const maxStreamLines = 100
+const maxBytes = 100 * 1024
+
+type route struct {
+	name    string
+	handler func(prefix string, params []string) server.Handler
+}
+
+// routes are matched on the first path segment, whatever follows it is passed on as params
+var routes = []route{
+	{"get", func(_ string, _ []string) server.Handler {
+		return server.ByMethod(map[string]server.Handler{"GET": handleGet})
+	}},
+	{"post", func(_ string, _ []string) server.Handler {
+		return server.ByMethod(map[string]server.Handler{"POST": handlePost})
+	}},
+	{"headers", func(_ string, _ []string) server.Handler { return handleHeaders }},
+	{"ip", func(_ string, _ []string) server.Handler { return handleIP }},
+	{"status", handleStatus},
+	{"delay", handleDelay},
+	{"stream", handleStream},
+	{"bytes", handleBytes},
+	{"drip", func(_ string, _ []string) server.Handler { return handleDrip }},
+	{"redirect", handleRedirect},
+	{"cookies", handleCookies},
+	{"basic-auth", handleBasicAuth},
+}
+
+// Handler serves the commonly used httpbin.org endpoints under prefix, so /get is
+// reachable at /httpbin/get with the prefix "/httpbin". Redirects stay under the prefix.
+func Handler(prefix string) server.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	return func(w *response.Writer, r *request.Request) *server.HandlerError {
+		target, err := url.ParseRequestURI(r.RequestLine.RequestTarget)
+		if err != nil {
+			return textError(response.StatusBadRequest, "invalid request target")
+		}
+
+		path, ok := strings.CutPrefix(target.Path, prefix+"/")
+		if !ok {
+			return textError(response.StatusNotFound, "not found")
+		}
+
+		segments := strings.Split(path, "/")
+		for _, route := range routes {
+			if route.name == segments[0] {
+				return route.handler(prefix, segments[1:])(w, r)
+			}
+		}
+
+		return textError(response.StatusNotFound, "not found")
+	}
+}
+
+func handleGet(w *response.Writer, r *request.Request) *server.HandlerError {
+	return writeJSON(w, response.StatusOk, map[string]any{
+		"args":    args(r),
+		"headers": requestHeaders(r),
+		"origin":  origin(r),
+		"url":     requestURL(r),
+	})
+}
+
+func handlePost(w *response.Writer, r *request.Request) *server.HandlerError {
+	body, err := r.ReadBody()
+	if err != nil {
+		return textError(response.StatusBadRequest, err.Error())
+	}
+
+	form := map[string]any{}
+	var jsonBody any
+
+	contentType, _ := r.Headers.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return textError(response.StatusBadRequest, "invalid form body")
+		}
+		form = flatten(values)
+	case strings.HasPrefix(contentType, "application/json"):
+		err := json.Unmarshal(body, &jsonBody)
+		if err != nil {
+			return textError(response.StatusBadRequest, "invalid json body")
+		}
+	}
+
+	return writeJSON(w, response.StatusOk, map[string]any{
+		"args":    args(r),
+		"data":    string(body),
+		"form":    form,
+		"json":    jsonBody,
+		"headers": requestHeaders(r),
+		"origin":  origin(r),
+		"url":     requestURL(r),
+	})
+}
+
+func handleHeaders(w *response.Writer, r *request.Request) *server.HandlerError {
+	return writeJSON(w, response.StatusOk, map[string]any{"headers": requestHeaders(r)})
+}
+
+func handleIP(w *response.Writer, r *request.Request) *server.HandlerError {
+	return writeJSON(w, response.StatusOk, map[string]any{"origin": origin(r)})
+}
+
+func handleStatus(prefix string, params []string) server.Handler {
+	return func(w *response.Writer, r *request.Request) *server.HandlerError {
+		if len(params) != 1 {
+			return textError(response.StatusNotFound, "not found")
+		}
+
+		code, err := strconv.Atoi(params[0])
+		if err != nil || code < 200 || code > 599 {
+			return textError(response.StatusBadRequest, "invalid status code")
+		}
+
+		err = w.WriteStatusLine(response.StatusCode(code))
+		if err != nil {
+			return internalError(err)
+		}
+
+		h := headers.NewHeaders()
+		switch {
+		case code == response.StatusUnauthorized:
+			h.Set("WWW-Authenticate", `Basic realm="Fake Realm"`)
+		case code >= 300 && code < 400 && code != response.StatusNotModified:
+			h.Set("Location", prefix+"/redirect/1")
+		}
+
+		err = w.WriteHeaders(h)
+		if err != nil {
+			return internalError(err)
+		}
+
+		return nil
+	}
+}
+
+func handleDelay(_ string, params []string) server.Handler {
+	return func(w *response.Writer, r *request.Request) *server.HandlerError {
+		seconds, err := intParam(params)
+		if err != nil {
+			return textError(response.StatusBadRequest, err.Error())
+		}
+
+		if !sleep(r, time.Duration(min(seconds, maxDelay))*time.Second) {
+			return nil
+		}
+
+		return handleGet(w, r)
+	}
+}
+
+func handleStream(_ string, params []string) server.Handler {
+	return func(w *response.Writer, r *request.Request) *server.HandlerError {
+		n, err := intParam(params)
+		if err != nil {
+			return textError(response.StatusBadRequest, err.Error())
+		}
+
+		err = w.WriteStatusLine(response.StatusOk)
+		if err != nil {
+			return internalError(err)
+		}
+
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "application/json")
+		err = w.WriteHeaders(h)
+		if err != nil {
+			return internalError(err)
+		}
+
+		for i := range min(n, maxStreamLines) {
+			line, err := json.Marshal(map[string]any{
+				"id":      i,
+				"args":    args(r),
+				"headers": requestHeaders(r),
+				"origin":  origin(r),
+				"url":     requestURL(r),
+			})
+			if err != nil {
+				return internalError(err)
+			}
+
+			w.WriteBody(append(line, '\n'))
+
+			// the client is gone once a flush fails, there's nobody to send an error to
+			if w.Flush() != nil {
+				return nil
+			}
+		}
+
+		return nil
+	}
+}
+
+func handleBytes(_ string, params []string) server.Handler {
+	return func(w *response.Writer, r *request.Request) *server.HandlerError {
+		n, err := intParam(params)
+		if err != nil {
+			return textError(response.StatusBadRequest, err.Error())
+		}
+
+		seed := time.Now().UnixNano()
+		query := args(r)
+		if value, ok := query["seed"].(string); ok {
+			seed, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return textError(response.StatusBadRequest, "invalid seed")
+			}
+		}
+
+		data := make([]byte, min(n, maxBytes))
+		rand.New(rand.NewSource(seed)).Read(data)
+
+		err = w.WriteStatusLine(response.StatusOk)
+		if err != nil {
+			return internalError(err)
+		}
+
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "application/octet-stream")
+		err = w.WriteHeaders(h)
+		if err != nil {
+			return internalError(err)
+		}
+
+		w.WriteBody(data)
+
+		return nil
+	}
+}
+
+// handleDrip sends numbytes asterisks spread evenly over duration seconds, after an initial delay.
+func handleDrip(w *response.Writer, r *request.Request) *server.HandlerError {
+	query, err := url.ParseQuery(rawQuery(r))
+	if err != nil {
+		return textError(response.StatusBadRequest, "invalid query")
+	}
+
+	duration, err := floatQuery(query, "duration", 2)
+	if err != nil {
+		return textError(response.StatusBadRequest, err.Error())
+	}
+
+	delay, err := floatQuery(query, "delay", 0)
+	if err != nil {
+		return textError(response.StatusBadRequest, err.Error())
+	}
+
+	numBytes, err := floatQuery(query, "numbytes", 10)
+	if err != nil || numBytes < 1 || numBytes > maxBytes {
+		return textError(response.StatusBadRequest, "invalid numbytes")
+	}
+
+	code, err := floatQuery(query, "code", response.StatusOk)
+	if err != nil || code < 200 || code > 599 {
+		return textError(response.StatusBadRequest, "invalid code")
+	}
+
+	if !sleep(r, time.Duration(min(delay, maxDelay)*float64(time.Second))) {
+		return nil
+	}
+
+	err = w.WriteStatusLine(response.StatusCode(code))
+	if err != nil {
+		return internalError(err)
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.Itoa(int(numBytes)))
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return internalError(err)
+	}
+
+	pause := time.Duration(min(duration, maxDelay) / numBytes * float64(time.Second))
+	for i := 0; i < int(numBytes); i++ {
+		w.WriteBody([]byte("*"))
+		if w.Flush() != nil || !sleep(r, pause) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func handleRedirect(prefix string, params []string) server.Handler {
+	return func(w *response.Writer, r *request.Request) *server.HandlerError {
+		n, err := intParam(params)
+		if err != nil || n < 1 {
+			return textError(response.StatusBadRequest, "invalid number of redirects")
+		}
+
+		location := prefix + "/get"
+		if n > 1 {
+			location = fmt.Sprintf("%s/redirect/%d", prefix, n-1)
+		}
+
+		if args(r)["absolute"] == "true" {
+			host, _ := r.Headers.Get("Host")
+			location = "http://" + host + location
+		}
+
+		return redirect(w, location, nil)
+	}
+}
+
+func handleCookies(prefix string, params []string) server.Handler {
+	return func(w *response.Writer, r *request.Request) *server.HandlerError {
+		if len(params) == 0 {
+			return writeJSON(w, response.StatusOk, map[string]any{"cookies": cookies(r)})
+		}
+
+		query, err := url.ParseQuery(rawQuery(r))
+		if err != nil {
+			return textError(response.StatusBadRequest, "invalid query")
+		}
+
+		names := make([]string, 0, len(query))
+		for name := range query {
+			// a cookie name is a token, anything else would spill into the attributes
+			if !headers.ValidFieldName(name) {
+				return textError(response.StatusBadRequest, "invalid cookie name")
+			}
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		setCookies := headers.NewHeaders()
+		switch params[0] {
+		case "set":
+			for _, name := range names {
+				setCookies.Add("Set-Cookie", fmt.Sprintf("%s=%s; Path=/", name, cookieValue(query.Get(name))))
+			}
+		case "delete":
+			for _, name := range names {
+				setCookies.Add("Set-Cookie", fmt.Sprintf("%s=; Expires=Thu, 01 Jan 1970 00:00:00 GMT; Max-Age=0; Path=/", name))
+			}
+		default:
+			return textError(response.StatusNotFound, "not found")
+		}
+
+		return redirect(w, prefix+"/cookies", setCookies)
+	}
+}
+
+func handleBasicAuth(_ string, params []string) server.Handler {
+	return func(w *response.Writer, r *request.Request) *server.HandlerError {
+		if len(params) != 2 {
+			return textError(response.StatusNotFound, "not found")
+		}
+
+		user, password, ok := basicAuth(r)
+		if !ok || user != params[0] || password != params[1] {
+			errorHeaders := headers.NewHeaders()
+			errorHeaders.Set("WWW-Authenticate", `Basic realm="Fake Realm"`)
+
+			return &server.HandlerError{
+				StatusCode: response.StatusUnauthorized,
+				Headers:    errorHeaders,
+			}
+		}
+
+		return writeJSON(w, response.StatusOk, map[string]any{
+			"authenticated": true,
+			"user":          user,
+		})
+	}
+}
+
+func redirect(w *response.Writer, location string, h headers.Headers) *server.HandlerError {
+	err := w.WriteStatusLine(response.StatusFound)
+	if err != nil {
+		return internalError(err)
+	}
+
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	h.Set("Location", location)
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return nil
+}
+
+func writeJSON(w *response.Writer, statusCode response.StatusCode, v any) *server.HandlerError {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return internalError(err)
+	}
+
+	err = w.WriteStatusLine(statusCode)
+	if err != nil {
+		return internalError(err)
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "application/json")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return internalError(err)
+	}
+
+	_, err = w.WriteBody(append(body, '\n'))
+	if err != nil {
+		return internalError(err)
+	}
+
+	return nil
+}
+
+func textError(statusCode response.StatusCode, message string) *server.HandlerError {
+	errorHeaders := headers.NewHeaders()
+	errorHeaders.Set("Content-Type", "text/plain")
+
+	return &server.HandlerError{
+		StatusCode: statusCode,
+		Headers:    errorHeaders,
+		Body:       []byte(message),
+	}
+}
+
+func internalError(err error) *server.HandlerError {
+	return textError(response.StatusInternalServerError, err.Error())
+}
+
+// sleep waits for d, false means the request was cancelled in the meantime
+func sleep(r *request.Request, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func intParam(params []string) (int, error) {
+	if len(params) != 1 {
+		return 0, fmt.Errorf("missing number in path")
+	}
+
+	n, err := strconv.Atoi(params[0])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number in path")
+	}
+
+	return n, nil
+}
+
+func floatQuery(query url.Values, key string, fallback float64) (float64, error) {
+	if !query.Has(key) {
+		return fallback, nil
+	}
+
+	value, err := strconv.ParseFloat(query.Get(key), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid %s", key)
+	}
+
+	return value, nil
+}
+
+func rawQuery(r *request.Request) string {
+	_, query, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return query
+}
+
+func args(r *request.Request) map[string]any {
+	values, err := url.ParseQuery(rawQuery(r))
+	if err != nil {
+		return map[string]any{}
+	}
+
+	return flatten(values)
+}
+
+// flatten turns url values into what httpbin returns, a single value as
+// a string and repeated ones as a list
+func flatten(values url.Values) map[string]any {
+	flat := map[string]any{}
+	for key, vals := range values {
+		if len(vals) == 1 {
+			flat[key] = vals[0]
+		} else {
+			flat[key] = vals
+		}
+	}
+
+	return flat
+}
+
+func requestHeaders(r *request.Request) map[string]string {
+	h := map[string]string{}
+	for key, values := range r.Headers {
+		h[headers.CanonicalName(key)] = strings.Join(values, ", ")
+	}
+
+	return h
+}
+
+func origin(r *request.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func requestURL(r *request.Request) string {
+	host, _ := r.Headers.Get("Host")
+	return "http://" + host + r.RequestLine.RequestTarget
+}
+
+func cookies(r *request.Request) map[string]string {
+	c := map[string]string{}
+
+	value, ok := r.Headers.Get("Cookie")
+	if !ok {
+		return c
+	}
+
+	for _, pair := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && name != "" {
+			c[name] = val
+		}
+	}
+
+	return c
+}
+
+// cookieValue percent encodes what isn't a cookie-octet (RFC 6265 section 4.1.1), so a
+// value from the query can't end the field or add attributes of its own
+func cookieValue(value string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '%' || c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+func basicAuth(r *request.Request) (string, string, bool) {
+	authorization, ok := r.Headers.Get("Authorization")
+	if !ok {
+		return "", "", false
+	}
+
+	scheme, encoded, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
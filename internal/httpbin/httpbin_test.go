@@ -0,0 +1,209 @@
+package httpbin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T) string {
+	s, err := server.Serve(0, Handler("/httpbin"))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return fmt.Sprintf("http://127.0.0.1:%d/httpbin", s.Addr().(*net.TCPAddr).Port)
+}
+
+func noRedirects(_ *http.Request, _ []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+func decode(t *testing.T, res *http.Response) map[string]any {
+	defer res.Body.Close()
+
+	body := map[string]any{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	return body
+}
+
+func TestHttpbinEndpoints(t *testing.T) {
+	base := startServer(t)
+
+	// Test: GET with query arguments
+	res, err := http.Get(base + "/get?a=1&b=2&b=3")
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	body := decode(t, res)
+	assert.Equal(t, map[string]any{"a": "1", "b": []any{"2", "3"}}, body["args"])
+	assert.Equal(t, "127.0.0.1", body["origin"])
+
+	// Test: Wrong method
+	res, err = http.Post(base+"/get", "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 405, res.StatusCode)
+	assert.Equal(t, "GET, HEAD", res.Header.Get("Allow"))
+
+	// Test: POST with a json body
+	res, err = http.Post(base+"/post", "application/json", strings.NewReader(`{"hello":"world"}`))
+	require.NoError(t, err)
+	body = decode(t, res)
+	assert.Equal(t, `{"hello":"world"}`, body["data"])
+	assert.Equal(t, map[string]any{"hello": "world"}, body["json"])
+
+	// Test: POST with a form body
+	res, err = http.Post(base+"/post", "application/x-www-form-urlencoded", strings.NewReader("a=1&b=2"))
+	require.NoError(t, err)
+	body = decode(t, res)
+	assert.Equal(t, map[string]any{"a": "1", "b": "2"}, body["form"])
+
+	// Test: Request headers
+	req, err := http.NewRequest("GET", base+"/headers", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Custom-Header", "banger")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body = decode(t, res)
+	assert.Equal(t, "banger", body["headers"].(map[string]any)["X-Custom-Header"])
+
+	// Test: Client ip
+	res, err = http.Get(base + "/ip")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"origin": "127.0.0.1"}, decode(t, res))
+
+	// Test: Arbitrary status code
+	res, err = http.Get(base + "/status/418")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 418, res.StatusCode)
+
+	// Test: No content
+	res, err = http.Get(base + "/status/204")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, "", res.Header.Get("Content-Length"))
+
+	// Test: Invalid status code
+	res, err = http.Get(base + "/status/abc")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 400, res.StatusCode)
+
+	// Test: Delay
+	start := time.Now()
+	res, err = http.Get(base + "/delay/1")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	// Test: Stream of json lines
+	res, err = http.Get(base + "/stream/3")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+
+	// Test: Seeded random bytes
+	res, err = http.Get(base + "/bytes/64?seed=42")
+	require.NoError(t, err)
+	first, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Len(t, first, 64)
+	res, err = http.Get(base + "/bytes/64?seed=42")
+	require.NoError(t, err)
+	second, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, first, second)
+
+	// Test: Drip
+	res, err = http.Get(base + "/drip?duration=0.2&numbytes=4&code=201")
+	require.NoError(t, err)
+	data, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, int64(4), res.ContentLength)
+	assert.Equal(t, "****", string(data))
+
+	// Test: Redirects stay under the prefix
+	client := &http.Client{CheckRedirect: noRedirects}
+	res, err = client.Get(base + "/redirect/2")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 302, res.StatusCode)
+	assert.Equal(t, "/httpbin/redirect/1", res.Header.Get("Location"))
+
+	// Test: Redirects are followed to /get
+	res, err = http.Get(base + "/redirect/3")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "/httpbin/get", res.Request.URL.Path)
+
+	// Test: Setting cookies
+	res, err = client.Get(base + "/cookies/set?a=1&b=2")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 302, res.StatusCode)
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Path=/"}, res.Header.Values("Set-Cookie"))
+
+	// Test: Cookie values can't add cookies or attributes of their own
+	res, err = client.Get(base + "/cookies/set?a=1%0Asession%3Devil%3B%20Domain%3Devil")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 302, res.StatusCode)
+	assert.Equal(t, []string{"a=1%0Asession=evil%3B%20Domain=evil; Path=/"}, res.Header.Values("Set-Cookie"))
+
+	// Test: Invalid cookie name
+	res, err = client.Get(base + "/cookies/set?a%0Ab=1")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 400, res.StatusCode)
+
+	// Test: Reading cookies
+	req, err = http.NewRequest("GET", base+"/cookies", nil)
+	require.NoError(t, err)
+	req.Header.Set("Cookie", "a=1; b=2")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"cookies": map[string]any{"a": "1", "b": "2"}}, decode(t, res))
+
+	// Test: Basic auth
+	req, err = http.NewRequest("GET", base+"/basic-auth/kacpi/secret", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("kacpi", "secret")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"authenticated": true, "user": "kacpi"}, decode(t, res))
+
+	// Test: Basic auth with the wrong password
+	req, err = http.NewRequest("GET", base+"/basic-auth/kacpi/secret", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("kacpi", "wrong")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 401, res.StatusCode)
+	assert.Equal(t, `Basic realm="Fake Realm"`, res.Header.Get("WWW-Authenticate"))
+
+	// Test: Unknown endpoint
+	res, err = http.Get(base + "/nope")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 404, res.StatusCode)
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+)
+
+type Upstream struct {
+	URL *url.URL
+
+	active  atomic.Int64
+	breaker breaker
+	budget  retryBudget
+}
+
+func NewUpstream(rawURL string) (*Upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream url %s: %v", rawURL, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid upstream url %s: scheme must be http or https", rawURL)
+	}
+
+	upstream := &Upstream{URL: u}
+	upstream.breaker.threshold = defaultFailureThreshold
+	upstream.breaker.cooldown = defaultCooldown
+	upstream.budget.tokens = initialRetryTokens
+
+	return upstream, nil
+}
+
+// ActiveRequests is the number of requests currently being proxied to the upstream.
+func (u *Upstream) ActiveRequests() int64 {
+	return u.active.Load()
+}
+
+// Balancer picks the upstream a request is sent to, upstreams that aren't Available are skipped.
+type Balancer interface {
+	Next(r *request.Request) (*Upstream, error)
+	Upstreams() []*Upstream
+}
+
+type RoundRobin struct {
+	upstreams []*Upstream
+	next      atomic.Uint64
+}
+
+func NewRoundRobin(upstreams []*Upstream) *RoundRobin {
+	return &RoundRobin{upstreams: upstreams}
+}
+
+func (b *RoundRobin) Next(_ *request.Request) (*Upstream, error) {
+	for range b.upstreams {
+		n := b.next.Add(1) - 1
+
+		u := b.upstreams[n%uint64(len(b.upstreams))]
+		if u.Available() {
+			return u, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no upstreams available")
+}
+
+func (b *RoundRobin) Upstreams() []*Upstream {
+	return b.upstreams
+}
+
+type LeastConnections struct {
+	upstreams []*Upstream
+}
+
+func NewLeastConnections(upstreams []*Upstream) *LeastConnections {
+	return &LeastConnections{upstreams: upstreams}
+}
+
+// Next picks the upstream with the fewest requests in flight, the first one listed wins a tie.
+func (b *LeastConnections) Next(_ *request.Request) (*Upstream, error) {
+	var best *Upstream
+	for _, u := range b.upstreams {
+		if !u.Available() {
+			continue
+		}
+
+		if best == nil || u.ActiveRequests() < best.ActiveRequests() {
+			best = u
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no upstreams available")
+	}
+
+	return best, nil
+}
+
+func (b *LeastConnections) Upstreams() []*Upstream {
+	return b.upstreams
+}
+
+const virtualNodes = 100
+
+// ConsistentHash sends requests with the same key to the same upstream, and only moves
+// the keys of one upstream around when it's added or removed.
+type ConsistentHash struct {
+	key       func(r *request.Request) string
+	upstreams []*Upstream
+	ring      []uint32
+	owners    map[uint32]*Upstream
+}
+
+// NewConsistentHash hashes requests by key, by the client address when key is nil.
+func NewConsistentHash(upstreams []*Upstream, key func(r *request.Request) string) *ConsistentHash {
+	if key == nil {
+		key = ClientIP
+	}
+
+	b := &ConsistentHash{key: key, upstreams: upstreams, owners: map[uint32]*Upstream{}}
+	for _, u := range upstreams {
+		for i := range virtualNodes {
+			point := crc32.ChecksumIEEE([]byte(u.URL.String() + "#" + strconv.Itoa(i)))
+			b.owners[point] = u
+			b.ring = append(b.ring, point)
+		}
+	}
+	slices.Sort(b.ring)
+
+	return b
+}
+
+func (b *ConsistentHash) Next(r *request.Request) (*Upstream, error) {
+	point := crc32.ChecksumIEEE([]byte(b.key(r)))
+	start, _ := slices.BinarySearch(b.ring, point)
+
+	// the keys of an unavailable upstream go to the next one around the ring,
+	// the same place they'd end up if it was removed
+	for i := range b.ring {
+		u := b.owners[b.ring[(start+i)%len(b.ring)]]
+		if u.Available() {
+			return u, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no upstreams available")
+}
+
+func (b *ConsistentHash) Upstreams() []*Upstream {
+	return b.upstreams
+}
+
+// ClientIP is the address of the client without the port.
+func ClientIP(r *request.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
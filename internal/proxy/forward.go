@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/client"
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+)
+
+// Forward is a forward proxy, clients send it requests with absolute-form targets
+// like http://example.com/path and CONNECT requests for tunnels, mostly to https sites.
+// Only destinations on the allowlist can be reached.
+type Forward struct {
+	allowed     []string
+	username    string
+	password    string
+	dialTimeout time.Duration
+	client      *client.Client
+}
+
+type ForwardOption func(*Forward)
+
+// WithAllowedDestinations sets the destinations the proxy may connect to. An entry is
+// either host:port or just a host for any port, a * host matches every host so *:443
+// allows tunnels to anything on the https port. Without any entries nothing is allowed.
+func WithAllowedDestinations(destinations ...string) ForwardOption {
+	return func(f *Forward) {
+		for _, destination := range destinations {
+			f.allowed = append(f.allowed, strings.ToLower(strings.TrimSpace(destination)))
+		}
+	}
+}
+
+// WithProxyAuth requires clients to send Proxy-Authorization with Basic credentials.
+func WithProxyAuth(username, password string) ForwardOption {
+	return func(f *Forward) {
+		f.username = username
+		f.password = password
+	}
+}
+
+func NewForward(opts ...ForwardOption) *Forward {
+	f := &Forward{dialTimeout: dialTimeout}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	f.client = client.New(
+		client.WithDialTimeout(f.dialTimeout),
+		client.WithResponseHeaderTimeout(defaultTimeout),
+		client.WithMaxRedirects(0),
+	)
+
+	return f
+}
+
+// IsAbsoluteForm reports whether target is a full url, the form clients use for requests
+// meant to go through a forward proxy.
+func IsAbsoluteForm(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+// Handle opens a tunnel for a CONNECT request, any other request with an absolute-form
+// target is sent on to its destination and the response relayed.
+func (f *Forward) Handle(w *response.Writer, r *request.Request) *server.HandlerError {
+	hErr := f.authorize(r)
+	if hErr != nil {
+		return hErr
+	}
+
+	if r.RequestLine.Method == "CONNECT" {
+		return f.tunnel(w, r)
+	}
+
+	target, err := url.Parse(r.RequestLine.RequestTarget)
+	if err != nil || !IsAbsoluteForm(r.RequestLine.RequestTarget) || target.Host == "" {
+		return gatewayError(response.StatusBadRequest, fmt.Errorf("forward proxy requests need an absolute-form target"))
+	}
+
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	if !f.destinationAllowed(target.Hostname(), port) {
+		return gatewayError(response.StatusForbidden, fmt.Errorf("destination not allowed"))
+	}
+
+	body, err := r.ReadBody()
+	if err != nil {
+		return gatewayError(response.StatusBadRequest, err)
+	}
+
+	outReq, err := client.NewRequest(r.RequestLine.Method, target.String(), body)
+	if err != nil {
+		return gatewayError(response.StatusBadRequest, err)
+	}
+	outReq.SetContext(r.Context())
+
+	for key, values := range endToEnd(r.Headers) {
+		if strings.EqualFold(key, "host") || strings.EqualFold(key, "content-length") {
+			continue
+		}
+
+		outReq.Headers[key] = values
+	}
+
+	res, err := f.client.Do(outReq)
+	if err != nil && errors.Is(r.Context().Err(), context.Canceled) {
+		// the client went away, nobody's left to answer
+		return nil
+	}
+
+	if err != nil {
+		return destinationError(err)
+	}
+	defer res.Body.Close()
+
+	return relay(w, res)
+}
+
+// tunnel connects to the destination a CONNECT request asks for, answers with a 200
+// and relays bytes both ways until both sides are done
+func (f *Forward) tunnel(w *response.Writer, r *request.Request) *server.HandlerError {
+	host, port, err := net.SplitHostPort(r.RequestLine.RequestTarget)
+	if err != nil || host == "" || port == "" {
+		return gatewayError(response.StatusBadRequest, fmt.Errorf("connect target must be host:port"))
+	}
+
+	if !f.destinationAllowed(host, port) {
+		return gatewayError(response.StatusForbidden, fmt.Errorf("destination not allowed"))
+	}
+
+	dialer := &net.Dialer{Timeout: f.dialTimeout}
+	dst, err := dialer.DialContext(r.Context(), "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return destinationError(err)
+	}
+	defer dst.Close()
+
+	conn, reader, err := w.Hijack()
+	if err != nil {
+		return gatewayError(response.StatusInternalServerError, err)
+	}
+	defer conn.Close()
+
+	// a 2xx to CONNECT has no body and so no framing, there's nothing for the writer to add
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err != nil {
+		return nil
+	}
+
+	done := make(chan struct{}, 2)
+	splice := func(to net.Conn, from io.Reader) {
+		io.Copy(to, from)
+		closeWrite(to)
+		done <- struct{}{}
+	}
+
+	// the reader holds anything the client sent without waiting for the 200
+	go splice(dst, reader)
+	go splice(conn, dst)
+	<-done
+	<-done
+
+	return nil
+}
+
+// closeWrite passes an end of stream from one side of a tunnel on to the other,
+// while the opposite direction can keep going. The server's wrappers around the client's
+// connection pass CloseWrite on, a connection that can't be half closed is closed.
+func closeWrite(conn net.Conn) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok && halfCloser.CloseWrite() == nil {
+		return
+	}
+
+	conn.Close()
+}
+
+func (f *Forward) authorize(r *request.Request) *server.HandlerError {
+	if f.username == "" && f.password == "" {
+		return nil
+	}
+
+	username, password, ok := proxyBasicAuth(r)
+	if ok &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(f.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(f.password)) == 1 {
+		return nil
+	}
+
+	errorHeaders := headers.NewHeaders()
+	errorHeaders.Set("Content-Type", "text/plain")
+	errorHeaders.Set("Proxy-Authenticate", `Basic realm="httpfromtcp"`)
+
+	return &server.HandlerError{
+		StatusCode: response.StatusProxyAuthenticationRequired,
+		Headers:    errorHeaders,
+		Body:       []byte("proxy authentication required"),
+	}
+}
+
+func (f *Forward) destinationAllowed(host, port string) bool {
+	host = strings.ToLower(host)
+
+	return slices.ContainsFunc(f.allowed, func(entry string) bool {
+		allowedHost, allowedPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			allowedHost, allowedPort = entry, ""
+		}
+
+		return (allowedHost == "*" || allowedHost == host) && (allowedPort == "" || allowedPort == port)
+	})
+}
+
+func proxyBasicAuth(r *request.Request) (string, string, bool) {
+	authorization, ok := r.Headers.Get("Proxy-Authorization")
+	if !ok {
+		return "", "", false
+	}
+
+	scheme, encoded, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+func destinationError(err error) *server.HandlerError {
+	if isTimeout(err) {
+		return gatewayError(response.StatusGatewayTimeout, fmt.Errorf("destination timed out"))
+	}
+
+	return gatewayError(response.StatusBadGateway, fmt.Errorf("destination unreachable"))
+}
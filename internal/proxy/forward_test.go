@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startForward(t *testing.T, opts ...ForwardOption) *url.URL {
+	f := NewForward(opts...)
+
+	s, err := server.Serve(0, f.Handle)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	proxyURL, err := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	return proxyURL
+}
+
+func proxiedClient(proxyURL *url.URL) *http.Client {
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+func TestForwardProxy(t *testing.T) {
+	destination := startServer(t, namedHandler("destination"))
+
+	// Test: Absolute-form requests are forwarded
+	proxyURL := startForward(t, WithAllowedDestinations("127.0.0.1"))
+	res, err := proxiedClient(proxyURL).Get(destination + "/")
+	require.NoError(t, err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "destination", string(data))
+
+	// Test: Destinations off the allowlist
+	proxyURL = startForward(t, WithAllowedDestinations("example.com", "127.0.0.1:1"))
+	res, err = proxiedClient(proxyURL).Get(destination + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 403, res.StatusCode)
+
+	// Test: Origin-form requests
+	res, err = http.Get(proxyURL.String() + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 400, res.StatusCode)
+
+	// Test: Missing proxy credentials
+	proxyURL = startForward(t, WithAllowedDestinations("127.0.0.1"), WithProxyAuth("kacpi", "secret"))
+	res, err = proxiedClient(proxyURL).Get(destination + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 407, res.StatusCode)
+	assert.Equal(t, `Basic realm="httpfromtcp"`, res.Header.Get("Proxy-Authenticate"))
+
+	// Test: Wrong proxy credentials
+	proxyURL.User = url.UserPassword("kacpi", "wrong")
+	res, err = proxiedClient(proxyURL).Get(destination + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 407, res.StatusCode)
+
+	// Test: Right proxy credentials
+	proxyURL.User = url.UserPassword("kacpi", "secret")
+	res, err = proxiedClient(proxyURL).Get(destination + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+func TestConnectTunnel(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("over tls"))
+	}))
+	defer tlsServer.Close()
+
+	// Test: https goes through a tunnel
+	proxyURL := startForward(t, WithAllowedDestinations("127.0.0.1"))
+	transport := tlsServer.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	res, err := (&http.Client{Transport: transport}).Get(tlsServer.URL)
+	require.NoError(t, err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "over tls", string(data))
+
+	// Test: The 200 has no framing and bytes sent along with the CONNECT make it through
+	destination := strings.TrimPrefix(startServer(t, namedHandler("raw")), "http://")
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nGET / HTTP/1.1\r\nHost: %s\r\n\r\n", destination, destination, destination)
+
+	reader := bufio.NewReader(conn)
+	connectRes, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	assert.Equal(t, 200, connectRes.StatusCode)
+	assert.Empty(t, connectRes.Header.Get("Content-Length"))
+	assert.Empty(t, connectRes.Header.Get("Transfer-Encoding"))
+
+	tunneledRes, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	data, err = io.ReadAll(tunneledRes.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "raw", string(data))
+
+	// Test: Tunnels off the allowlist
+	proxyURL = startForward(t, WithAllowedDestinations("*:443"))
+	conn, err = net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destination, destination)
+	connectRes, err = http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	assert.Equal(t, 403, connectRes.StatusCode)
+}
+
+func TestConnectTunnelHalfClose(t *testing.T) {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer origin.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := origin.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("hello"))
+		conn.(*net.TCPConn).CloseWrite()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	proxyURL := startForward(t, WithAllowedDestinations("127.0.0.1"))
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	destination := origin.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destination, destination)
+
+	reader := bufio.NewReader(conn)
+	connectRes, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	assert.Equal(t, 200, connectRes.StatusCode)
+
+	// Test: The origin closing its side first leaves the client's side open
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	_, err = conn.Write([]byte("late data"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	assert.Equal(t, "late data", <-received)
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/client"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+const defaultFailureThreshold = 5
+const defaultCooldown = 10 * time.Second
+
+// breaker is the circuit breaker of a single upstream. It opens after threshold failures
+// in a row and stops requests from going there, once cooldown passes a single trial
+// request is let through and its outcome decides whether the circuit closes or opens again.
+type breaker struct {
+	mu        sync.Mutex
+	state     circuitState
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	threshold int
+	cooldown  time.Duration
+}
+
+func (b *breaker) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		return now.Sub(b.openedAt) >= b.cooldown
+	case circuitHalfOpen:
+		return !b.trial
+	default:
+		return true
+	}
+}
+
+// acquire claims the upstream for a request, for an open circuit past its cooldown
+// that request is the trial one
+func (b *breaker) acquire(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+
+		b.state = circuitHalfOpen
+		b.trial = true
+		return true
+	case circuitHalfOpen:
+		if b.trial {
+			return false
+		}
+
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = circuitClosed
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *breaker) failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.openedAt = now
+	}
+}
+
+const retryRatio = 0.2
+const maxRetryTokens = 10
+const initialRetryTokens = 3
+
+// retryBudget keeps retries to a fraction of the requests an upstream gets, every request
+// adds retryRatio of a token and every retry takes a whole one. Without it a struggling
+// upstream gets buried under retries exactly when it can least afford them.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.tokens+retryRatio, maxRetryTokens)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Available reports whether the upstream can be sent a request right now.
+func (u *Upstream) Available() bool {
+	return u.breaker.available(time.Now())
+}
+
+// State is the state of the upstream's circuit breaker: closed, open or half-open.
+func (u *Upstream) State() string {
+	u.breaker.mu.Lock()
+	defer u.breaker.mu.Unlock()
+
+	return u.breaker.state.String()
+}
+
+func (u *Upstream) ReportSuccess() {
+	u.breaker.success()
+}
+
+func (u *Upstream) ReportFailure() {
+	u.breaker.failure(time.Now())
+}
+
+type HealthCheck struct {
+	// Path is requested on every upstream, anything but a 2xx or 3xx response counts as a failure.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+type healthChecker struct {
+	check     HealthCheck
+	upstreams []*Upstream
+	client    *client.Client
+	stop      chan struct{}
+	done      sync.WaitGroup
+}
+
+func startHealthChecker(check HealthCheck, upstreams []*Upstream) *healthChecker {
+	if check.Interval <= 0 {
+		check.Interval = 10 * time.Second
+	}
+
+	if check.Timeout <= 0 {
+		check.Timeout = 2 * time.Second
+	}
+
+	hc := &healthChecker{
+		check:     check,
+		upstreams: upstreams,
+		client:    client.New(client.WithDialTimeout(check.Timeout)),
+		stop:      make(chan struct{}),
+	}
+
+	hc.done.Add(1)
+	go hc.run()
+
+	return hc
+}
+
+func (hc *healthChecker) run() {
+	defer hc.done.Done()
+
+	ticker := time.NewTicker(hc.check.Interval)
+	defer ticker.Stop()
+
+	for {
+		hc.probeAll()
+
+		select {
+		case <-hc.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *healthChecker) probeAll() {
+	var wg sync.WaitGroup
+	for _, u := range hc.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc.probe(u)
+		}()
+	}
+	wg.Wait()
+}
+
+func (hc *healthChecker) probe(u *Upstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.check.Timeout)
+	defer cancel()
+
+	target := strings.TrimSuffix(u.URL.String(), "/") + "/" + strings.TrimPrefix(hc.check.Path, "/")
+	req, err := client.NewRequest("GET", target, nil)
+	if err != nil {
+		u.ReportFailure()
+		return
+	}
+	req.SetContext(ctx)
+
+	res, err := hc.client.Do(req)
+	if err != nil {
+		u.ReportFailure()
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusLine.StatusCode >= 400 {
+		u.ReportFailure()
+		return
+	}
+
+	u.ReportSuccess()
+}
+
+func (hc *healthChecker) close() {
+	close(hc.stop)
+	hc.done.Wait()
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := &breaker{threshold: 2, cooldown: time.Second}
+
+	// Test: Stays closed below the threshold
+	b.failure(now)
+	assert.Equal(t, circuitClosed, b.state)
+	assert.True(t, b.available(now))
+
+	// Test: A success resets the count
+	b.success()
+	b.failure(now)
+	assert.Equal(t, circuitClosed, b.state)
+
+	// Test: Opens at the threshold
+	b.failure(now)
+	assert.Equal(t, circuitOpen, b.state)
+	assert.False(t, b.available(now))
+	assert.False(t, b.acquire(now))
+
+	// Test: A single trial request after the cooldown
+	later := now.Add(time.Second)
+	assert.True(t, b.available(later))
+	assert.True(t, b.acquire(later))
+	assert.Equal(t, circuitHalfOpen, b.state)
+	assert.False(t, b.acquire(later))
+
+	// Test: A failed trial opens it again
+	b.failure(later)
+	assert.Equal(t, circuitOpen, b.state)
+	assert.False(t, b.available(later))
+
+	// Test: A successful trial closes it
+	evenLater := later.Add(time.Second)
+	assert.True(t, b.acquire(evenLater))
+	b.success()
+	assert.Equal(t, circuitClosed, b.state)
+	assert.True(t, b.available(evenLater))
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{tokens: 1}
+
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+
+	for range 5 {
+		b.deposit()
+	}
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+}
+
+func TestBalancersSkipUnavailable(t *testing.T) {
+	a := mustUpstream(t, "http://a.local")
+	b := mustUpstream(t, "http://b.local")
+	for range defaultFailureThreshold {
+		a.ReportFailure()
+	}
+	assert.Equal(t, "open", a.State())
+
+	for _, balancer := range []Balancer{
+		NewRoundRobin([]*Upstream{a, b}),
+		NewLeastConnections([]*Upstream{a, b}),
+		NewConsistentHash([]*Upstream{a, b}, nil),
+	} {
+		for range 3 {
+			u, err := balancer.Next(&request.Request{})
+			require.NoError(t, err)
+			assert.Equal(t, b, u)
+		}
+	}
+
+	for range defaultFailureThreshold {
+		b.ReportFailure()
+	}
+	_, err := NewRoundRobin([]*Upstream{a, b}).Next(nil)
+	require.Error(t, err)
+}
+
+func get(t *testing.T, url string) (int, string) {
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, string(data)
+}
+
+func TestProxyFailures(t *testing.T) {
+	down := mustUpstream(t, "http://127.0.0.1:1")
+	up := mustUpstream(t, startServer(t, namedHandler("up")))
+
+	// Test: Idempotent requests are retried on another upstream
+	base := startServer(t, New(NewRoundRobin([]*Upstream{down, up})).Handle)
+	status, body := get(t, base+"/")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "up", body)
+
+	// Test: Non idempotent requests aren't
+	res, err := http.Post(base+"/", "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 502, res.StatusCode)
+	assert.Equal(t, "upstream unreachable", string(data))
+
+	// Test: No healthy upstreams
+	dead := mustUpstream(t, "http://127.0.0.1:1")
+	base = startServer(t, New(NewRoundRobin([]*Upstream{dead}), WithCircuitBreaker(1, time.Minute)).Handle)
+	status, _ = get(t, base+"/")
+	assert.Equal(t, 502, status)
+	assert.Equal(t, "open", dead.State())
+	status, body = get(t, base+"/")
+	assert.Equal(t, 503, status)
+	assert.Equal(t, "no healthy upstreams available", body)
+
+	// Test: Slow upstream
+	slow := mustUpstream(t, startServer(t, func(w *response.Writer, _ *request.Request) *server.HandlerError {
+		time.Sleep(500 * time.Millisecond)
+		return namedHandler("slow")(w, nil)
+	}))
+	base = startServer(t, New(NewRoundRobin([]*Upstream{slow}), WithTimeout(50*time.Millisecond), WithRetries(0)).Handle)
+	status, body = get(t, base+"/")
+	assert.Equal(t, 504, status)
+	assert.Equal(t, "upstream timed out", body)
+}
+
+func TestHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	upstream := mustUpstream(t, startServer(t, func(w *response.Writer, r *request.Request) *server.HandlerError {
+		if r.RequestLine.RequestTarget == "/health" && !healthy.Load() {
+			w.WriteStatusLine(response.StatusServiceUnavailable)
+			w.WriteHeaders(headers.NewHeaders())
+			return nil
+		}
+
+		return namedHandler("ok")(w, r)
+	}))
+
+	p := New(
+		NewRoundRobin([]*Upstream{upstream}),
+		WithCircuitBreaker(1, time.Hour),
+		WithHealthCheck(HealthCheck{Path: "/health", Interval: 10 * time.Millisecond}),
+	)
+	defer p.Close()
+
+	// Test: Failing probes eject the upstream
+	assert.Eventually(t, func() bool { return upstream.State() == "open" }, time.Second, 5*time.Millisecond)
+
+	// Test: A passing probe brings it back before the cooldown is over
+	healthy.Store(true)
+	assert.Eventually(t, func() bool { return upstream.State() == "closed" }, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,412 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/client"
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+)
+
+// hopByHopHeaders only mean something for a single connection and aren't forwarded,
+// neither are the ones listed in the Connection header
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"proxy-connection",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// idempotentMethods can be sent again when the upstream fails without a response,
+// retrying anything else could apply the request twice
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+const defaultRetries = 2
+const defaultTimeout = 30 * time.Second
+const dialTimeout = 5 * time.Second
+
+type Proxy struct {
+	balancer    Balancer
+	stripPrefix string
+	client      *client.Client
+	timeout     time.Duration
+	retries     int
+	healthCheck *HealthCheck
+	checker     *healthChecker
+}
+
+type Option func(*Proxy)
+
+// WithStripPrefix removes prefix from the request path before it's sent upstream.
+func WithStripPrefix(prefix string) Option {
+	return func(p *Proxy) {
+		p.stripPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+func WithClient(c *client.Client) Option {
+	return func(p *Proxy) {
+		p.client = c
+	}
+}
+
+// WithTimeout limits how long an upstream has to start responding, past it the client gets a 504.
+// It's ignored when the client is set with WithClient.
+func WithTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times a failed idempotent request is sent again, as long as
+// the upstream's retry budget allows it.
+func WithRetries(retries int) Option {
+	return func(p *Proxy) {
+		p.retries = retries
+	}
+}
+
+// WithCircuitBreaker sets after how many failures in a row an upstream is ejected
+// and how long it stays out before a trial request is let through.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(p *Proxy) {
+		for _, u := range p.balancer.Upstreams() {
+			u.breaker.mu.Lock()
+			u.breaker.threshold = threshold
+			u.breaker.cooldown = cooldown
+			u.breaker.mu.Unlock()
+		}
+	}
+}
+
+// WithHealthCheck probes every upstream in the background, see HealthCheck.
+// The probes run until the proxy is closed.
+func WithHealthCheck(check HealthCheck) Option {
+	return func(p *Proxy) {
+		p.healthCheck = &check
+	}
+}
+
+func New(balancer Balancer, opts ...Option) *Proxy {
+	p := &Proxy{
+		balancer: balancer,
+		timeout:  defaultTimeout,
+		retries:  defaultRetries,
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.client == nil {
+		// redirects are the client's business, they're relayed as they are
+		p.client = client.New(
+			client.WithDialTimeout(dialTimeout),
+			client.WithResponseHeaderTimeout(p.timeout),
+			client.WithMaxRedirects(0),
+		)
+	}
+
+	if p.healthCheck != nil {
+		p.checker = startHealthChecker(*p.healthCheck, balancer.Upstreams())
+	}
+
+	return p
+}
+
+// Close stops the health checks, if there are any.
+func (p *Proxy) Close() {
+	if p.checker != nil {
+		p.checker.close()
+	}
+}
+
+// Handle forwards the request to the upstream picked by the balancer and relays the response.
+func (p *Proxy) Handle(w *response.Writer, r *request.Request) *server.HandlerError {
+	body, err := r.ReadBody()
+	if err != nil {
+		return gatewayError(response.StatusBadRequest, err)
+	}
+
+	tried := []*Upstream{}
+	var lastErr error
+
+	for attempt := 0; attempt <= p.retries; attempt++ {
+		upstream, err := p.pick(r, tried)
+		if err != nil {
+			break
+		}
+
+		tried = append(tried, upstream)
+		if attempt == 0 {
+			upstream.budget.deposit()
+		}
+
+		res, err := p.roundTrip(upstream, r, body)
+		if err != nil && errors.Is(r.Context().Err(), context.Canceled) {
+			// the client went away, that's not the upstream's fault and nobody's left to answer
+			return nil
+		}
+
+		if err != nil {
+			upstream.ReportFailure()
+			lastErr = err
+
+			if !slices.Contains(idempotentMethods, r.RequestLine.Method) || !upstream.budget.withdraw() {
+				break
+			}
+
+			continue
+		}
+		defer res.Body.Close()
+
+		switch res.StatusLine.StatusCode {
+		case 502, 503, 504:
+			upstream.ReportFailure()
+		default:
+			upstream.ReportSuccess()
+		}
+
+		return relay(w, res)
+	}
+
+	if lastErr == nil {
+		return gatewayError(response.StatusServiceUnavailable, fmt.Errorf("no healthy upstreams available"))
+	}
+
+	if isTimeout(lastErr) {
+		return gatewayError(response.StatusGatewayTimeout, fmt.Errorf("upstream timed out"))
+	}
+
+	return gatewayError(response.StatusBadGateway, fmt.Errorf("upstream unreachable"))
+}
+
+// pick asks the balancer for an upstream, preferring one the request wasn't sent to yet
+func (p *Proxy) pick(r *request.Request, tried []*Upstream) (*Upstream, error) {
+	now := time.Now()
+
+	var fallback *Upstream
+	for range p.balancer.Upstreams() {
+		upstream, err := p.balancer.Next(r)
+		if err != nil {
+			break
+		}
+
+		if slices.Contains(tried, upstream) {
+			fallback = upstream
+			continue
+		}
+
+		if upstream.breaker.acquire(now) {
+			return upstream, nil
+		}
+	}
+
+	if fallback != nil && fallback.breaker.acquire(now) {
+		return fallback, nil
+	}
+
+	return nil, fmt.Errorf("no upstreams available")
+}
+
+func (p *Proxy) roundTrip(upstream *Upstream, r *request.Request, body []byte) (*response.Response, error) {
+	upstream.active.Add(1)
+	defer upstream.active.Add(-1)
+
+	outReq, err := p.outboundRequest(upstream, r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.client.Do(outReq)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+func (p *Proxy) outboundRequest(upstream *Upstream, r *request.Request, body []byte) (*request.Request, error) {
+	path := strings.TrimPrefix(r.RequestLine.RequestTarget, p.stripPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	target := strings.TrimSuffix(upstream.URL.String(), "/") + path
+	outReq, err := client.NewRequest(r.RequestLine.Method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	outReq.SetContext(r.Context())
+
+	for key, values := range endToEnd(r.Headers) {
+		if strings.EqualFold(key, "host") || strings.EqualFold(key, "content-length") {
+			continue
+		}
+
+		outReq.Headers[key] = values
+	}
+
+	addForwardedHeaders(outReq.Headers, r)
+
+	return outReq, nil
+}
+
+// addForwardedHeaders tells the upstream who the request came from, both with the
+// standard Forwarded header (RFC 7239) and the X-Forwarded-* ones most servers still read
+func addForwardedHeaders(h headers.Headers, r *request.Request) {
+	clientIP := ClientIP(r)
+	host, _ := r.Headers.Get("Host")
+
+	forwardedFor := clientIP
+	if strings.Contains(clientIP, ":") {
+		forwardedFor = fmt.Sprintf(`"[%s]"`, clientIP)
+	}
+
+	forwarded := fmt.Sprintf("for=%s;proto=http", forwardedFor)
+	if host != "" {
+		forwarded += fmt.Sprintf(`;host="%s"`, host)
+	}
+
+	if prior, ok := r.Headers.Get("Forwarded"); ok {
+		forwarded = prior + ", " + forwarded
+	}
+	replaceHeader(h, "Forwarded", forwarded)
+
+	xForwardedFor := clientIP
+	if prior, ok := r.Headers.Get("X-Forwarded-For"); ok {
+		xForwardedFor = prior + ", " + clientIP
+	}
+	replaceHeader(h, "X-Forwarded-For", xForwardedFor)
+	replaceHeader(h, "X-Forwarded-Proto", "http")
+	if host != "" {
+		replaceHeader(h, "X-Forwarded-Host", host)
+	}
+}
+
+// replaceHeader sets key whatever case the copied headers have it in
+func replaceHeader(h headers.Headers, key, value string) {
+	h.Delete(key)
+	h.Set(key, value)
+}
+
+func relay(w *response.Writer, res *response.Response) *server.HandlerError {
+	err := w.WriteStatusLine(res.StatusLine.StatusCode)
+	if err != nil {
+		return gatewayError(response.StatusBadGateway, err)
+	}
+
+	resHeaders := headers.NewHeaders()
+	connectionHeaders := hopByHopFromConnection(res.Headers.Values("Connection"))
+	for key, values := range res.Headers {
+		if isHopByHop(key, connectionHeaders) {
+			continue
+		}
+
+		resHeaders[key] = values
+	}
+
+	err = w.WriteHeaders(resHeaders)
+	if err != nil {
+		return gatewayError(response.StatusBadGateway, err)
+	}
+
+	// trailers the upstream announced are passed on once the body is done
+	for _, value := range res.Headers.Values("Trailer") {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				w.DeclareTrailer(key)
+			}
+		}
+	}
+
+	buff := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buff)
+
+		if n > 0 {
+			_, writeErr := w.WriteBody(buff[:n])
+			if writeErr == nil {
+				writeErr = w.Flush()
+			}
+
+			// the client went away, nobody's left to tell
+			if writeErr != nil {
+				return nil
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return gatewayError(response.StatusBadGateway, err)
+		}
+	}
+
+	for key, values := range res.Trailers {
+		w.SetTrailer(key, strings.Join(values, ", "))
+	}
+
+	return nil
+}
+
+// endToEnd returns the headers that are meant for the final recipient of the message.
+func endToEnd(h headers.Headers) headers.Headers {
+	connectionHeaders := hopByHopFromConnection(h.Values("Connection"))
+
+	filtered := headers.NewHeaders()
+	for key, values := range h {
+		if !isHopByHop(key, connectionHeaders) {
+			filtered[key] = slices.Clone(values)
+		}
+	}
+
+	return filtered
+}
+
+func hopByHopFromConnection(values []string) []string {
+	names := []string{}
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			names = append(names, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+
+	return names
+}
+
+func isHopByHop(key string, connectionHeaders []string) bool {
+	key = strings.ToLower(key)
+	return slices.Contains(hopByHopHeaders, key) || slices.Contains(connectionHeaders, key)
+}
+
+func gatewayError(statusCode response.StatusCode, err error) *server.HandlerError {
+	errorHeaders := headers.NewHeaders()
+	errorHeaders.Set("Content-Type", "text/plain")
+
+	return &server.HandlerError{
+		StatusCode: statusCode,
+		Headers:    errorHeaders,
+		Body:       []byte(err.Error()),
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/httpbin"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+func namedHandler(name string) server.Handler {
+	return func(w *response.Writer, _ *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte(name))
+		return nil
+	}
+}
+
+func mustUpstream(t *testing.T, rawURL string) *Upstream {
+	u, err := NewUpstream(rawURL)
+	require.NoError(t, err)
+	return u
+}
+
+func TestProxyForwarding(t *testing.T) {
+	upstream := mustUpstream(t, startServer(t, httpbin.Handler("")))
+	p := New(NewRoundRobin([]*Upstream{upstream}), WithStripPrefix("/api"))
+	base := startServer(t, p.Handle)
+
+	// Test: Method, body and end to end headers are forwarded
+	req, err := http.NewRequest("POST", base+"/api/post?a=1", strings.NewReader(`{"hello":"world"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Custom-Header", "banger")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "secret")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	body := map[string]any{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	assert.Equal(t, `{"hello":"world"}`, body["data"])
+	assert.Equal(t, map[string]any{"a": "1"}, body["args"])
+
+	forwardedHeaders := body["headers"].(map[string]any)
+	assert.Equal(t, "banger", forwardedHeaders["X-Custom-Header"])
+	assert.Nil(t, forwardedHeaders["X-Hop"])
+	assert.Equal(t, "127.0.0.1", forwardedHeaders["X-Forwarded-For"])
+	assert.Equal(t, "http", forwardedHeaders["X-Forwarded-Proto"])
+	assert.Equal(t, strings.TrimPrefix(base, "http://"), forwardedHeaders["X-Forwarded-Host"])
+	assert.Equal(t, fmt.Sprintf(`for=127.0.0.1;proto=http;host="%s"`, strings.TrimPrefix(base, "http://")), forwardedHeaders["Forwarded"])
+
+	// Test: Prior X-Forwarded-For is kept
+	req, err = http.NewRequest("GET", base+"/api/headers", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body = map[string]any{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	assert.Equal(t, "10.0.0.1, 127.0.0.1", body["headers"].(map[string]any)["X-Forwarded-For"])
+
+	// Test: Upstream status and headers are relayed
+	client := &http.Client{CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err = client.Get(base + "/api/cookies/set?a=1&b=2")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 302, res.StatusCode)
+	assert.Equal(t, "/cookies", res.Header.Get("Location"))
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Path=/"}, res.Header.Values("Set-Cookie"))
+
+	res, err = http.Get(base + "/api/status/418")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 418, res.StatusCode)
+
+	// Test: Unreachable upstream
+	p = New(NewRoundRobin([]*Upstream{mustUpstream(t, "http://127.0.0.1:1")}))
+	base = startServer(t, p.Handle)
+	res, err = http.Get(base + "/get")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 502, res.StatusCode)
+}
+
+func TestProxyBalancing(t *testing.T) {
+	a := mustUpstream(t, startServer(t, namedHandler("a")))
+	b := mustUpstream(t, startServer(t, namedHandler("b")))
+	c := mustUpstream(t, startServer(t, namedHandler("c")))
+
+	get := func(base string) string {
+		res, err := http.Get(base + "/")
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		data, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	// Test: Round robin
+	base := startServer(t, New(NewRoundRobin([]*Upstream{a, b, c})).Handle)
+	seen := []string{}
+	for range 6 {
+		seen = append(seen, get(base))
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, seen)
+
+	// Test: Consistent hashing sends a client to the same upstream
+	base = startServer(t, New(NewConsistentHash([]*Upstream{a, b, c}, nil)).Handle)
+	first := get(base)
+	for range 5 {
+		assert.Equal(t, first, get(base))
+	}
+}
+
+func TestBalancers(t *testing.T) {
+	a := mustUpstream(t, "http://a.local")
+	b := mustUpstream(t, "http://b.local")
+	c := mustUpstream(t, "http://c.local")
+
+	// Test: Least connections picks the least busy upstream
+	balancer := NewLeastConnections([]*Upstream{a, b, c})
+	a.active.Add(2)
+	b.active.Add(1)
+	c.active.Add(3)
+	u, err := balancer.Next(nil)
+	require.NoError(t, err)
+	assert.Equal(t, b, u)
+
+	// Test: Least connections tie goes to the first one
+	b.active.Add(1)
+	u, err = balancer.Next(nil)
+	require.NoError(t, err)
+	assert.Equal(t, a, u)
+
+	// Test: Consistent hashing only moves the keys of a removed upstream
+	key := func(r *request.Request) string { return r.RequestLine.RequestTarget }
+	all := NewConsistentHash([]*Upstream{a, b, c}, key)
+	withoutC := NewConsistentHash([]*Upstream{a, b}, key)
+	moved := 0
+	for i := range 1000 {
+		r := &request.Request{RequestLine: request.RequestLine{RequestTarget: fmt.Sprintf("/%d", i)}}
+		before, err := all.Next(r)
+		require.NoError(t, err)
+		after, err := withoutC.Next(r)
+		require.NoError(t, err)
+
+		if before != c {
+			assert.Equal(t, before, after)
+		}
+		if before != after {
+			moved++
+		}
+	}
+	assert.Greater(t, moved, 0)
+
+	// Test: No upstreams
+	_, err = NewRoundRobin(nil).Next(nil)
+	require.Error(t, err)
+	assert.Equal(t, "no upstreams available", err.Error())
+
+	// Test: Invalid upstream url
+	_, err = NewUpstream("ftp://files.local")
+	require.Error(t, err)
+}
@@ -2,13 +2,14 @@ package request
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
 	"unicode"
 
+	"github.com/magicznykacpur/httpfromtcp/internal/framing"
 	"github.com/magicznykacpur/httpfromtcp/internal/headers"
 )
 
@@ -21,6 +22,9 @@ const (
 	requestStateInitialized requestState = iota
 	requestStateParsingHeaders
 	requestStateParsingBody
+	requestStateParsingChunkSize
+	requestStateParsingChunkData
+	requestStateParsingTrailers
 	requestStateDone
 )
 
@@ -28,7 +32,37 @@ type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
-	state       requestState
+	Trailers    headers.Headers
+	// RemoteAddr is the address of the client, set by the server that read the request.
+	RemoteAddr string
+	// LocalAddr is the address the request came in on, set by the server that read the request.
+	LocalAddr string
+	state     requestState
+	ctx       context.Context
+
+	contentLength  int
+	chunkRemaining int
+
+	reader         io.Reader
+	buf            []byte
+	readToIndex    int
+	parsed         int
+	beforeBodyRead func() error
+}
+
+// ParseError is returned when the bytes of a request don't make a valid one, Offset is
+// where in the stream the line or the part of the body that didn't parse starts.
+type ParseError struct {
+	Offset int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
 }
 
 type RequestLine struct {
@@ -37,13 +71,13 @@ type RequestLine struct {
 	Method        string
 }
 
-func (r *Request) parse(data []byte) (int, error) {
+func (r *Request) parse(data []byte, until requestState) (int, error) {
 	totalBytesParsed := 0
 
-	for r.state != requestStateDone {
+	for r.state < until {
 		numBytesParsed, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
-			return 0, err
+			return totalBytesParsed, err
 		}
 
 		if numBytesParsed == 0 {
@@ -80,38 +114,82 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, err
 		}
 
+		// other fields can be empty, a request has to name the host it's for
+		if host, ok := r.Headers.Get("Host"); ok && host == "" {
+			return 0, fmt.Errorf("invalid header format")
+		}
+
 		if parsedBytes == 0 && !done {
 			return 0, nil
 		}
 
 		if done {
-			r.state = requestStateParsingBody
+			err = r.selectBodyFraming()
+			if err != nil {
+				return 0, err
+			}
 		}
 
 		return parsedBytes, nil
 	case requestStateParsingBody:
-		val, ok := r.Headers.Get("content-length")
-		if !ok {
+		// anything past the content length is the start of whatever the client sends next
+		n := min(len(data), r.contentLength-len(r.Body))
+		r.Body = append(r.Body, data[:n]...)
+
+		if len(r.Body) == r.contentLength {
 			r.state = requestStateDone
-			return 0, nil
 		}
 
-		r.Body = append(r.Body, data...)
+		return n, nil
+	case requestStateParsingChunkSize:
+		idx := bytes.Index(data, []byte(crlf))
+		if idx == -1 {
+			return 0, nil
+		}
 
-		contentLenght, err := strconv.Atoi(val)
+		size, err := framing.ChunkSize(string(data[:idx]))
 		if err != nil {
-			return 0, fmt.Errorf("couldnt convert content length to int")
+			return 0, err
 		}
 
-		if len(r.Body) > contentLenght {
-			return 0, fmt.Errorf("to much content provided")
+		if size == 0 {
+			r.state = requestStateParsingTrailers
+		} else {
+			r.chunkRemaining = size
+			r.state = requestStateParsingChunkData
 		}
 
-		if len(r.Body) == contentLenght {
+		return idx + 2, nil
+	case requestStateParsingChunkData:
+		if r.chunkRemaining > 0 {
+			n := min(len(data), r.chunkRemaining)
+			r.Body = append(r.Body, data[:n]...)
+			r.chunkRemaining -= n
+
+			return n, nil
+		}
+
+		if len(data) < 2 {
+			return 0, nil
+		}
+
+		if string(data[:2]) != crlf {
+			return 0, fmt.Errorf("invalid chunk terminator")
+		}
+
+		r.state = requestStateParsingChunkSize
+		return 2, nil
+	case requestStateParsingTrailers:
+		parsedBytes, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+
+		if done {
 			r.state = requestStateDone
 		}
 
-		return len(data), nil
+		return parsedBytes, nil
 	case requestStateDone:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
 	default:
@@ -120,50 +198,205 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
-	request := Request{Headers: headers.NewHeaders(), state: requestStateInitialized}
+	request, err := HeadFromReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = request.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// HeadFromReader parses the request line and the headers and leaves the body on the reader,
+// it's read by ReadBody once something actually needs it.
+func HeadFromReader(reader io.Reader) (*Request, error) {
+	request := &Request{
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		state:    requestStateInitialized,
+		reader:   reader,
+		buf:      make([]byte, bufferSize),
+	}
+
+	err := request.readUntil(requestStateParsingBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// Context is cancelled once the request is over for the server, when the client went away,
+// the server shut down or the request ran out of time. It's never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// SetContext replaces the request's context, the server sets it before the handler runs.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// BeforeBodyRead registers fn to be called once, right before the body is first read
+// from the connection. It's how the server answers Expect: 100-continue.
+func (r *Request) BeforeBodyRead(fn func() error) {
+	r.beforeBodyRead = fn
+}
 
-	for request.state != requestStateDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+// ReadBody reads the rest of the request and returns the body, it's safe to call more
+// than once and for requests that were already read whole.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.state == requestStateDone || r.reader == nil {
+		return r.Body, nil
+	}
+
+	if r.beforeBodyRead != nil {
+		fn := r.beforeBodyRead
+		r.beforeBodyRead = nil
+
+		err := fn()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := r.readUntil(requestStateDone)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Body) < r.contentLength {
+		return nil, fmt.Errorf("not enough content provided")
+	}
+
+	return r.Body, nil
+}
+
+// Buffered returns the bytes past the end of the request that were read into the parser's
+// buffer along with it. That's only what happened to come in with the request, whatever the
+// client sent next is there and on the reader after it, Rest reads both.
+func (r *Request) Buffered() []byte {
+	if r.state != requestStateDone {
+		return nil
+	}
+
+	return r.buf[:r.readToIndex]
+}
+
+// Rest reads what follows the request: the buffered bytes first, then the reader the request
+// was parsed from. It's how the next request on a connection or a recording is read.
+func (r *Request) Rest() io.Reader {
+	buffered := bytes.NewReader(bytes.Clone(r.Buffered()))
+	if r.reader == nil {
+		return buffered
+	}
+
+	return io.MultiReader(buffered, r.reader)
+}
+
+func (r *Request) readUntil(until requestState) error {
+	// bytes read past the point the last call stopped at are still waiting in the buffer
+	err := r.parseBuffered(until)
+	if err != nil {
+		return err
+	}
+
+	for r.state < until {
+		if r.readToIndex >= len(r.buf) {
+			newBuf := make([]byte, len(r.buf)*2)
+			copy(newBuf, r.buf)
+			r.buf = newBuf
 		}
 
-		numReadbytes, err := reader.Read(buf[readToIndex:])
+		numReadbytes, err := r.reader.Read(r.buf[r.readToIndex:])
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				request.state = requestStateDone
+				if r.isParsingChunkedBody() {
+					return fmt.Errorf("incomplete chunked body")
+				}
+
+				r.state = requestStateDone
 				break
 			}
 
-			return nil, err
+			return err
 		}
-		readToIndex += numReadbytes
+		r.readToIndex += numReadbytes
 
-		numParsedBytes, err := request.parse(buf[:readToIndex])
+		err = r.parseBuffered(until)
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+
+	return nil
+}
 
-		copy(buf, buf[numParsedBytes:])
-		readToIndex -= numParsedBytes
+func (r *Request) parseBuffered(until requestState) error {
+	numParsedBytes, err := r.parse(r.buf[:r.readToIndex], until)
+	if err != nil {
+		return &ParseError{Offset: r.parsed + numParsedBytes, Err: err}
 	}
+	r.parsed += numParsedBytes
 
-	val, ok := request.Headers.Get("content-length")
-	if ok {
-		contentLength, err := strconv.Atoi(val)
-		if err != nil {
-			return nil, fmt.Errorf("couldnt convert content-length to int")
-		}
+	copy(r.buf, r.buf[numParsedBytes:])
+	r.readToIndex -= numParsedBytes
 
-		if len(request.Body) < contentLength {
-			return nil, fmt.Errorf("not enough content provided")
+	return nil
+}
+
+func (r *Request) isParsingChunkedBody() bool {
+	return r.state == requestStateParsingChunkSize ||
+		r.state == requestStateParsingChunkData ||
+		r.state == requestStateParsingTrailers
+}
+
+// selectBodyFraming applies the message body length rules from RFC 9112 section 6.3
+// once all the headers are known. Anything ambiguous is rejected rather than guessed,
+// since two parties guessing differently is exactly what request smuggling relies on.
+func (r *Request) selectBodyFraming() error {
+	transferEncoding, hasTransferEncoding := r.Headers.Get("transfer-encoding")
+	contentLength, hasContentLength := r.Headers.Get("content-length")
+
+	if hasTransferEncoding && hasContentLength {
+		return fmt.Errorf("both transfer-encoding and content-length provided")
+	}
+
+	if hasTransferEncoding {
+		if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+			return fmt.Errorf("unsupported transfer-encoding")
 		}
+
+		r.state = requestStateParsingChunkSize
+		return nil
+	}
+
+	if !hasContentLength {
+		r.state = requestStateDone
+		return nil
+	}
+
+	length, err := framing.ContentLength(contentLength)
+	if err != nil {
+		return err
+	}
+
+	r.contentLength = length
+	if length == 0 {
+		r.state = requestStateDone
+	} else {
+		r.state = requestStateParsingBody
 	}
 
-	return &request, nil
+	return nil
 }
 
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
@@ -197,7 +430,7 @@ func requestLineFromString(str string) (*RequestLine, error) {
 		}
 	}
 
-	if protocolVersion != "HTTP/1.1" {
+	if protocolVersion != "HTTP/1.1" && protocolVersion != "HTTP/1.0" {
 		return nil, fmt.Errorf("invalid protocol version")
 	}
 
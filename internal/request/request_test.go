@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -82,6 +83,12 @@ func TestRequestLineParse(t *testing.T) {
 	require.Error(t, err)
 	assert.Equal(t, "invalid http method", err.Error())
 
+	// Test: Good HTTP/1.0 Request line
+	r, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/1.0\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+
 	// Test: Invalid HTTP version
 	_, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/1.4\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
 	require.Error(t, err)
@@ -146,9 +153,9 @@ func TestRequestLineWithHeadersParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers["host"])
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers["user-agent"])
+	assert.Equal(t, []string{"*/*"}, r.Headers["accept"])
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -186,7 +193,7 @@ func TestRequestLineWithHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, localhost:42068", r.Headers["host"])
+	assert.Equal(t, []string{"localhost:42069, localhost:42068"}, r.Headers["host"])
 
 	// Test: Case insensitve header key
 	reader = &chunkReader{
@@ -196,7 +203,7 @@ func TestRequestLineWithHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", r.Headers["Host"])
+	assert.Nil(t, r.Headers["Host"])
 
 	// Test: Missing end of headers
 	reader = &chunkReader{
@@ -261,7 +268,7 @@ func TestRequestLineWithHeadersAndBodyParse(t *testing.T) {
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
 
-	// Test: Body longer than reported content length
+	// Test: Body longer than reported content length, the rest is left for the next request
 	reader = &chunkReader{
 		data: "POST /submit HTTP/1.1\r\n" +
 			"Host: localhost:42069\r\n" +
@@ -270,8 +277,31 @@ func TestRequestLineWithHeadersAndBodyParse(t *testing.T) {
 			"this is like a lot of content",
 		numBytesPerRead: 3,
 	}
-	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "this ", string(r.Body))
+
+	// Test: Pipelined request after a body read in one go
+	data := "POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello" +
+		"GET /next HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"\r\n"
+	r, err = RequestFromReader(&chunkReader{data: data, numBytesPerRead: len(data)})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: Only some of what follows is buffered, the rest is still on the reader
+	reader = &chunkReader{data: data + strings.Repeat("x", 100), numBytesPerRead: 3}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Less(t, len(r.Buffered()), 100)
+	rest, err := io.ReadAll(r.Rest())
+	require.NoError(t, err)
+	assert.Equal(t, data[strings.Index(data, "GET"):]+strings.Repeat("x", 100), string(rest))
 
 
 	// Test: No content length but body exists
@@ -285,4 +315,327 @@ func TestRequestLineWithHeadersAndBodyParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.Nil(t, r.Body)
+
+	// Test: Repeated identical content length
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello", string(r.Body))
+}
+
+func TestRequestChunkedBodyParse(t *testing.T) {
+	// Test: Standard chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\n" +
+			"hello \r\n" +
+			"7;name=value\r\n" +
+			"world!\n\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// Test: Chunked body with trailers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"A\r\n" +
+			"0123456789\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789", string(r.Body))
+	assert.Equal(t, []string{"abc"}, r.Trailers["x-checksum"])
+
+	// Test: Empty chunked body
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Nil(t, r.Body)
+}
+
+func TestRequestLazyBody(t *testing.T) {
+	// Test: Body is left unread until asked for
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Expect: 100-continue\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := HeadFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, []string{"100-continue"}, r.Headers["expect"])
+	assert.Nil(t, r.Body)
+
+	called := 0
+	r.BeforeBodyRead(func() error {
+		called++
+		return nil
+	})
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.Equal(t, 1, called)
+
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.Equal(t, 1, called)
+
+	// Test: Body read in the same read as the headers
+	r, err = HeadFromReader(strings.NewReader("POST /submit HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: No body means the hook is never called
+	r, err = HeadFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	r.BeforeBodyRead(func() error {
+		t.Fatal("hook called for a request without a body")
+		return nil
+	})
+	_, err = r.ReadBody()
+	require.NoError(t, err)
+}
+
+func TestParseErrorOffset(t *testing.T) {
+	parseError := func(data string, numBytesPerRead int) *ParseError {
+		_, err := RequestFromReader(&chunkReader{data: data, numBytesPerRead: numBytesPerRead})
+		require.Error(t, err)
+		var parseErr *ParseError
+		require.ErrorAs(t, err, &parseErr)
+		return parseErr
+	}
+
+	// Test: Invalid request line
+	err := parseError("get / HTTP/1.1\r\n\r\n", 3)
+	assert.Equal(t, 0, err.Offset)
+	assert.Equal(t, "invalid http method", err.Error())
+
+	// Test: Invalid header after valid ones
+	data := "GET / HTTP/1.1\r\nHost: localhost\r\nBad Header: x\r\n\r\n"
+	err = parseError(data, 5)
+	assert.Equal(t, strings.Index(data, "Bad"), err.Offset)
+	assert.Equal(t, "invalid header format", err.Error())
+
+	// Test: Invalid chunk size
+	data = "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\nzz\r\n"
+	err = parseError(data, 7)
+	assert.Equal(t, strings.Index(data, "zz"), err.Offset)
+	assert.Equal(t, "invalid chunk size", err.Error())
+
+	// Test: Errors that aren't about the bytes
+	_, plainErr := RequestFromReader(&chunkReader{data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel", numBytesPerRead: 4})
+	require.Error(t, plainErr)
+	assert.NotErrorAs(t, plainErr, new(*ParseError))
+}
+
+func TestRequestWriteTo(t *testing.T) {
+	// Test: Content-Length body
+	r, err := RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\ncontent-type: text/plain\r\nHost: localhost:42069\r\nx-b: 2\r\nContent-Length: 13\r\n\r\nhello world!\n"))
+	require.NoError(t, err)
+	buf := &strings.Builder{}
+	n, err := r.WriteTo(buf)
+	require.NoError(t, err)
+	expected := "POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"X-B: 2\r\n" +
+		"Content-Length: 13\r\n" +
+		"\r\n" +
+		"hello world!\n"
+	assert.Equal(t, expected, buf.String())
+	assert.Equal(t, int64(len(expected)), n)
+
+	// Test: Written request parses back the same
+	again, err := RequestFromReader(&chunkReader{data: buf.String(), numBytesPerRead: 3})
+	require.NoError(t, err)
+	assert.Equal(t, r.RequestLine, again.RequestLine)
+	assert.Equal(t, r.Headers, again.Headers)
+	assert.Equal(t, r.Body, again.Body)
+
+	// Test: Chunked body keeps its trailers
+	r, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"6\r\nhello \r\n" +
+		"6\r\nworld!\r\n" +
+		"0\r\n" +
+		"X-Checksum: abc\r\n" +
+		"\r\n"))
+	require.NoError(t, err)
+	buf = &strings.Builder{}
+	_, err = r.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /submit HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"Trailer: X-Checksum\r\n"+
+		"\r\n"+
+		"c\r\nhello world!\r\n"+
+		"0\r\n"+
+		"X-Checksum: abc\r\n"+
+		"\r\n", buf.String())
+
+	// Test: Host taken from an absolute-form target
+	r = &Request{
+		RequestLine: RequestLine{Method: "GET", RequestTarget: "http://example.com/path", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	buf = &strings.Builder{}
+	_, err = r.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "GET http://example.com/path HTTP/1.1\r\nHost: example.com\r\n\r\n", buf.String())
+
+	// Test: Empty POST body still gets a length
+	r = &Request{
+		RequestLine: RequestLine{Method: "POST", RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	buf = &strings.Builder{}
+	_, err = r.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "POST / HTTP/1.1\r\nContent-Length: 0\r\n\r\n", buf.String())
+
+	// Test: Header that would split the request
+	r.Headers.Set("X-Evil", "a\r\nX-Injected: b")
+	_, err = r.WriteTo(&strings.Builder{})
+	require.Error(t, err)
+	assert.Equal(t, "invalid header X-Evil", err.Error())
+
+	// Test: Host that would split the request
+	r.Headers.Delete("X-Evil")
+	r.Headers.Set("Host", "a\r\nX-Evil: 1")
+	buf = &strings.Builder{}
+	_, err = r.WriteTo(buf)
+	require.Error(t, err)
+	assert.Equal(t, "invalid header Host", err.Error())
+	assert.NotContains(t, buf.String(), "X-Evil")
+
+	// Test: Request line that would split the request
+	r.Headers.Set("Host", "localhost")
+	r.RequestLine.RequestTarget = "/ HTTP/1.1\r\nX-Evil: 1\r\n\r\nGET /"
+	_, err = r.WriteTo(&strings.Builder{})
+	require.Error(t, err)
+	assert.Equal(t, `invalid request target "/ HTTP/1.1\r\nX-Evil: 1\r\n\r\nGET /"`, err.Error())
+	r.RequestLine.RequestTarget = "/"
+	r.RequestLine.Method = "GET /evil"
+	_, err = r.WriteTo(&strings.Builder{})
+	require.Error(t, err)
+	assert.Equal(t, `invalid method "GET /evil"`, err.Error())
+
+	// Test: Chunked framing picked for trailers goes after the other codings
+	r = &Request{
+		RequestLine: RequestLine{Method: "POST", RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+		Body:        []byte("gzipped"),
+		Trailers:    headers.NewHeaders(),
+		state:       requestStateDone,
+	}
+	r.Headers.Set("Transfer-Encoding", "gzip")
+	r.Trailers.Set("X-Checksum", "abc")
+	buf = &strings.Builder{}
+	_, err = r.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "POST / HTTP/1.1\r\n"+
+		"Transfer-Encoding: gzip, chunked\r\n"+
+		"Trailer: X-Checksum\r\n"+
+		"\r\n"+
+		"7\r\ngzipped\r\n"+
+		"0\r\n"+
+		"X-Checksum: abc\r\n"+
+		"\r\n", buf.String())
+}
+
+func TestDumpRequest(t *testing.T) {
+	reader := &chunkReader{
+		data:            "PUT /item HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 4,
+	}
+	r, err := HeadFromReader(reader)
+	require.NoError(t, err)
+
+	// Test: Head only still frames the body
+	dump, err := DumpRequest(r, false)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT /item HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\n", string(dump))
+
+	// Test: Body included and still readable
+	dump, err = DumpRequest(r, true)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT /item HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello", string(dump))
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestCurlCommand(t *testing.T) {
+	// Test: GET with headers
+	r, err := RequestFromReader(strings.NewReader("GET /search?q=a HTTP/1.1\r\nHost: localhost:42069\r\nAccept: */*\r\n\r\n"))
+	require.NoError(t, err)
+	command, err := CurlCommand(r)
+	require.NoError(t, err)
+	assert.Equal(t, `curl 'http://localhost:42069/search?q=a' -H 'Accept: */*'`, command)
+
+	// Test: POST with a body that needs quoting
+	r, err = RequestFromReader(strings.NewReader("POST /notes HTTP/1.1\r\nHost: localhost:42069\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\nit's a note"))
+	require.NoError(t, err)
+	command, err = CurlCommand(r)
+	require.NoError(t, err)
+	assert.Equal(t, `curl -X POST 'http://localhost:42069/notes' -H 'Content-Type: text/plain' --data-binary 'it'\''s a note'`, command)
+
+	// Test: HEAD
+	r, err = RequestFromReader(strings.NewReader("HEAD / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	command, err = CurlCommand(r)
+	require.NoError(t, err)
+	assert.Equal(t, `curl --head 'http://localhost:42069/'`, command)
+
+	// Test: GET with a body keeps its method
+	r, err = RequestFromReader(strings.NewReader("GET /x HTTP/1.1\r\nHost: h\r\nContent-Length: 3\r\n\r\nq=1"))
+	require.NoError(t, err)
+	command, err = CurlCommand(r)
+	require.NoError(t, err)
+	assert.Equal(t, `curl -X GET 'http://h/x' --data-binary 'q=1'`, command)
 }
@@ -0,0 +1,228 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// known request smuggling payloads, every one of them has to be rejected
+// no matter how the bytes are split up on the wire
+var smugglingCorpus = []struct {
+	name string
+	data string
+	err  string
+}{
+	{
+		name: "CL.TE",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n" +
+			"SMUGGLED",
+		err: "both transfer-encoding and content-length provided",
+	},
+	{
+		name: "TE.CL",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Content-Length: 3\r\n" +
+			"\r\n" +
+			"8\r\n" +
+			"SMUGGLED\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "both transfer-encoding and content-length provided",
+	},
+	{
+		name: "CL.CL conflicting",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 8\r\n" +
+			"Content-Length: 7\r\n" +
+			"\r\n" +
+			"12345678",
+		err: "conflicting content-length values",
+	},
+	{
+		name: "CL comma separated list",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 8, 7\r\n" +
+			"\r\n" +
+			"12345678",
+		err: "conflicting content-length values",
+	},
+	{
+		name: "CL with sign",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: +8\r\n" +
+			"\r\n" +
+			"12345678",
+		err: "invalid content-length",
+	},
+	{
+		name: "CL negative",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: -1\r\n" +
+			"\r\n",
+		err: "invalid content-length",
+	},
+	{
+		name: "CL hex",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 0x8\r\n" +
+			"\r\n" +
+			"12345678",
+		err: "invalid content-length",
+	},
+	{
+		name: "CL empty list member",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 8,\r\n" +
+			"\r\n" +
+			"12345678",
+		err: "invalid content-length",
+	},
+	{
+		name: "TE obfuscated value",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: xchunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "unsupported transfer-encoding",
+	},
+	{
+		name: "TE chunked not final",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked, identity\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "unsupported transfer-encoding",
+	},
+	{
+		name: "TE duplicated",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Transfer-Encoding: cow\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "unsupported transfer-encoding",
+	},
+	{
+		name: "TE space before colon",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding : chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "invalid header format",
+	},
+	{
+		name: "TE tab before colon",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding\t: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "invalid header format",
+	},
+	{
+		name: "CL space before colon",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length : 8\r\n" +
+			"\r\n" +
+			"12345678",
+		err: "invalid header format",
+	},
+	{
+		name: "chunk size not hex",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\n" +
+			"SMUGGLED\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "invalid chunk size",
+	},
+	{
+		name: "chunk size with sign",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"-8\r\n" +
+			"SMUGGLED\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "invalid chunk size",
+	},
+	{
+		name: "chunk size overflow",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"ffffffffffffffff0\r\n" +
+			"SMUGGLED\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "invalid chunk size",
+	},
+	{
+		name: "chunk data longer than size",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\n" +
+			"SMUGGLED\r\n" +
+			"0\r\n" +
+			"\r\n",
+		err: "invalid chunk terminator",
+	},
+	{
+		name: "chunked body cut short",
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"8\r\n" +
+			"SMUG",
+		err: "incomplete chunked body",
+	},
+}
+
+func TestRequestSmugglingCorpus(t *testing.T) {
+	for _, tc := range smugglingCorpus {
+		for _, numBytesPerRead := range []int{1, 3, 8, len(tc.data)} {
+			reader := &chunkReader{
+				data:            tc.data,
+				numBytesPerRead: numBytesPerRead,
+			}
+			_, err := RequestFromReader(reader)
+			require.Error(t, err, tc.name)
+			assert.Equal(t, tc.err, err.Error(), tc.name)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+)
+
+// framingHeaders are picked by WriteTo from the body and the trailers, never copied
+var framingHeaders = []string{"host", "content-length", "transfer-encoding", "trailer"}
+
+// WriteTo writes the request the way it goes on the wire: the request line, Host first,
+// the other headers sorted under their canonical names and then the body. The framing
+// is picked again, it's chunked when there are trailers or the request came in chunked
+// and a Content-Length otherwise. The body is read first if it wasn't yet.
+func (r *Request) WriteTo(w io.Writer) (int64, error) {
+	body, err := r.ReadBody()
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	err = r.writeHead(bw, body)
+	if err != nil {
+		return cw.n, err
+	}
+
+	if r.isChunked() {
+		err = writeChunkedBody(bw, body, r.Trailers)
+		if err != nil {
+			return cw.n, err
+		}
+	} else {
+		bw.Write(body)
+	}
+
+	err = bw.Flush()
+	return cw.n, err
+}
+
+func (r *Request) writeHead(w io.Writer, body []byte) error {
+	version := r.RequestLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+
+	// a method is a token like a field name is
+	if !headers.ValidFieldName(r.RequestLine.Method) {
+		return fmt.Errorf("invalid method %q", r.RequestLine.Method)
+	}
+
+	if !validRequestTarget(r.RequestLine.RequestTarget) {
+		return fmt.Errorf("invalid request target %q", r.RequestLine.RequestTarget)
+	}
+
+	host, ok := r.Headers.Get("Host")
+	if !ok {
+		target, err := url.Parse(r.RequestLine.RequestTarget)
+		if err == nil {
+			host = target.Host
+		}
+	}
+	if !headers.ValidFieldValue(host) {
+		return fmt.Errorf("invalid header Host")
+	}
+
+	fmt.Fprintf(w, "%s %s HTTP/%s%s", r.RequestLine.Method, r.RequestLine.RequestTarget, version, crlf)
+	if host != "" {
+		fmt.Fprintf(w, "Host: %s%s", host, crlf)
+	}
+
+	err := writeFields(w, r.Headers, framingHeaders)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case r.isChunked():
+		// the codings before chunked weren't undone, the body still has them applied, chunked
+		// goes last when it's the trailers that picked it
+		transferEncoding, ok := r.Headers.Get("Transfer-Encoding")
+		if !ok {
+			transferEncoding = "chunked"
+		} else if !endsInChunked(transferEncoding) {
+			transferEncoding += ", chunked"
+		}
+		fmt.Fprintf(w, "Transfer-Encoding: %s%s", transferEncoding, crlf)
+
+		if len(r.Trailers) > 0 {
+			names := []string{}
+			for key := range r.Trailers {
+				names = append(names, headers.CanonicalName(key))
+			}
+			slices.Sort(names)
+
+			fmt.Fprintf(w, "Trailer: %s%s", strings.Join(names, ", "), crlf)
+		}
+	case len(body) > 0 || slices.Contains([]string{"POST", "PUT", "PATCH"}, r.RequestLine.Method):
+		fmt.Fprintf(w, "Content-Length: %s%s", strconv.Itoa(len(body)), crlf)
+	}
+
+	_, err = fmt.Fprint(w, crlf)
+	return err
+}
+
+func (r *Request) isChunked() bool {
+	if len(r.Trailers) > 0 {
+		return true
+	}
+
+	transferEncoding, ok := r.Headers.Get("Transfer-Encoding")
+	if !ok {
+		return false
+	}
+
+	return endsInChunked(transferEncoding)
+}
+
+func endsInChunked(transferEncoding string) bool {
+	codings := strings.Split(transferEncoding, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// validRequestTarget rejects targets that would end the request line early or split it
+func validRequestTarget(target string) bool {
+	if target == "" {
+		return false
+	}
+
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeFields writes the fields of h sorted by name, skipping the ones in skip.
+// Every value of a field goes out as a line of its own, the way Set-Cookie's are kept.
+func writeFields(w io.Writer, h headers.Headers, skip []string) error {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		if !slices.Contains(skip, strings.ToLower(key)) {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return strings.Compare(headers.CanonicalName(a), headers.CanonicalName(b))
+	})
+
+	for _, key := range keys {
+		for _, value := range h[key] {
+			if !headers.ValidFieldName(key) || !headers.ValidFieldValue(value) {
+				return fmt.Errorf("invalid header %s", key)
+			}
+
+			fmt.Fprintf(w, "%s: %s%s", headers.CanonicalName(key), value, crlf)
+		}
+	}
+
+	return nil
+}
+
+func writeChunkedBody(w io.Writer, body []byte, trailers headers.Headers) error {
+	if len(body) > 0 {
+		fmt.Fprintf(w, "%x%s%s%s", len(body), crlf, body, crlf)
+	}
+
+	fmt.Fprintf(w, "0%s", crlf)
+
+	err := writeFields(w, trailers, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprint(w, crlf)
+	return err
+}
+
+// DumpRequest returns the request as WriteTo would send it, without the body unless
+// body is set. The body is read either way since the framing depends on it, it can
+// still be read with ReadBody after.
+func DumpRequest(r *Request, body bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	if body {
+		_, err := r.WriteTo(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	data, err := r.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.writeHead(buf, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// CurlCommand formats the request as a curl command line that sends the same thing, for
+// pasting into a shell while debugging. An origin-form target is completed from the Host
+// header, the framing headers are left for curl to pick.
+func CurlCommand(r *Request) (string, error) {
+	body, err := r.ReadBody()
+	if err != nil {
+		return "", err
+	}
+
+	target := r.RequestLine.RequestTarget
+	host, hasHost := r.Headers.Get("Host")
+	if strings.HasPrefix(target, "/") && hasHost {
+		target = "http://" + host + target
+	}
+
+	parts := []string{"curl"}
+	method := r.RequestLine.Method
+	switch {
+	case method == "GET" && len(body) == 0:
+	case method == "HEAD" && len(body) == 0:
+		parts = append(parts, "--head")
+	default:
+		// given a body curl sends a POST, any other method has to be named
+		parts = append(parts, "-X", method)
+	}
+	parts = append(parts, shellQuote(target))
+
+	keys := make([]string, 0, len(r.Headers))
+	for key := range r.Headers {
+		lower := strings.ToLower(key)
+		if lower == "content-length" || lower == "transfer-encoding" || lower == "host" && hasHost && target != r.RequestLine.RequestTarget {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		for _, value := range r.Headers[key] {
+			parts = append(parts, "-H", shellQuote(headers.CanonicalName(key)+": "+value))
+		}
+	}
+
+	if len(body) > 0 {
+		parts = append(parts, "--data-binary", shellQuote(string(body)))
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// shellQuote wraps s in single quotes, the ones inside are closed, escaped and reopened
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
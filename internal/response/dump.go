@@ -0,0 +1,66 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+)
+
+// DumpResponse returns the response as it came in, headers sorted under their canonical
+// names, with the body when body is set. Reading the body for the dump leaves it in
+// r.Body again for the caller, a chunked one is dumped as a single chunk and its trailers.
+func DumpResponse(r *Response, body bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	statusLine := fmt.Sprintf("HTTP/%s %d", r.StatusLine.HttpVersion, r.StatusLine.StatusCode)
+	if r.StatusLine.ReasonPhrase != "" {
+		statusLine += " " + r.StatusLine.ReasonPhrase
+	}
+	buf.WriteString(statusLine + crlf)
+	writeSortedFields(buf, r.Headers)
+	buf.WriteString(crlf)
+
+	if !body {
+		return buf.Bytes(), nil
+	}
+
+	data, err := r.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+
+	if !r.chunked {
+		buf.Write(data)
+		return buf.Bytes(), nil
+	}
+
+	if len(data) > 0 {
+		fmt.Fprintf(buf, "%x%s%s%s", len(data), crlf, data, crlf)
+	}
+	buf.WriteString("0" + crlf)
+	writeSortedFields(buf, r.Trailers)
+	buf.WriteString(crlf)
+
+	return buf.Bytes(), nil
+}
+
+func writeSortedFields(buf *bytes.Buffer, h headers.Headers) {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return strings.Compare(headers.CanonicalName(a), headers.CanonicalName(b))
+	})
+
+	for _, key := range keys {
+		for _, value := range h[key] {
+			fmt.Fprintf(buf, "%s: %s%s", headers.CanonicalName(key), value, crlf)
+		}
+	}
+}
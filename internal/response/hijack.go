@@ -0,0 +1,54 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Hijack hands the connection over to the handler, for protocols that take over after
+// an Upgrade or for tunnels. The reader returns the bytes the client sent past the
+// request before reading from the connection. Whatever was written to the response but
+// not sent yet is dropped, it's up to the handler to answer on the connection itself,
+// and once the handler returns the server doesn't touch the connection anymore,
+// closing it included.
+func (w *Writer) Hijack() (net.Conn, *bufio.Reader, error) {
+	if w.hijacked {
+		return nil, nil, fmt.Errorf("connection already hijacked")
+	}
+
+	if w.headSent {
+		return nil, nil, fmt.Errorf("headers already sent")
+	}
+
+	conn, ok := w.dst.(net.Conn)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+
+	var buffered []byte
+	if w.Request != nil {
+		// an unread body is still part of the request, not of what comes after it
+		_, err := w.Request.ReadBody()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		buffered = bytes.Clone(w.Request.Buffered())
+	}
+
+	w.hijacked = true
+	w.finished = true
+	w.state = writerStateDone
+	w.head.Reset()
+	w.body.Reset()
+
+	return conn, bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)), nil
+}
+
+// Hijacked reports whether the handler took the connection over with Hijack.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
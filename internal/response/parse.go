@@ -0,0 +1,460 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/framing"
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+)
+
+const parseBufferSize = 4096
+
+type responseState int
+
+const (
+	responseStateInitialized responseState = iota
+	responseStateParsingHeaders
+	responseStateParsingBody
+	responseStateParsingUntilClose
+	responseStateParsingChunkSize
+	responseStateParsingChunkData
+	responseStateParsingTrailers
+	responseStateDone
+)
+
+// Response is a response read from a connection. The head is parsed up front and the body
+// is streamed from Body as it's read, Trailers are filled in once Body is read to the end.
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Trailers   headers.Headers
+	// Interim holds the 1xx responses the server sent before this one, in the order they came in.
+	Interim []Interim
+	// Body is closed by whoever owns the connection underneath, closing it is a no-op otherwise.
+	Body io.ReadCloser
+
+	requestMethod string
+	state         responseState
+	untilClose    bool
+	chunked       bool
+	remaining     int
+	reader        io.Reader
+	buf           []byte
+	readToIndex   int
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+// Interim is an informational response like 100 Continue or 103 Early Hints, it's only
+// ever a head and the final response follows it on the same connection.
+type Interim struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+}
+
+// ResponseFromReader parses the status line and the headers of a response and leaves the body
+// on the reader for Body. requestMethod is the method of the request being answered,
+// a response to HEAD never has a body whatever its headers say. Interim 1xx responses
+// are collected on the way to the final one, except 101 which ends the response there.
+func ResponseFromReader(reader io.Reader, requestMethod string) (*Response, error) {
+	return parseResponse(reader, requestMethod, nil)
+}
+
+// Next parses the response that follows r on the same connection, starting with the
+// bytes r read past its end. It's for pipelined requests, r has to be read whole first
+// and not be delimited by the connection closing.
+func (r *Response) Next(requestMethod string) (*Response, error) {
+	if r.state != responseStateDone || r.untilClose {
+		return nil, fmt.Errorf("response not read to its end")
+	}
+
+	return parseResponse(r.reader, requestMethod, r.buf[:r.readToIndex])
+}
+
+// parseResponse parses a response from leftover, what was already read off the reader, and the reader
+func parseResponse(reader io.Reader, requestMethod string, leftover []byte) (*Response, error) {
+	r := &Response{
+		Headers:       headers.NewHeaders(),
+		Trailers:      headers.NewHeaders(),
+		requestMethod: requestMethod,
+		state:         responseStateInitialized,
+		reader:        reader,
+		buf:           make([]byte, max(parseBufferSize, len(leftover))),
+		readToIndex:   len(leftover),
+	}
+	copy(r.buf, leftover)
+	r.Body = &bodyReader{r: r}
+
+	for r.state < responseStateParsingBody {
+		n, err := r.parseHead(r.buf[:r.readToIndex])
+		if err != nil {
+			return nil, err
+		}
+
+		if n > 0 {
+			r.consume(n)
+			continue
+		}
+
+		err = r.fill()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// ReadBody reads whatever is left of the body.
+func (r *Response) ReadBody() ([]byte, error) {
+	return io.ReadAll(r.Body)
+}
+
+// Done reports whether the whole response, trailers included, was read.
+func (r *Response) Done() bool {
+	return r.state == responseStateDone
+}
+
+// KeepAlive reports whether the connection the response came on can carry another
+// request now. It has to be read whole, end on its own rather than with the connection
+// and not be followed by anything, and the server must not have asked to close.
+func (r *Response) KeepAlive() bool {
+	if r.state != responseStateDone || r.untilClose || r.readToIndex > 0 {
+		return false
+	}
+
+	if r.StatusLine.StatusCode == StatusSwitchingProtocols {
+		return false
+	}
+
+	options := []string{}
+	for _, value := range r.Headers.Values("Connection") {
+		for _, option := range strings.Split(value, ",") {
+			options = append(options, strings.ToLower(strings.TrimSpace(option)))
+		}
+	}
+
+	if r.StatusLine.HttpVersion == "1.0" {
+		return slices.Contains(options, "keep-alive")
+	}
+
+	return !slices.Contains(options, "close")
+}
+
+func (r *Response) parseHead(data []byte) (int, error) {
+	switch r.state {
+	case responseStateInitialized:
+		idx := bytes.Index(data, []byte(crlf))
+		if idx == -1 {
+			return 0, nil
+		}
+
+		statusLine, err := parseStatusLine(string(data[:idx]))
+		if err != nil {
+			return 0, err
+		}
+
+		r.StatusLine = *statusLine
+		r.state = responseStateParsingHeaders
+
+		return idx + 2, nil
+	case responseStateParsingHeaders:
+		n, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+
+		if done && r.isInterim() {
+			r.Interim = append(r.Interim, Interim{StatusLine: r.StatusLine, Headers: r.Headers})
+			r.StatusLine = StatusLine{}
+			r.Headers = headers.NewHeaders()
+			r.state = responseStateInitialized
+
+			return n, nil
+		}
+
+		if done {
+			err = r.selectBodyFraming()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return n, nil
+	default:
+		return 0, fmt.Errorf("unknown state")
+	}
+}
+
+// isInterim tells the 1xx responses that come before the final one apart from 101,
+// after which the connection isn't speaking HTTP anymore
+func (r *Response) isInterim() bool {
+	code := r.StatusLine.StatusCode
+	return code >= 100 && code < 200 && code != StatusSwitchingProtocols
+}
+
+// selectBodyFraming applies the message body length rules from RFC 9112 section 6.3,
+// as they go for responses: a body that isn't framed otherwise lasts until the connection closes
+func (r *Response) selectBodyFraming() error {
+	code := r.StatusLine.StatusCode
+	if r.requestMethod == "HEAD" || (code >= 100 && code < 200) || code == StatusNoContent || code == StatusNotModified {
+		r.state = responseStateDone
+		return nil
+	}
+
+	transferEncoding, hasTransferEncoding := r.Headers.Get("transfer-encoding")
+	if hasTransferEncoding {
+		codings := strings.Split(transferEncoding, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			r.state = responseStateParsingChunkSize
+			r.chunked = true
+		} else {
+			r.state = responseStateParsingUntilClose
+			r.untilClose = true
+		}
+
+		return nil
+	}
+
+	contentLength, hasContentLength := r.Headers.Get("content-length")
+	if !hasContentLength {
+		r.state = responseStateParsingUntilClose
+		r.untilClose = true
+		return nil
+	}
+
+	length, err := framing.ContentLength(contentLength)
+	if err != nil {
+		return err
+	}
+
+	r.remaining = length
+	if length == 0 {
+		r.state = responseStateDone
+	} else {
+		r.state = responseStateParsingBody
+	}
+
+	return nil
+}
+
+type bodyReader struct {
+	r *Response
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	return b.r.readBody(p)
+}
+
+func (b *bodyReader) Close() error {
+	return nil
+}
+
+// readBody advances through the body framing until it has bytes of the body to hand out
+func (r *Response) readBody(p []byte) (int, error) {
+	for {
+		switch r.state {
+		case responseStateDone:
+			return 0, io.EOF
+		case responseStateParsingBody:
+			n, err := r.take(p[:min(len(p), r.remaining)])
+			r.remaining -= n
+			if r.remaining == 0 {
+				r.state = responseStateDone
+			}
+
+			if errors.Is(err, io.EOF) && r.remaining > 0 {
+				return n, fmt.Errorf("not enough content provided")
+			}
+
+			if err != nil && !errors.Is(err, io.EOF) {
+				return n, err
+			}
+
+			return n, nil
+		case responseStateParsingUntilClose:
+			n, err := r.take(p)
+			if errors.Is(err, io.EOF) {
+				r.state = responseStateDone
+			}
+
+			return n, err
+		case responseStateParsingChunkSize:
+			line, err := r.line()
+			if err != nil {
+				return 0, err
+			}
+
+			size, err := framing.ChunkSize(line)
+			if err != nil {
+				return 0, err
+			}
+
+			if size == 0 {
+				r.state = responseStateParsingTrailers
+			} else {
+				r.remaining = size
+				r.state = responseStateParsingChunkData
+			}
+		case responseStateParsingChunkData:
+			if r.remaining > 0 {
+				n, err := r.take(p[:min(len(p), r.remaining)])
+				r.remaining -= n
+
+				if errors.Is(err, io.EOF) {
+					return n, fmt.Errorf("incomplete chunked body")
+				}
+
+				return n, err
+			}
+
+			line, err := r.line()
+			if err != nil {
+				return 0, err
+			}
+
+			if line != "" {
+				return 0, fmt.Errorf("invalid chunk terminator")
+			}
+
+			r.state = responseStateParsingChunkSize
+		case responseStateParsingTrailers:
+			n, done, err := r.Trailers.Parse(r.buf[:r.readToIndex])
+			if err != nil {
+				return 0, err
+			}
+
+			if done {
+				r.state = responseStateDone
+			}
+
+			if n > 0 {
+				r.consume(n)
+				continue
+			}
+
+			err = r.fill()
+			if err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("unknown state")
+		}
+	}
+}
+
+// take hands out buffered bytes first and reads straight into p once there are none
+func (r *Response) take(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if r.readToIndex > 0 {
+		n := copy(p, r.buf[:r.readToIndex])
+		r.consume(n)
+		return n, nil
+	}
+
+	return r.reader.Read(p)
+}
+
+// line returns the next line without its CRLF, reading more until there's a whole one
+func (r *Response) line() (string, error) {
+	for {
+		idx := bytes.Index(r.buf[:r.readToIndex], []byte(crlf))
+		if idx != -1 {
+			line := string(r.buf[:idx])
+			r.consume(idx + 2)
+			return line, nil
+		}
+
+		err := r.fill()
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// fill reads more from the reader into the buffer, an end of stream there is an error
+// since whoever asked needed more bytes to make progress
+func (r *Response) fill() error {
+	if r.readToIndex >= len(r.buf) {
+		newBuf := make([]byte, len(r.buf)*2)
+		copy(newBuf, r.buf)
+		r.buf = newBuf
+	}
+
+	n, err := r.reader.Read(r.buf[r.readToIndex:])
+	r.readToIndex += n
+
+	if n > 0 {
+		return nil
+	}
+
+	if errors.Is(err, io.EOF) {
+		if r.state >= responseStateParsingChunkSize {
+			return fmt.Errorf("incomplete chunked body")
+		}
+
+		return fmt.Errorf("incomplete response")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Response) consume(n int) {
+	copy(r.buf, r.buf[n:r.readToIndex])
+	r.readToIndex -= n
+}
+
+// parseStatusLine takes the reason phrase as free text (RFC 9112 section 4), it can be empty
+// or missing along with the space before it. Whitespace around it is dropped, the writer
+// in this package leaves a space at the end itself.
+func parseStatusLine(line string) (*StatusLine, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid status line")
+	}
+
+	if parts[0] != "HTTP/1.1" && parts[0] != "HTTP/1.0" {
+		return nil, fmt.Errorf("invalid protocol version")
+	}
+
+	if len(parts[1]) != 3 || strings.Trim(parts[1], "0123456789") != "" {
+		return nil, fmt.Errorf("invalid status code")
+	}
+
+	code, _ := strconv.Atoi(parts[1])
+	if code < 100 {
+		return nil, fmt.Errorf("invalid status code")
+	}
+
+	statusLine := &StatusLine{
+		HttpVersion: strings.TrimPrefix(parts[0], "HTTP/"),
+		StatusCode:  StatusCode(code),
+	}
+
+	if len(parts) == 3 {
+		if strings.ContainsFunc(parts[2], func(c rune) bool { return (c < ' ' && c != '\t') || c == 0x7f }) {
+			return nil, fmt.Errorf("invalid reason phrase")
+		}
+
+		statusLine.ReasonPhrase = strings.TrimSpace(parts[2])
+	}
+
+	return statusLine, nil
+}
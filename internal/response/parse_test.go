@@ -0,0 +1,335 @@
+package response
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read reads up to len(p) or numBytesPerRead bytes from the string per call
+// its useful for simulating reading a variable number of bytes per chunk from a network connection
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func readResponse(t *testing.T, data, requestMethod string, numBytesPerRead int) (*Response, string) {
+	r, err := ResponseFromReader(&chunkReader{data: data, numBytesPerRead: numBytesPerRead}, requestMethod)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.True(t, r.Done())
+
+	return r, string(body)
+}
+
+func TestStatusLineParse(t *testing.T) {
+	// Test: Good status line
+	r, _ := readResponse(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", "GET", 3)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusCode(StatusOk), r.StatusLine.StatusCode)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+
+	// Test: Reason phrase with spaces and non-ascii text
+	r, _ = readResponse(t, "HTTP/1.1 404 Nie ma  takiej strony\r\nContent-Length: 0\r\n\r\n", "GET", 5)
+	assert.Equal(t, StatusCode(StatusNotFound), r.StatusLine.StatusCode)
+	assert.Equal(t, "Nie ma  takiej strony", r.StatusLine.ReasonPhrase)
+
+	// Test: Empty reason phrase
+	r, _ = readResponse(t, "HTTP/1.1 299 \r\nContent-Length: 0\r\n\r\n", "GET", 1)
+	assert.Equal(t, StatusCode(299), r.StatusLine.StatusCode)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+
+	// Test: Missing reason phrase
+	r, _ = readResponse(t, "HTTP/1.0 500\r\nContent-Length: 0\r\n\r\n", "GET", 2)
+	assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusCode(StatusInternalServerError), r.StatusLine.StatusCode)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+
+	// Test: Invalid HTTP version
+	_, err := ResponseFromReader(strings.NewReader("HTTP/2.0 200 OK\r\n\r\n"), "GET")
+	require.Error(t, err)
+	assert.Equal(t, "invalid protocol version", err.Error())
+
+	// Test: Invalid status code
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 20x OK\r\n\r\n"), "GET")
+	require.Error(t, err)
+	assert.Equal(t, "invalid status code", err.Error())
+
+	// Test: Status code out of range
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 099 Low\r\n\r\n"), "GET")
+	require.Error(t, err)
+	assert.Equal(t, "invalid status code", err.Error())
+
+	// Test: Control characters in the reason phrase
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 O\x00K\r\n\r\n"), "GET")
+	require.Error(t, err)
+	assert.Equal(t, "invalid reason phrase", err.Error())
+
+	// Test: Missing status code
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1\r\n\r\n"), "GET")
+	require.Error(t, err)
+	assert.Equal(t, "invalid status line", err.Error())
+
+	// Test: Connection closed during the head
+	_, err = ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-Le", numBytesPerRead: 4}, "GET")
+	require.Error(t, err)
+	assert.Equal(t, "incomplete response", err.Error())
+}
+
+func TestResponseInterim(t *testing.T) {
+	// Test: Interim responses before the final one
+	r, body := readResponse(t, "HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 103 Early Hints\r\n"+
+		"Link: </style.css>; rel=preload\r\n"+
+		"\r\n"+
+		"HTTP/1.1 200 OK\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"hello", "POST", 3)
+	assert.Equal(t, StatusCode(StatusOk), r.StatusLine.StatusCode)
+	assert.Equal(t, "hello", body)
+	require.Len(t, r.Interim, 2)
+	assert.Equal(t, StatusCode(StatusContinue), r.Interim[0].StatusLine.StatusCode)
+	assert.Equal(t, StatusCode(StatusEarlyHints), r.Interim[1].StatusLine.StatusCode)
+	assert.Equal(t, []string{"</style.css>; rel=preload"}, r.Interim[1].Headers["link"])
+	_, ok := r.Headers.Get("Link")
+	assert.False(t, ok)
+
+	// Test: Switching protocols is final and has no body
+	r, body = readResponse(t, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x00", "GET", 4)
+	assert.Equal(t, StatusCode(StatusSwitchingProtocols), r.StatusLine.StatusCode)
+	assert.Equal(t, "", body)
+	assert.Empty(t, r.Interim)
+}
+
+func TestResponseBodyParse(t *testing.T) {
+	// Test: Content-Length body
+	r, body := readResponse(t, "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nhello world!\n", "GET", 3)
+	assert.Equal(t, "hello world!\n", body)
+	assert.Equal(t, []string{"13"}, r.Headers["content-length"])
+
+	// Test: Empty header values from upstreams are kept
+	r, body = readResponse(t, "HTTP/1.1 200 OK\r\nX-Empty:\r\nContent-Length: 2\r\n\r\nok", "GET", 4)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, []string{""}, r.Headers["x-empty"])
+
+	// Test: Response to HEAD has no body
+	_, body = readResponse(t, "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\n", "HEAD", 3)
+	assert.Equal(t, "", body)
+
+	// Test: 204 has no body
+	_, body = readResponse(t, "HTTP/1.1 204 No Content\r\nContent-Length: 13\r\n\r\n", "DELETE", 5)
+	assert.Equal(t, "", body)
+
+	// Test: 304 has no body
+	_, body = readResponse(t, "HTTP/1.1 304 Not Modified\r\nETag: \"abc\"\r\n\r\n", "GET", 5)
+	assert.Equal(t, "", body)
+
+	// Test: Body that lasts until the connection closes
+	_, body = readResponse(t, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the very end", "GET", 4)
+	assert.Equal(t, "until the very end", body)
+
+	// Test: Transfer coding other than chunked is read until close
+	_, body = readResponse(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n\r\ncompressed", "GET", 4)
+	assert.Equal(t, "compressed", body)
+
+	// Test: Body shorter than Content-Length
+	r, err := ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\nshort", numBytesPerRead: 3}, "GET")
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.Error(t, err)
+	assert.Equal(t, "not enough content provided", err.Error())
+
+	// Test: Conflicting Content-Length values
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello"), "GET")
+	require.Error(t, err)
+	assert.Equal(t, "conflicting content-length values", err.Error())
+
+	// Test: Bytes past the body are left alone
+	reader := strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhelloHTTP/1.1 200 OK\r\n")
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	data, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestResponseChunkedBodyParse(t *testing.T) {
+	// Test: Standard chunked body
+	_, body := readResponse(t, "HTTP/1.1 200 OK\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"6\r\n"+
+		"hello \r\n"+
+		"7;name=value\r\n"+
+		"world!\n\r\n"+
+		"0\r\n"+
+		"\r\n", "GET", 3)
+	assert.Equal(t, "hello world!\n", body)
+
+	// Test: Chunked body with trailers
+	r, body := readResponse(t, "HTTP/1.1 200 OK\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"Trailer: X-Checksum\r\n"+
+		"\r\n"+
+		"A\r\n"+
+		"0123456789\r\n"+
+		"0\r\n"+
+		"X-Checksum: abc\r\n"+
+		"\r\n", "GET", 1)
+	assert.Equal(t, "0123456789", body)
+	assert.Equal(t, []string{"abc"}, r.Trailers["x-checksum"])
+
+	// Test: Empty chunked body
+	_, body = readResponse(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", "GET", 5)
+	assert.Equal(t, "", body)
+
+	// Test: Chunked wins over Content-Length
+	_, body = readResponse(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip, chunked\r\nContent-Length: 100\r\n\r\n3\r\nabc\r\n0\r\n\r\n", "GET", 7)
+	assert.Equal(t, "abc", body)
+
+	// Test: Invalid chunk size
+	r, err := ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n0\r\n\r\n"), "GET")
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.Error(t, err)
+	assert.Equal(t, "invalid chunk size", err.Error())
+
+	// Test: Missing chunk terminator
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcd\r\n0\r\n\r\n"), "GET")
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.Error(t, err)
+	assert.Equal(t, "invalid chunk terminator", err.Error())
+
+	// Test: Connection closed in the middle of the body
+	r, err = ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel", numBytesPerRead: 2}, "GET")
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.Error(t, err)
+	assert.Equal(t, "incomplete chunked body", err.Error())
+}
+
+func TestResponseKeepAlive(t *testing.T) {
+	// Test: HTTP/1.1 keeps the connection by default
+	r, _ := readResponse(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", "GET", 3)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Server asked to close
+	r, _ = readResponse(t, "HTTP/1.1 200 OK\r\nConnection: X-Private, close\r\nContent-Length: 2\r\n\r\nok", "GET", 3)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 needs keep-alive
+	r, _ = readResponse(t, "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok", "GET", 3)
+	assert.False(t, r.KeepAlive())
+	r, _ = readResponse(t, "HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nok", "GET", 3)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Body delimited by the connection closing
+	r, _ = readResponse(t, "HTTP/1.1 200 OK\r\n\r\nuntil the end", "GET", 3)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Body not read yet
+	r, err := ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"), "GET")
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Bytes past the end of the response
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1"), "GET")
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+}
+
+func TestResponseNext(t *testing.T) {
+	// Test: Pipelined responses
+	reader := &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nfirst" +
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nsecond\r\n0\r\n\r\n" +
+			"HTTP/1.1 204 No Content\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\n",
+		numBytesPerRead: 100,
+	}
+	r, err := ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(body))
+
+	r, err = r.Next("GET")
+	require.NoError(t, err)
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(body))
+
+	r, err = r.Next("GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(StatusNoContent), r.StatusLine.StatusCode)
+	assert.True(t, r.Done())
+
+	// Test: Response to HEAD has no body to skip
+	r, err = r.Next("HEAD")
+	require.NoError(t, err)
+	assert.True(t, r.Done())
+
+	// Test: Nothing more on the connection
+	_, err = r.Next("GET")
+	require.Error(t, err)
+	assert.Equal(t, "incomplete response", err.Error())
+
+	// Test: Response not read yet
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"), "GET")
+	require.NoError(t, err)
+	_, err = r.Next("GET")
+	require.Error(t, err)
+	assert.Equal(t, "response not read to its end", err.Error())
+}
+
+func TestDumpResponse(t *testing.T) {
+	// Test: Content-Length body
+	r, err := ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\ncontent-length: 5\r\nset-cookie: a=1\r\nset-cookie: b=2\r\n\r\nhello", numBytesPerRead: 3}, "GET")
+	require.NoError(t, err)
+	dump, err := DumpResponse(r, false)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n", string(dump))
+	dump, err = DumpResponse(r, true)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\nhello", string(dump))
+
+	// Test: Body still readable after the dump
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Chunked body with trailers
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 201 \r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"3\r\nabc\r\n"+
+		"3\r\ndef\r\n"+
+		"0\r\n"+
+		"X-Checksum: abc\r\n"+
+		"\r\n"), "POST")
+	require.NoError(t, err)
+	dump, err = DumpResponse(r, true)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 201\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nabcdef\r\n0\r\nX-Checksum: abc\r\n\r\n", string(dump))
+}
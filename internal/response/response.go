@@ -3,14 +3,53 @@ package response
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
 )
 
+// Writer builds a response and sends it to dst. The status line and headers are held back
+// until the first Flush or the final Finish, so the framing can still be picked based on
+// how the body was written: a body that's complete by Finish gets a Content-Length, a body
+// that's flushed while it's still being written is sent chunked.
 type Writer struct {
-	Buffer *bytes.Buffer
-	state  writerState
+	// ServerName is sent in the Server header unless the handler sets one itself.
+	ServerName string
+	// Request is the request being answered, nil when it couldn't be parsed.
+	Request *request.Request
+	// CloseConnection adds the close option to the Connection header, for a connection
+	// that won't carry another request after this response.
+	CloseConnection bool
+
+	dst      io.Writer
+	status   StatusCode
+	head     *bytes.Buffer
+	headers  headers.Headers
+	body     *bytes.Buffer
+	state    writerState
+	headSent bool
+	chunked  bool
+	// closeDelimited is set once chunks were written for a client that can't take chunked
+	// encoding, they're sent as they are and closing the connection ends the body
+	closeDelimited bool
+	finished       bool
+	hijacked       bool
+
+	trailerNames []string
+	trailers     headers.Headers
+
+	tees         []io.Writer
+	beforeHead   []func(complete bool)
+	beforeFinish []func()
+	headHooksRan bool
+
+	// discarded counts the body bytes dropped for a HEAD request, so the
+	// Content-Length still matches what a GET would have sent
+	discarded int
 }
 
 type writerState int
@@ -20,59 +59,194 @@ const (
 	writerStateWritingHeaders
 	writerStateWritingBody
 	writerStateWritingTrailers
+	writerStateDone
 )
 
 type StatusCode int
 
 const (
-	StatusOk                  = 200
-	StatusBadRequest          = 400
-	StatusInternalServerError = 500
+	StatusContinue                    = 100
+	StatusSwitchingProtocols          = 101
+	StatusEarlyHints                  = 103
+	StatusOk                          = 200
+	StatusCreated                     = 201
+	StatusAccepted                    = 202
+	StatusNoContent                   = 204
+	StatusPartialContent              = 206
+	StatusMovedPermanently            = 301
+	StatusFound                       = 302
+	StatusSeeOther                    = 303
+	StatusNotModified                 = 304
+	StatusTemporaryRedirect           = 307
+	StatusPermanentRedirect           = 308
+	StatusBadRequest                  = 400
+	StatusUnauthorized                = 401
+	StatusForbidden                   = 403
+	StatusNotFound                    = 404
+	StatusMethodNotAllowed            = 405
+	StatusProxyAuthenticationRequired = 407
+	StatusRequestTimeout              = 408
+	StatusConflict                    = 409
+	StatusGone                        = 410
+	StatusLengthRequired              = 411
+	StatusPreconditionFailed          = 412
+	StatusContentTooLarge             = 413
+	StatusURITooLong                  = 414
+	StatusUnsupportedMediaType        = 415
+	StatusExpectationFailed           = 417
+	StatusTeapot                      = 418
+	StatusUnprocessableContent        = 422
+	StatusUpgradeRequired             = 426
+	StatusTooManyRequests             = 429
+	StatusRequestHeaderFieldsTooLarge = 431
+	StatusInternalServerError         = 500
+	StatusNotImplemented              = 501
+	StatusBadGateway                  = 502
+	StatusServiceUnavailable          = 503
+	StatusGatewayTimeout              = 504
+	StatusHTTPVersionNotSupported     = 505
 )
 
+var statusText = map[StatusCode]string{
+	StatusContinue:                    "Continue",
+	StatusSwitchingProtocols:          "Switching Protocols",
+	StatusEarlyHints:                  "Early Hints",
+	StatusOk:                          "OK",
+	StatusCreated:                     "Created",
+	StatusAccepted:                    "Accepted",
+	StatusNoContent:                   "No Content",
+	StatusPartialContent:              "Partial Content",
+	StatusMovedPermanently:            "Moved Permanently",
+	StatusFound:                       "Found",
+	StatusSeeOther:                    "See Other",
+	StatusNotModified:                 "Not Modified",
+	StatusTemporaryRedirect:           "Temporary Redirect",
+	StatusPermanentRedirect:           "Permanent Redirect",
+	StatusBadRequest:                  "Bad Request",
+	StatusUnauthorized:                "Unauthorized",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusProxyAuthenticationRequired: "Proxy Authentication Required",
+	StatusRequestTimeout:              "Request Timeout",
+	StatusConflict:                    "Conflict",
+	StatusGone:                        "Gone",
+	StatusLengthRequired:              "Length Required",
+	StatusPreconditionFailed:          "Precondition Failed",
+	StatusContentTooLarge:             "Content Too Large",
+	StatusURITooLong:                  "URI Too Long",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusExpectationFailed:           "Expectation Failed",
+	StatusTeapot:                      "I'm a teapot",
+	StatusUnprocessableContent:        "Unprocessable Content",
+	StatusUpgradeRequired:             "Upgrade Required",
+	StatusTooManyRequests:             "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusInternalServerError:         "Internal Server Error",
+	StatusNotImplemented:              "Not Implemented",
+	StatusBadGateway:                  "Bad Gateway",
+	StatusServiceUnavailable:          "Service Unavailable",
+	StatusGatewayTimeout:              "Gateway Timeout",
+	StatusHTTPVersionNotSupported:     "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for a status code, empty for the ones we don't know.
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
+
 const crlf = "\r\n"
 const protocol = "HTTP/1.1"
 
-func NewWriter() *Writer {
-	return &Writer{Buffer: bytes.NewBuffer([]byte{}), state: writerStateInitialized}
+// DateFormat is the IMF-fixdate format from RFC 9110 used in the Date header.
+const DateFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+func NewWriter(dst io.Writer) *Writer {
+	return &Writer{
+		dst:   dst,
+		head:  bytes.NewBuffer([]byte{}),
+		body:  bytes.NewBuffer([]byte{}),
+		state: writerStateInitialized,
+	}
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	var statusLine string
-
-	switch statusCode {
-	case StatusOk:
-		statusLine = fmt.Sprintf("%s %d %s %s", protocol, StatusOk, "OK", crlf)
-	case StatusBadRequest:
-		statusLine = fmt.Sprintf("%s %d %s %s", protocol, StatusBadRequest, "Bad Request", crlf)
-	case StatusInternalServerError:
-		statusLine = fmt.Sprintf("%s %d %s %s", protocol, StatusInternalServerError, "Internal Server Error", crlf)
-	default:
+	if w.state != writerStateInitialized {
+		return fmt.Errorf("status line already written")
+	}
+
+	if statusCode < 200 {
+		return fmt.Errorf("informational status codes are sent with WriteInformational")
+	}
+
+	// the reason phrase is optional, any three digit code can be sent without one
+	if statusCode > 599 {
 		return fmt.Errorf("unknown status code")
 	}
+	text := statusText[statusCode]
+	statusLine := fmt.Sprintf("%s %d %s %s", protocol, statusCode, text, crlf)
 
-	_, err := w.Buffer.Write([]byte(statusLine))
+	_, err := w.head.Write([]byte(statusLine))
 	if err != nil {
 		return err
 	}
 
+	w.status = statusCode
 	w.state = writerStateWritingHeaders
 	return nil
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+// WriteInformational sends an interim 1xx response straight away, ahead of the final one.
+// HTTP/1.0 clients don't know about them, so nothing is sent to those.
+func (w *Writer) WriteInformational(statusCode StatusCode, h headers.Headers) error {
+	if w.headSent {
+		return fmt.Errorf("informational responses must come before the final response")
+	}
+
+	if statusCode < 100 || statusCode > 199 || statusCode == 101 {
+		return fmt.Errorf("%d is not an informational status code", statusCode)
+	}
+
+	text, ok := statusText[statusCode]
+	if !ok {
+		return fmt.Errorf("unknown status code")
+	}
+
+	err := validateHeaders(h)
+	if err != nil {
+		return err
+	}
+
+	if !w.http11Client() {
+		return nil
+	}
+
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("%s %d %s %s", protocol, statusCode, text, crlf))
+	for key, values := range h {
+		for _, value := range values {
+			b.WriteString(fmt.Sprintf("%s: %s%s", key, value, crlf))
+		}
+	}
+	b.WriteString(crlf)
+
+	_, err = w.dst.Write(b.Bytes())
+	return err
+}
+
+func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.state != writerStateWritingHeaders {
 		return fmt.Errorf("invalid writer status, write status line first")
 	}
 
-	for key, value := range headers {
-		_, err := w.Buffer.Write([]byte(fmt.Sprintf("%s: %s%s", key, value, crlf)))
-		if err != nil {
-			return err
-		}
+	err := validateHeaders(h)
+	if err != nil {
+		return err
 	}
 
-	_, err := w.Buffer.Write([]byte(crlf))
+	w.headers = h.Clone()
+
+	err = w.declareFromHeader()
 	if err != nil {
 		return err
 	}
@@ -87,66 +261,437 @@ func (w *Writer) WriteBody(bytes []byte) (int, error) {
 		return 0, fmt.Errorf("invalid writer status, write headers first")
 	}
 
-	return w.Buffer.Write(bytes)
+	if !w.bodyAllowed() && len(bytes) > 0 {
+		return 0, fmt.Errorf("a %d response can't have a body", w.status)
+	}
+
+	for _, tee := range w.tees {
+		tee.Write(bytes)
+	}
+
+	if w.isHead() {
+		w.discarded += len(bytes)
+		return len(bytes), nil
+	}
+
+	return w.body.Write(bytes)
 }
 
+// WriteChunkedBody frames p as a single chunk, the Transfer-Encoding header is added
+// for the handler if it didn't set one. HTTP/1.0 clients get the body delimited by closing
+// the connection instead, and a head that was sent with a Content-Length can't be followed
+// by chunks.
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.state != writerStateWritingBody {
 		return 0, fmt.Errorf("cannot write body in state %d", w.state)
 	}
-	chunkSize := len(p)
 
-	nTotal := 0
-	n, err := fmt.Fprintf(w.Buffer, "%x\r\n", chunkSize)
-	if err != nil {
-		return nTotal, err
+	if w.chunked || w.isHead() || !w.bodyAllowed() {
+		return w.WriteBody(p)
 	}
-	nTotal += n
 
-	n, err = w.Buffer.Write(p)
-	if err != nil {
-		return nTotal, err
+	if !w.http11Client() {
+		if !w.headSent {
+			w.headers.Delete("Content-Length")
+			w.headers.Delete("Transfer-Encoding")
+			w.headers.Set("Connection", "close")
+		}
+		w.closeDelimited = true
+
+		return w.WriteBody(p)
 	}
-	nTotal += n
 
-	n, err = w.Buffer.Write([]byte("\r\n"))
-	if err != nil {
-		return nTotal, err
+	if w.headSent {
+		_, hasContentLength := w.headers.Get("Content-Length")
+		if hasContentLength {
+			return 0, fmt.Errorf("headers already sent with a content-length")
+		}
 	}
-	nTotal += n
-	return nTotal, nil
+
+	if !w.headSent {
+		_, hasTransferEncoding := w.headers.Get("Transfer-Encoding")
+		if !hasTransferEncoding {
+			w.headers.Delete("Content-Length")
+			w.headers.Set("Transfer-Encoding", "chunked")
+		}
+	}
+
+	for _, tee := range w.tees {
+		tee.Write(p)
+	}
+
+	return writeChunk(w.body, p)
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.state != writerStateWritingBody {
 		return 0, fmt.Errorf("cannot write body in state %d", w.state)
 	}
-	n, err := w.Buffer.Write([]byte("0\r\n"))
-	if err != nil {
-		return n, err
+
+	if w.chunked {
+		err := w.Flush()
+		if err != nil {
+			return 0, err
+		}
+		w.chunked = false
 	}
+
 	w.state = writerStateWritingTrailers
+	if w.isHead() || w.closeDelimited {
+		return 0, nil
+	}
 
-	return n, nil
+	return w.body.Write([]byte("0\r\n"))
 }
 
-func (w *Writer) WriteTrailers(headers headers.Headers) error {
+func (w *Writer) WriteTrailers(h headers.Headers) error {
 	if w.state != writerStateWritingTrailers {
 		return fmt.Errorf("cannot write trailers in state %d", w.state)
 	}
 
-	for key, value := range headers {
-		_, err := w.Buffer.Write([]byte(fmt.Sprintf("%s: %s%s", key, value, crlf)))
+	for key := range h {
+		value, _ := h.Get(key)
+		err := w.SetTrailer(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !w.isHead() && !w.closeDelimited {
+		w.writeTrailerSection()
+	}
+	w.state = writerStateDone
+
+	return nil
+}
+
+// Flush sends everything written so far. The first flush commits the headers, if the
+// handler didn't frame the body itself it's sent chunked from here on, or delimited by
+// closing the connection for clients that don't understand chunked encoding.
+func (w *Writer) Flush() error {
+	if w.state == writerStateInitialized || w.state == writerStateWritingHeaders {
+		return fmt.Errorf("invalid writer status, write headers first")
+	}
+
+	if !w.headSent {
+		w.runHeadHooks(false)
+		w.frameForTrailers()
+
+		if !w.framedByHandler() && w.bodyAllowed() {
+			if w.http11Client() {
+				w.headers.Set("Transfer-Encoding", "chunked")
+				w.chunked = true
+			} else {
+				w.headers.Set("Connection", "close")
+			}
+		}
+
+		err := w.writeHead()
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.body.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if w.chunked {
+		_, err = writeChunk(w.dst, w.body.Bytes())
+	} else {
+		_, err = w.dst.Write(w.body.Bytes())
+	}
+	w.body.Reset()
+
+	return err
+}
+
+// Finish completes the response, the server calls it once the handler returns.
+func (w *Writer) Finish() error {
+	if w.finished {
+		return nil
+	}
+
+	if w.state == writerStateInitialized || w.state == writerStateWritingHeaders {
+		return fmt.Errorf("handler didn't write a response")
+	}
+
+	if !w.headSent {
+		w.runHeadHooks(true)
+	}
+
+	for _, fn := range w.beforeFinish {
+		fn()
+	}
+
+	if !w.headSent {
+		w.frameForTrailers()
+	}
+
+	if !w.headSent && !w.framedByHandler() && w.bodyAllowed() && !w.closeDelimited {
+		if len(w.trailerNames) > 0 && w.http11Client() {
+			w.headers.Set("Transfer-Encoding", "chunked")
+			w.chunked = true
+		} else {
+			w.headers.Set("Content-Length", strconv.Itoa(w.body.Len()+w.discarded))
+		}
+	}
+
+	if w.isHead() {
+		// a HEAD response ends with its headers whatever they say about the body
+		w.chunked = false
+		w.state = writerStateDone
+	}
+
+	if w.chunked {
+		err := w.Flush()
 		if err != nil {
 			return err
 		}
+
+		w.body.Write([]byte("0\r\n"))
+		w.writeTrailerSection()
+		w.chunked = false
+	} else if w.state == writerStateWritingTrailers && !w.closeDelimited {
+		// the last chunk was written but WriteTrailers wasn't called
+		w.writeTrailerSection()
 	}
 
-	_, err := w.Buffer.Write([]byte(crlf))
+	err := w.Flush()
 	if err != nil {
 		return err
 	}
 
+	w.state = writerStateDone
+	w.finished = true
+
+	return nil
+}
+
+// Reset drops whatever the handler wrote so another response can be written instead,
+// that's only possible while nothing has been sent yet.
+func (w *Writer) Reset() error {
+	if w.headSent {
+		return fmt.Errorf("response already sent")
+	}
+
+	w.head.Reset()
+	w.body.Reset()
+	w.discarded = 0
+	w.closeDelimited = false
+	w.headers = nil
+	w.trailerNames = nil
+	w.trailers = nil
+	w.tees = nil
+	w.beforeHead = nil
+	w.beforeFinish = nil
+	w.headHooksRan = false
+	w.state = writerStateInitialized
+
+	return nil
+}
+
+// SetHeader adds a header after WriteHeaders, as long as the headers weren't sent yet.
+func (w *Writer) SetHeader(name, value string) error {
+	if w.state < writerStateWritingBody {
+		return fmt.Errorf("invalid writer status, write headers first")
+	}
+
+	if w.headSent {
+		return fmt.Errorf("headers already sent")
+	}
+
+	h := headers.Headers{name: {value}}
+	err := validateHeaders(h)
+	if err != nil {
+		return err
+	}
+
+	w.headers.Delete(name)
+	w.headers.Set(name, value)
+
+	return nil
+}
+
+// TeeBody copies every body byte the handler writes to dst as well, including the ones
+// dropped for HEAD requests. It's meant for middleware that looks at the body as it streams.
+func (w *Writer) TeeBody(dst io.Writer) {
+	w.tees = append(w.tees, dst)
+}
+
+// BeforeHead registers fn to be called right before the headers are sent, complete tells
+// whether the whole body was written by then or the response is being streamed.
+func (w *Writer) BeforeHead(fn func(complete bool)) {
+	w.beforeHead = append(w.beforeHead, fn)
+}
+
+// BeforeFinish registers fn to be called once the handler is done writing the body,
+// right before the response is completed. Trailers can still be set from it.
+func (w *Writer) BeforeFinish(fn func()) {
+	w.beforeFinish = append(w.beforeFinish, fn)
+}
+
+func (w *Writer) runHeadHooks(complete bool) {
+	if w.headHooksRan {
+		return
+	}
+	w.headHooksRan = true
+
+	for _, fn := range w.beforeHead {
+		fn(complete)
+	}
+}
+
+// HeadSent reports whether the status line and headers went out already.
+func (w *Writer) HeadSent() bool {
+	return w.headSent
+}
+
+// bodyAllowed is false for the status codes that end the response with the headers
+func (w *Writer) bodyAllowed() bool {
+	// a 2xx to CONNECT turns the connection into a tunnel, what follows isn't a body
+	// and the response mustn't claim otherwise with Content-Length or Transfer-Encoding
+	if w.Request != nil && w.Request.RequestLine.Method == "CONNECT" && w.status >= 200 && w.status < 300 {
+		return false
+	}
+
+	return w.status != StatusNoContent && w.status != StatusNotModified
+}
+
+func (w *Writer) isHead() bool {
+	return w.Request != nil && w.Request.RequestLine.Method == "HEAD"
+}
+
+// frameForTrailers makes room for declared trailers, they can only follow a chunked body.
+// A Content-Length the handler set gives way to chunked framing for clients that can take
+// it, for the others the trailers are dropped instead of being announced and never sent.
+func (w *Writer) frameForTrailers() {
+	if len(w.trailerNames) == 0 || w.isHead() || !w.bodyAllowed() {
+		return
+	}
+
+	_, hasTransferEncoding := w.headers.Get("Transfer-Encoding")
+	if hasTransferEncoding {
+		return
+	}
+
+	if w.http11Client() {
+		w.headers.Delete("Content-Length")
+	} else {
+		w.trailerNames = nil
+	}
+}
+
+func (w *Writer) framedByHandler() bool {
+	_, hasContentLength := w.headers.Get("Content-Length")
+	_, hasTransferEncoding := w.headers.Get("Transfer-Encoding")
+
+	return hasContentLength || hasTransferEncoding
+}
+
+func (w *Writer) addCloseOption() {
+	connection, ok := w.headers.Get("Connection")
+	if !ok {
+		w.headers.Set("Connection", "close")
+		return
+	}
+
+	for _, option := range strings.Split(connection, ",") {
+		if strings.EqualFold(strings.TrimSpace(option), "close") {
+			return
+		}
+	}
+
+	w.headers.Delete("Connection")
+	w.headers.Set("Connection", connection+", close")
+}
+
+func (w *Writer) http11Client() bool {
+	return w.Request == nil || w.Request.RequestLine.HttpVersion == "1.1"
+}
+
+func (w *Writer) writeHead() error {
+	_, hasDate := w.headers.Get("Date")
+	if !hasDate {
+		w.headers.Set("Date", time.Now().UTC().Format(DateFormat))
+	}
+
+	if len(w.trailerNames) > 0 {
+		w.headers.Set("Trailer", strings.Join(w.trailerNames, ", "))
+	}
+
+	_, hasServer := w.headers.Get("Server")
+	if !hasServer && w.ServerName != "" {
+		w.headers.Set("Server", w.ServerName)
+	}
+
+	if w.CloseConnection {
+		w.addCloseOption()
+	}
+
+	for key, values := range w.headers {
+		for _, value := range values {
+			_, err := w.head.Write([]byte(fmt.Sprintf("%s: %s%s", key, value, crlf)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := w.head.Write([]byte(crlf))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.dst.Write(w.head.Bytes())
+	if err != nil {
+		return err
+	}
+
+	w.headSent = true
+	return nil
+}
+
+func writeChunk(dst io.Writer, p []byte) (int, error) {
+	chunkSize := len(p)
+
+	nTotal := 0
+	n, err := fmt.Fprintf(dst, "%x\r\n", chunkSize)
+	if err != nil {
+		return nTotal, err
+	}
+	nTotal += n
+
+	n, err = dst.Write(p)
+	if err != nil {
+		return nTotal, err
+	}
+	nTotal += n
+
+	n, err = dst.Write([]byte("\r\n"))
+	if err != nil {
+		return nTotal, err
+	}
+	nTotal += n
+	return nTotal, nil
+}
+
+// validateHeaders checks every value of every field before anything is written, so a
+// handler reflecting user input into a header can't end up with half a response on the wire.
+func validateHeaders(h headers.Headers) error {
+	for key, values := range h {
+		if !headers.ValidFieldName(key) {
+			return fmt.Errorf("invalid header name %q", key)
+		}
+
+		for _, value := range values {
+			if !headers.ValidFieldValue(value) {
+				return fmt.Errorf("invalid value for header %s", key)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,427 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterValidation(t *testing.T) {
+	// Test: Injected header is rejected before anything is written
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	h := headers.NewHeaders()
+	h.Set("Location", "/\r\nSet-Cookie: session=stolen")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	err := w.WriteHeaders(h)
+	require.Error(t, err)
+	assert.Equal(t, "invalid value for header Location", err.Error())
+	assert.NotContains(t, buf.String(), "stolen")
+
+	// Test: Invalid header name is rejected
+	w = NewWriter(&bytes.Buffer{})
+	h = headers.NewHeaders()
+	h.Set("X Forwarded", "1")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	err = w.WriteHeaders(h)
+	require.Error(t, err)
+	assert.Equal(t, `invalid header name "X Forwarded"`, err.Error())
+
+	// Test: A line feed in a Set-Cookie value can't forge another cookie
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	h = headers.NewHeaders()
+	h.Add("Set-Cookie", "a=1")
+	h.Add("Set-Cookie", "pref=x\nsession=evil")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	err = w.WriteHeaders(h)
+	require.Error(t, err)
+	assert.Equal(t, "invalid value for header Set-Cookie", err.Error())
+	h = headers.NewHeaders()
+	h.Set("Set-Cookie", "pref=x\nsession=evil")
+	err = w.WriteHeaders(h)
+	require.Error(t, err)
+	assert.NotContains(t, buf.String(), "evil")
+
+	// Test: Every Set-Cookie value is a field of its own
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	h = headers.NewHeaders()
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	h.Add("Set-Cookie", "b=2")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "\r\nSet-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\nSet-Cookie: b=2\r\n")
+}
+
+func TestWriterFraming(t *testing.T) {
+	// Test: Complete body gets a content length
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.ServerName = "httpfromtcp"
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, buf.Len())
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK \r\n"))
+	assert.Contains(t, out, "Content-Length: 5\r\n")
+	assert.Contains(t, out, "Server: httpfromtcp\r\n")
+	assert.Contains(t, out, "Date: ")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+
+	// Test: Handler provided headers are kept
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	h := headers.NewHeaders()
+	h.Set("Date", "Tue, 01 Apr 2025 00:00:00 GMT")
+	h.Set("Server", "teapot")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	out = buf.String()
+	assert.Contains(t, out, "Date: Tue, 01 Apr 2025 00:00:00 GMT\r\n")
+	assert.Contains(t, out, "Server: teapot\r\n")
+	assert.Contains(t, out, "Content-Length: 0\r\n")
+
+	// Test: Flushed body is switched to chunked
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.WriteBody([]byte("hello "))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.NotContains(t, buf.String(), "Content-Length")
+	_, err = w.WriteBody([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n"))
+
+	// Test: Flushed body for an HTTP/1.0 client is delimited by closing
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.Request = &request.Request{RequestLine: request.RequestLine{HttpVersion: "1.0"}}
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+	assert.NotContains(t, buf.String(), "Transfer-Encoding")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+
+	// Test: Explicitly chunked body with trailers
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	h = headers.NewHeaders()
+	h.Set("Trailer", "X-Content-Length")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-Length", "5")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.Contains(t, buf.String(), "Trailer: X-Content-Length\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\nX-Content-Length: 5\r\n\r\n"))
+
+	// Test: Explicitly chunked body for an HTTP/1.0 client is delimited by closing
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.Request = &request.Request{RequestLine: request.RequestLine{HttpVersion: "1.0"}}
+	h = headers.NewHeaders()
+	h.Set("Content-Length", "10")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+	assert.NotContains(t, buf.String(), "Transfer-Encoding")
+	assert.NotContains(t, buf.String(), "Content-Length")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhelloworld"))
+
+	// Test: Chunks can't follow a head that was sent with a content length
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	h = headers.NewHeaders()
+	h.Set("Content-Length", "10")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.EqualError(t, err, "headers already sent with a content-length")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+
+	// Test: Nothing is sent for an unfinished response and it can be replaced
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Reset())
+	require.NoError(t, w.WriteStatusLine(StatusInternalServerError))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 500 Internal Server Error \r\n"))
+}
+
+func TestWriterHead(t *testing.T) {
+	// Test: Body is dropped but the content length is kept
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Request = &request.Request{RequestLine: request.RequestLine{Method: "HEAD", HttpVersion: "1.1"}}
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	n, err := w.WriteBody([]byte("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, 11, n)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Content-Length: 11\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+
+	// Test: Chunked body and trailers are dropped
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.Request = &request.Request{RequestLine: request.RequestLine{Method: "HEAD", HttpVersion: "1.1"}}
+	h := headers.NewHeaders()
+	h.Set("Trailer", "X-Content-Length")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-Length", "5")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+	assert.NotContains(t, buf.String(), "hello")
+	assert.NotContains(t, buf.String(), "X-Content-Length: 5")
+}
+
+func TestWriterCloseConnection(t *testing.T) {
+	// Test: Close option is added
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.CloseConnection = true
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+
+	// Test: Close option joins the ones the handler set
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.CloseConnection = true
+	h := headers.NewHeaders()
+	h.Set("Connection", "X-Private")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Connection: X-Private, close\r\n")
+
+}
+
+func TestWriterInformational(t *testing.T) {
+	// Test: Early hints go out ahead of the final response
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	hints := headers.NewHeaders()
+	hints.Set("Link", "</style.css>; rel=preload; as=style")
+	require.NoError(t, w.WriteInformational(StatusEarlyHints, hints))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints \r\nLink: </style.css>; rel=preload; as=style\r\n\r\n", buf.String())
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "\r\n\r\nHTTP/1.1 200 OK \r\n")
+
+	// Test: Not an informational status code
+	w = NewWriter(&bytes.Buffer{})
+	err := w.WriteInformational(StatusOk, nil)
+	require.Error(t, err)
+	assert.Equal(t, "200 is not an informational status code", err.Error())
+
+	// Test: Informational status code as the final one
+	w = NewWriter(&bytes.Buffer{})
+	require.Error(t, w.WriteStatusLine(StatusContinue))
+
+	// Test: Too late once the final response was sent
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Flush())
+	require.Error(t, w.WriteInformational(StatusContinue, nil))
+
+	// Test: Nothing is sent to HTTP/1.0 clients
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.Request = &request.Request{RequestLine: request.RequestLine{HttpVersion: "1.0"}}
+	require.NoError(t, w.WriteInformational(StatusContinue, nil))
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestWriterTrailers(t *testing.T) {
+	trailersRequest := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", HttpVersion: "1.1"},
+		Headers:     headers.Headers{"te": {"trailers"}},
+	}
+
+	// Test: Declared trailers are sent after the final chunk
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Request = trailersRequest
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.DeclareTrailer("X-Checksum"))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.SetTrailer("X-Checksum", "abc"))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Trailer: X-Checksum\r\n")
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.NotContains(t, buf.String(), "Content-Length")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\nX-Checksum: abc\r\n\r\n"))
+
+	// Test: Trailer set while streaming
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.Request = trailersRequest
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.DeclareTrailer("X-Checksum"))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.SetTrailer("X-Checksum", "abc"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\nX-Checksum: abc\r\n\r\n"))
+
+	// Test: Declaring after the headers were sent
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Flush())
+	err = w.DeclareTrailer("X-Checksum")
+	require.Error(t, err)
+	assert.Equal(t, "trailers must be declared before the headers are sent", err.Error())
+
+	// Test: Undeclared trailer
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	err = w.SetTrailer("X-Checksum", "abc")
+	require.Error(t, err)
+	assert.Equal(t, "trailer X-Checksum wasn't declared", err.Error())
+
+	// Test: Forbidden trailer
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	err = w.DeclareTrailer("Content-Length")
+	require.Error(t, err)
+	assert.Equal(t, "Content-Length can't be sent as a trailer", err.Error())
+
+	// Test: Forbidden trailer in the Trailer header
+	w = NewWriter(&bytes.Buffer{})
+	h := headers.NewHeaders()
+	h.Set("Trailer", "X-Checksum, Host")
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	err = w.WriteHeaders(h)
+	require.Error(t, err)
+	assert.Equal(t, "Host can't be sent as a trailer", err.Error())
+
+	// Test: Trailers are dropped for clients that didn't ask for them
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.Request = &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.DeclareTrailer("X-Checksum"))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.SetTrailer("X-Checksum", "abc"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+}
+
+func TestWriterHijack(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("GET /chat HTTP/1.1\r\nHost: localhost\r\nUpgrade: chat\r\n\r\nhello"))
+
+	req, err := request.HeadFromReader(conn)
+	require.NoError(t, err)
+
+	// Test: Unsent response is dropped and the reader starts with what the client sent past the request
+	w := NewWriter(conn)
+	w.Request = req
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	hijacked, reader, err := w.Hijack()
+	require.NoError(t, err)
+	assert.True(t, w.Hijacked())
+	assert.Equal(t, conn, hijacked)
+
+	data := make([]byte, 5)
+	_, err = io.ReadFull(reader, data)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// Test: The writer is done with the connection
+	require.NoError(t, w.Finish())
+	_, err = w.WriteBody([]byte("nope"))
+	require.Error(t, err)
+	_, _, err = w.Hijack()
+	require.Error(t, err)
+
+	go hijacked.Write([]byte("hi"))
+	data = make([]byte, 2)
+	_, err = io.ReadFull(client, data)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+
+	// Test: Not after the headers were sent
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	go io.Copy(io.Discard, client)
+	require.NoError(t, w.Flush())
+	_, _, err = w.Hijack()
+	require.Error(t, err)
+
+	// Test: Not without a connection underneath
+	w = NewWriter(&bytes.Buffer{})
+	_, _, err = w.Hijack()
+	require.Error(t, err)
+}
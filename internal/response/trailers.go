@@ -0,0 +1,160 @@
+package response
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+)
+
+// forbiddenTrailers can't be sent after the body, recipients need them to frame, route,
+// authenticate or process the message before they get to the end of it (RFC 9110 section 6.5.1)
+var forbiddenTrailers = []string{
+	"age",
+	"authorization",
+	"cache-control",
+	"connection",
+	"content-encoding",
+	"content-length",
+	"content-range",
+	"content-type",
+	"date",
+	"expect",
+	"expires",
+	"host",
+	"keep-alive",
+	"location",
+	"max-forwards",
+	"pragma",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"range",
+	"retry-after",
+	"set-cookie",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+	"vary",
+	"www-authenticate",
+}
+
+// DeclareTrailer announces the trailer fields in the Trailer header, so it has to be called
+// before the headers are sent. A response with trailers is always sent chunked.
+func (w *Writer) DeclareTrailer(names ...string) error {
+	if w.headSent {
+		return fmt.Errorf("trailers must be declared before the headers are sent")
+	}
+
+	for _, name := range names {
+		err := checkTrailerName(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if !w.trailerDeclared(name) {
+			w.trailerNames = append(w.trailerNames, name)
+		}
+	}
+
+	return nil
+}
+
+// SetTrailer sets the value of a declared trailer, it can be called at any point until
+// the response is finished and the last value set is the one sent after the final chunk.
+func (w *Writer) SetTrailer(name, value string) error {
+	if w.finished || w.state == writerStateDone {
+		return fmt.Errorf("response already finished")
+	}
+
+	if !w.trailerDeclared(name) {
+		return fmt.Errorf("trailer %s wasn't declared", name)
+	}
+
+	if !headers.ValidFieldValue(value) {
+		return fmt.Errorf("invalid value for trailer %s", name)
+	}
+
+	if w.trailers == nil {
+		w.trailers = headers.NewHeaders()
+	}
+	w.trailers.Delete(name)
+	w.trailers.Set(name, value)
+
+	return nil
+}
+
+// TrailersAccepted reports whether the client said it can handle trailers with TE: trailers,
+// trailers aren't sent to the ones that didn't.
+func (w *Writer) TrailersAccepted() bool {
+	if w.Request == nil {
+		return true
+	}
+
+	te, ok := w.Request.Headers.Get("TE")
+	if !ok {
+		return false
+	}
+
+	for _, coding := range strings.Split(te, ",") {
+		coding, _, _ = strings.Cut(coding, ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// declareFromHeader picks up trailers a handler declared by setting the Trailer header itself.
+func (w *Writer) declareFromHeader() error {
+	declared, ok := w.headers.Get("Trailer")
+	if !ok {
+		return nil
+	}
+	w.headers.Delete("Trailer")
+
+	names := []string{}
+	for _, name := range strings.Split(declared, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return w.DeclareTrailer(names...)
+}
+
+func (w *Writer) trailerDeclared(name string) bool {
+	return slices.ContainsFunc(w.trailerNames, func(declared string) bool {
+		return strings.EqualFold(declared, name)
+	})
+}
+
+// writeTrailerSection ends a chunked body, the last chunk has to be written already.
+func (w *Writer) writeTrailerSection() {
+	if w.TrailersAccepted() {
+		for key, values := range w.trailers {
+			for _, value := range values {
+				w.body.Write([]byte(fmt.Sprintf("%s: %s%s", key, value, crlf)))
+			}
+		}
+	}
+
+	w.body.Write([]byte(crlf))
+}
+
+func checkTrailerName(name string) error {
+	if !headers.ValidFieldName(name) {
+		return fmt.Errorf("invalid trailer name %q", name)
+	}
+
+	if slices.Contains(forbiddenTrailers, strings.ToLower(name)) {
+		return fmt.Errorf("%s can't be sent as a trailer", name)
+	}
+
+	return nil
+}
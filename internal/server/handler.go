@@ -2,6 +2,8 @@ package server
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/magicznykacpur/httpfromtcp/internal/headers"
 	"github.com/magicznykacpur/httpfromtcp/internal/request"
@@ -14,9 +16,9 @@ type HandlerError struct {
 	Body       []byte
 }
 
-type Handler func(response.Writer, *request.Request) *HandlerError
+type Handler func(*response.Writer, *request.Request) *HandlerError
 
-func (hr *HandlerError) WriteError(w response.Writer) error {
+func (hr *HandlerError) WriteError(w *response.Writer) error {
 	err := w.WriteStatusLine(hr.StatusCode)
 	if err != nil {
 		return fmt.Errorf("couldn't write status line for handler error")
@@ -34,3 +36,40 @@ func (hr *HandlerError) WriteError(w response.Writer) error {
 
 	return nil
 }
+
+// ByMethod dispatches to the handler registered for the request method. HEAD requests
+// fall back to the GET handler when there's no HEAD one, the response writer drops
+// the body for them so only the status line and headers go out.
+func ByMethod(handlers map[string]Handler) Handler {
+	return func(w *response.Writer, r *request.Request) *HandlerError {
+		handler, ok := handlers[r.RequestLine.Method]
+		if !ok && r.RequestLine.Method == "HEAD" {
+			handler, ok = handlers["GET"]
+		}
+
+		if !ok {
+			allowed := make([]string, 0, len(handlers))
+			for method := range handlers {
+				allowed = append(allowed, method)
+			}
+			if _, hasGet := handlers["GET"]; hasGet {
+				if _, hasHead := handlers["HEAD"]; !hasHead {
+					allowed = append(allowed, "HEAD")
+				}
+			}
+			slices.Sort(allowed)
+
+			errorHeaders := headers.NewHeaders()
+			errorHeaders.Set("Content-Type", "text/plain")
+			errorHeaders.Set("Allow", strings.Join(allowed, ", "))
+
+			return &HandlerError{
+				StatusCode: response.StatusMethodNotAllowed,
+				Headers:    errorHeaders,
+				Body:       []byte("method not allowed"),
+			}
+		}
+
+		return handler(w, r)
+	}
+}
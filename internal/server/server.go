@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"strings"
 	"sync/atomic"
+	"time"
 
+	"github.com/magicznykacpur/httpfromtcp/internal/capture"
+	"github.com/magicznykacpur/httpfromtcp/internal/har"
 	"github.com/magicznykacpur/httpfromtcp/internal/headers"
 	"github.com/magicznykacpur/httpfromtcp/internal/request"
 	"github.com/magicznykacpur/httpfromtcp/internal/response"
@@ -14,24 +21,90 @@ type Server struct {
 	listener net.Listener
 	isClosed atomic.Bool
 	handler  Handler
+	name     string
+	timeout  time.Duration
+	capture  *capture.Recorder
+	har      *har.Recorder
+	// harFull is set once a full archive has been reported, so it's logged only once
+	harFull atomic.Bool
+
+	// ctx is the parent of every request's context, it's cancelled when the server closes
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type Option func(*Server)
+
+// WithServerName sets the value of the Server header added to every response,
+// an empty name leaves the header out.
+func WithServerName(name string) Option {
+	return func(s *Server) {
+		s.name = name
+	}
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+// WithRequestTimeout cancels the context of a request that's still being handled after timeout.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.timeout = timeout
+	}
+}
+
+// WithCapture records the bytes of every connection to recorder, for replaying them later.
+func WithCapture(recorder *capture.Recorder) Option {
+	return func(s *Server) {
+		s.capture = recorder
+	}
+}
+
+// WithHAR adds an entry to recorder's archive for every request once it's answered,
+// requests that couldn't be parsed are left out.
+func WithHAR(recorder *har.Recorder) Option {
+	return func(s *Server) {
+		s.har = recorder
+	}
+}
+
+const defaultServerName = "httpfromtcp"
+
+// recordHAR adds the exchange on conn to the archive, failing to doesn't affect the response
+// that's already been sent so it's only logged
+func (s *Server) recordHAR(conn *har.Conn, req *request.Request) {
+	err := conn.Record(req)
+	if errors.Is(err, har.ErrFull) {
+		if s.harFull.CompareAndSwap(false, true) {
+			log.Printf("har file is full, requests are no longer added to it")
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording request to har file: %v", err)
+	}
+}
+
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, fmt.Errorf("couldn't open listener on port %d: %v", port, err)
 	}
 
-	server := &Server{listener: listener, isClosed: atomic.Bool{}, handler: handler}
+	server := &Server{listener: listener, isClosed: atomic.Bool{}, handler: handler, name: defaultServerName}
 	server.isClosed.Store(false)
+	server.ctx, server.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(server)
+	}
 
 	go server.listen()
 
 	return server, nil
 }
 
+// Close stops accepting connections and cancels the requests that are still being handled.
 func (s *Server) Close() error {
 	s.isClosed.Store(true)
+	s.cancel()
 	err := s.listener.Close()
 	if err != nil {
 		return fmt.Errorf("couldn't close listener: %v", err)
@@ -40,6 +113,11 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Addr is the address the server listens on, useful when it was started on port 0.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
 func (s *Server) listen() {
 	for {
 		conn, err := s.listener.Accept()
@@ -55,35 +133,137 @@ func (s *Server) listen() {
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+func (s *Server) handle(netConn net.Conn) {
+	if s.capture != nil {
+		netConn = s.capture.Wrap(netConn)
+	}
+
+	var harConn *har.Conn
+	if s.har != nil {
+		harConn = s.har.Wrap(netConn)
+		netConn = harConn
+	}
+
+	conn := newWatchedConn(netConn)
+	resWriter := response.NewWriter(conn)
+	resWriter.ServerName = s.name
+	// every connection ends with its first response, clients are told so they don't wait for more
+	resWriter.CloseConnection = true
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if s.timeout > 0 {
+		ctx, cancel = context.WithTimeout(s.ctx, s.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(s.ctx)
+	}
+	defer cancel()
+
+	defer func() {
+		// a hijacked connection is the handler's to close
+		if !resWriter.Hijacked() {
+			conn.Close()
+		}
+	}()
 
-	resWriter := response.NewWriter()
-	req, err := request.RequestFromReader(conn)
+	req, err := s.readRequest(conn, resWriter)
 	if err != nil {
+		// a request we couldn't frame leaves the connection in an unknown state,
+		// whatever follows on it must not be read as another request
 		errorHeaders := headers.NewHeaders()
 		errorHeaders.Set("Content-Type", "text/plain")
+		errorHeaders.Set("Connection", "close")
 
 		hErr := &HandlerError{
 			StatusCode: response.StatusBadRequest,
 			Body:       []byte(err.Error()),
 			Headers:    errorHeaders,
 		}
-		hErr.WriteError(*resWriter)
+		hErr.WriteError(resWriter)
+		resWriter.Finish()
+		return
+	}
+	resWriter.Request = req
+	req.SetContext(ctx)
+
+	if harConn != nil {
+		harConn.RequestRead()
+		// deferred after the close so it runs first, with everything written
+		defer s.recordHAR(harConn, req)
+	}
+
+	// the client has nothing more to send until it gets the response, unless the handler
+	// reads a body that was held back or takes the connection over, either stops the watch
+	conn.watch(cancel)
+
+	expect, ok := req.Headers.Get("Expect")
+	if ok && req.RequestLine.HttpVersion == "1.1" && !strings.EqualFold(expect, "100-continue") {
+		errorHeaders := headers.NewHeaders()
+		errorHeaders.Set("Content-Type", "text/plain")
+		errorHeaders.Set("Connection", "close")
+
+		hErr := &HandlerError{
+			StatusCode: response.StatusExpectationFailed,
+			Body:       []byte("unsupported expectation"),
+			Headers:    errorHeaders,
+		}
+		hErr.WriteError(resWriter)
+		resWriter.Finish()
+		return
+	}
+
+	handlerErr := s.handler(resWriter, req)
+	if resWriter.Hijacked() {
 		return
 	}
 
-	handlerErr := s.handler(*resWriter, req)
 	if handlerErr != nil {
-		err = handlerErr.WriteError(*resWriter)
+		// once the head is out there's no way to swap in the error response,
+		// closing the connection is the only signal left for the client
+		err = resWriter.Reset()
+		if err != nil {
+			return
+		}
+
+		err = handlerErr.WriteError(resWriter)
 		if err != nil {
 			conn.Write([]byte(err.Error()))
 			return
 		}
+	}
 
-		conn.Write(resWriter.Buffer.Bytes())
-		return
+	resWriter.Finish()
+}
+
+// readRequest reads the whole request up front, unless the client asked to hear back
+// before sending the body. Then the body is left for the handler to read and the
+// 100 Continue goes out the first time it does, a handler that rejects the request
+// without reading it spares the client the upload.
+func (s *Server) readRequest(conn net.Conn, w *response.Writer) (*request.Request, error) {
+	req, err := request.HeadFromReader(conn)
+	if err != nil {
+		return nil, err
 	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.LocalAddr = conn.LocalAddr().String()
+
+	expect, _ := req.Headers.Get("Expect")
+	if !strings.EqualFold(expect, "100-continue") {
+		_, err = req.ReadBody()
+		if err != nil {
+			return nil, err
+		}
+
+		return req, nil
+	}
+
+	req.BeforeBodyRead(func() error {
+		if w.HeadSent() {
+			return nil
+		}
+
+		return w.WriteInformational(response.StatusContinue, nil)
+	})
 
-	conn.Write(resWriter.Buffer.Bytes())
+	return req, nil
 }
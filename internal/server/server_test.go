@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/capture"
+	"github.com/magicznykacpur/httpfromtcp/internal/har"
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler Handler, opts ...Option) (*Server, string) {
+	s, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s, fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+func writeText(w *response.Writer, text string) *HandlerError {
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteBody([]byte(text))
+	return nil
+}
+
+// waitForCancel answers with the reason the request's context ended
+func waitForCancel(cancelled chan error) Handler {
+	return func(w *response.Writer, r *request.Request) *HandlerError {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+
+		cancelled <- r.Context().Err()
+		return writeText(w, fmt.Sprint(r.Context().Err()))
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	// Test: Client going away cancels the request
+	cancelled := make(chan error, 1)
+	_, addr := startServer(t, waitForCancel(cancelled))
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	conn.Close()
+	assert.Equal(t, context.Canceled, <-cancelled)
+
+	// Test: Request timeout
+	_, addr = startServer(t, waitForCancel(cancelled), WithRequestTimeout(20*time.Millisecond))
+	res, err := http.Get("http://" + addr + "/")
+	require.NoError(t, err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, context.DeadlineExceeded, <-cancelled)
+	assert.Equal(t, "context deadline exceeded", string(data))
+
+	// Test: Server shutting down
+	s, addr := startServer(t, waitForCancel(cancelled))
+	go http.Get("http://" + addr + "/")
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	assert.Equal(t, context.Canceled, <-cancelled)
+}
+
+func TestRequestContextKeepsBody(t *testing.T) {
+	// Test: A held back body is still read whole once the watch is on
+	_, addr := startServer(t, func(w *response.Writer, r *request.Request) *HandlerError {
+		body, err := r.ReadBody()
+		if err != nil {
+			return &HandlerError{StatusCode: response.StatusBadRequest, Headers: headers.NewHeaders(), Body: []byte(err.Error())}
+		}
+
+		return writeText(w, fmt.Sprintf("%s %v", body, r.Context().Err()))
+	})
+
+	req, err := http.NewRequest("POST", "http://"+addr+"/", strings.NewReader("hello world"))
+	require.NoError(t, err)
+	req.Header.Set("Expect", "100-continue")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "hello world <nil>", string(data))
+}
+
+func TestRequestAddrs(t *testing.T) {
+	_, addr := startServer(t, func(w *response.Writer, r *request.Request) *HandlerError {
+		return writeText(w, r.RemoteAddr+" "+r.LocalAddr)
+	})
+
+	res, err := http.Get("http://" + addr + "/")
+	require.NoError(t, err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	remote, local, _ := strings.Cut(string(data), " ")
+	assert.True(t, strings.HasPrefix(remote, "127.0.0.1:"))
+	assert.Equal(t, addr, local)
+}
+
+// lockedBuffer is read by the test while the server may still be writing to it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Read(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCapture(t *testing.T) {
+	captured := &lockedBuffer{}
+	_, addr := startServer(t, func(w *response.Writer, r *request.Request) *HandlerError {
+		return writeText(w, "captured")
+	}, WithCapture(capture.NewRecorder(captured)))
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET /first HTTP/1.1\r\nHost: ")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = io.WriteString(conn, "localhost\r\n\r\n")
+	require.NoError(t, err)
+	sent, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	// Test: Both directions of the connection are recorded
+	conns, err := capture.ReadConns(captured)
+	require.NoError(t, err)
+	require.Len(t, conns, 1)
+	assert.Equal(t, uint64(1), conns[0].ID)
+	assert.Equal(t, conn.LocalAddr().String(), conns[0].Remote)
+	assert.Equal(t, "GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n", string(conns[0].Inbound()))
+	assert.Equal(t, string(sent), string(conns[0].Outbound()))
+	assert.False(t, conns[0].Closed.IsZero())
+}
+
+func TestHAR(t *testing.T) {
+	harFile, err := os.CreateTemp(t.TempDir(), "*.har")
+	require.NoError(t, err)
+	defer harFile.Close()
+	recorder, err := har.NewRecorder(harFile)
+	require.NoError(t, err)
+
+	_, addr := startServer(t, func(w *response.Writer, r *request.Request) *HandlerError {
+		return writeText(w, "archived")
+	}, WithHAR(recorder))
+
+	send := func(raw string) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = io.WriteString(conn, raw)
+		require.NoError(t, err)
+		// a rejected request can end in a reset, the server is done with it either way
+		io.ReadAll(conn)
+	}
+
+	// Test: Answered requests are archived, ones that didn't parse are left out
+	send("GET /archived?page=2 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send("NOT A REQUEST\r\n\r\n")
+
+	data, err := os.ReadFile(harFile.Name())
+	require.NoError(t, err)
+	var archive struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					URL string `json:"url"`
+				} `json:"request"`
+				Response struct {
+					Status  int `json:"status"`
+					Content struct {
+						Text string `json:"text"`
+					} `json:"content"`
+				} `json:"response"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	require.NoError(t, json.Unmarshal(data, &archive))
+	require.Len(t, archive.Log.Entries, 1)
+	assert.Equal(t, "http://localhost/archived?page=2", archive.Log.Entries[0].Request.URL)
+	assert.Equal(t, 200, archive.Log.Entries[0].Response.Status)
+	assert.Equal(t, "archived", archive.Log.Entries[0].Response.Content.Text)
+}
+
+func TestHARFull(t *testing.T) {
+	logged := &lockedBuffer{}
+	log.SetOutput(logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	harFile, err := os.CreateTemp(t.TempDir(), "*.har")
+	require.NoError(t, err)
+	defer harFile.Close()
+	recorder, err := har.NewRecorder(harFile, har.WithMaxFileSize(256))
+	require.NoError(t, err)
+
+	_, addr := startServer(t, func(w *response.Writer, r *request.Request) *HandlerError {
+		return writeText(w, "not archived")
+	}, WithHAR(recorder))
+
+	// Test: A full archive is logged once, the requests are still answered
+	for range 3 {
+		res, err := http.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "not archived", string(body))
+	}
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(logged.String(), "har file is full")
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, strings.Count(logged.String(), "har file is full"))
+}
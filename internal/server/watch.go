@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// watchedConn notices a client that goes away while its request is being handled.
+// Nothing is expected from the client then, so a read is kept waiting in the background
+// and the end of the connection showing up there cancels the request. The first Read
+// from anyone else stops the watch, whatever it picked up is handed over first.
+type watchedConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	watching bool
+	stopping bool
+	done     chan struct{}
+	pending  []byte
+	err      error
+}
+
+func newWatchedConn(conn net.Conn) *watchedConn {
+	return &watchedConn{Conn: conn}
+}
+
+// watch starts the background read, onClose is called when it finds the connection closed
+func (c *watchedConn) watch(onClose func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watching || c.err != nil || len(c.pending) > 0 {
+		return
+	}
+
+	c.watching = true
+	c.stopping = false
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+
+		buf := make([]byte, 1)
+		n, err := c.Conn.Read(buf)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.pending = append(c.pending, buf[:n]...)
+
+		// the deadline set by stop isn't the connection's doing
+		if err != nil && !(c.stopping && errors.Is(err, os.ErrDeadlineExceeded)) {
+			c.err = err
+			onClose()
+		}
+	}()
+}
+
+// stop ends the background read and waits for it to return
+func (c *watchedConn) stop() {
+	c.mu.Lock()
+	if !c.watching {
+		c.mu.Unlock()
+		return
+	}
+	c.stopping = true
+	done := c.done
+	c.mu.Unlock()
+
+	c.Conn.SetReadDeadline(time.Now())
+	<-done
+	c.Conn.SetReadDeadline(time.Time{})
+
+	c.mu.Lock()
+	c.watching = false
+	c.mu.Unlock()
+}
+
+// CloseWrite half closes the connection underneath, for tunnels of hijacked connections
+func (c *watchedConn) CloseWrite() error {
+	halfCloser, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("connection can't be half closed")
+	}
+
+	return halfCloser.CloseWrite()
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	c.stop()
+
+	c.mu.Lock()
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	err := c.err
+	c.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,190 @@
+package sse
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+)
+
+const defaultHeartbeat = 15 * time.Second
+
+// Event is a single server-sent event, empty fields are left out.
+type Event struct {
+	ID    string
+	Event string
+	// Data can span multiple lines, each one is sent as its own data field.
+	Data string
+	// Retry tells the client how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+type Option func(*Stream)
+
+// WithHeartbeat sets how often a comment is sent while there are no events, it keeps
+// intermediaries from timing the stream out and notices a client that went away.
+// Zero turns heartbeats off.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(s *Stream) {
+		s.heartbeat = interval
+	}
+}
+
+// Stream writes a text/event-stream response. It's safe to Send from any goroutine,
+// the handler has to Close the stream before it returns.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+	heartbeat   time.Duration
+
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   sync.WaitGroup
+}
+
+// NewStream sends the head of the event stream response right away and starts the heartbeats.
+func NewStream(w *response.Writer, r *request.Request, opts ...Option) (*Stream, error) {
+	s := &Stream{w: w, heartbeat: defaultHeartbeat, done: make(chan struct{})}
+	s.lastEventID, _ = r.Headers.Get("Last-Event-ID")
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	err := w.WriteStatusLine(response.StatusOk)
+	if err != nil {
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.heartbeat > 0 {
+		s.stopped.Add(1)
+		go s.sendHeartbeats()
+	}
+
+	s.stopped.Add(1)
+	go func() {
+		defer s.stopped.Done()
+
+		select {
+		case <-r.Context().Done():
+			s.closeOnce.Do(func() { close(s.done) })
+		case <-s.done:
+		}
+	}()
+
+	return s, nil
+}
+
+// LastEventID is the id of the last event the client saw before it reconnected, empty on a first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream is over, because the request was cancelled, a write
+// failed or Close was called.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes e and flushes it to the client.
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return fmt.Errorf("event id and name can't contain line breaks")
+	}
+
+	b := &strings.Builder{}
+	if e.ID != "" {
+		fmt.Fprintf(b, "id: %s\n", e.ID)
+	}
+	if e.Event != "" {
+		fmt.Fprintf(b, "event: %s\n", e.Event)
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(b, "retry: %d\n", e.Retry.Milliseconds())
+	}
+
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, clients ignore it.
+func (s *Stream) Comment(text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return fmt.Errorf("comments can't contain line breaks")
+	}
+
+	return s.write(fmt.Sprintf(": %s\n\n", text))
+}
+
+// Close stops the heartbeats, the response is completed once the handler returns.
+func (s *Stream) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.stopped.Wait()
+
+	// a Send from another goroutine may still be writing, the writer is the server's again after this
+	s.mu.Lock()
+	defer s.mu.Unlock()
+}
+
+func (s *Stream) write(data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return fmt.Errorf("stream closed")
+	default:
+	}
+
+	_, err := s.w.WriteBody([]byte(data))
+	if err == nil {
+		err = s.w.Flush()
+	}
+
+	// a write that fails means the client is gone, there's no point in going on
+	if err != nil {
+		s.closeOnce.Do(func() { close(s.done) })
+	}
+
+	return err
+}
+
+func (s *Stream) sendHeartbeats() {
+	defer s.stopped.Done()
+
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.Comment("heartbeat")
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package sse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+func TestStream(t *testing.T) {
+	base := startServer(t, func(w *response.Writer, r *request.Request) *server.HandlerError {
+		stream, err := NewStream(w, r, WithHeartbeat(0))
+		require.NoError(t, err)
+		defer stream.Close()
+
+		stream.Send(Event{ID: "1", Event: "greeting", Data: "hello"})
+		stream.Send(Event{Data: "first line\nsecond line\r\nthird line", Retry: 3 * time.Second})
+		stream.Send(Event{ID: stream.LastEventID() + "-next", Data: ""})
+		stream.Comment("bye")
+
+		require.Error(t, stream.Send(Event{ID: "bad\nid"}))
+		return nil
+	})
+
+	req, err := http.NewRequest("GET", base+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "41")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	// Test: Event stream head
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+
+	// Test: Fields, multi-line data and comments
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t,
+		"id: 1\nevent: greeting\ndata: hello\n\n"+
+			"retry: 3000\ndata: first line\ndata: second line\ndata: third line\n\n"+
+			"id: 41-next\ndata: \n\n"+
+			": bye\n\n",
+		string(data))
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	done := make(chan struct{})
+	base := startServer(t, func(w *response.Writer, r *request.Request) *server.HandlerError {
+		stream, err := NewStream(w, r, WithHeartbeat(10*time.Millisecond))
+		require.NoError(t, err)
+		defer stream.Close()
+
+		// the client never gets an event, only heartbeats, until it goes away
+		<-stream.Done()
+		close(done)
+		return nil
+	})
+
+	res, err := http.Get(base + "/events")
+	require.NoError(t, err)
+
+	// Test: Heartbeats are sent while there are no events
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, ": heartbeat\n", line)
+
+	// Test: The stream ends once the client is gone
+	res.Body.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream didn't notice the client went away")
+	}
+}
@@ -0,0 +1,400 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xa
+)
+
+// Close codes from RFC 6455 section 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseAbnormal        = 1006
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+const maxControlPayload = 125
+
+// closeTimeout is how long the peer has to answer a close frame before the connection is dropped
+const closeTimeout = 5 * time.Second
+
+// CloseError is returned by ReadMessage once the connection is closed, Code and Reason
+// come from the close frame, whichever side sent it.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket closed with %d", e.Code)
+	}
+
+	return fmt.Sprintf("websocket closed with %d: %s", e.Code, e.Reason)
+}
+
+// Conn is a websocket connection on the server side. Messages are read by a single
+// goroutine with ReadMessage, which also answers pings and close frames. Writes are
+// safe from any goroutine.
+type Conn struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	subprotocol string
+	opts        options
+
+	writeMu   sync.Mutex
+	closeSent bool
+	closed    bool
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, subprotocol string, opts options) *Conn {
+	return &Conn{conn: conn, reader: reader, subprotocol: subprotocol, opts: opts}
+}
+
+// Subprotocol is the subprotocol agreed on during the handshake, empty if there's none.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// ReadMessage returns the next text or binary message, put together from its fragments.
+// Control frames in between are handled on the way. When the peer closes the connection
+// or breaks the protocol the returned error is a *CloseError, the connection is closed
+// whenever an error is returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var messageType MessageType
+	var message []byte
+	inMessage := false
+
+	for {
+		f, err := c.readFrame(len(message))
+		if err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) {
+				return 0, nil, c.fail(closeErr)
+			}
+
+			c.conn.Close()
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, nil, &CloseError{Code: CloseAbnormal, Reason: "connection closed without a close frame"}
+			}
+
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			err = c.writeFrame(true, opPong, f.payload)
+			if err != nil {
+				c.conn.Close()
+				return 0, nil, err
+			}
+
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.closeReceived(f.payload)
+		case opContinuation:
+			if !inMessage {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "continuation frame without a message"})
+			}
+		case opText, opBinary:
+			if inMessage {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "new message before the last one was finished"})
+			}
+
+			inMessage = true
+			messageType = MessageType(f.opcode)
+		}
+
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "text message isn't valid utf-8"})
+		}
+
+		if message == nil {
+			message = []byte{}
+		}
+
+		return messageType, message, nil
+	}
+}
+
+// WriteMessage sends data as a single message, split into frames when a fragment size was set.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("unknown message type %d", messageType)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return fmt.Errorf("websocket is closing")
+	}
+
+	opcode := byte(messageType)
+	size := c.opts.fragmentSize
+	for size > 0 && len(data) > size {
+		err := c.writeFrameLocked(false, opcode, data[:size])
+		if err != nil {
+			return err
+		}
+
+		opcode = opContinuation
+		data = data[size:]
+	}
+
+	return c.writeFrameLocked(true, opcode, data)
+}
+
+// Ping sends a ping, the pong that comes back is consumed by ReadMessage.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("control frame payload can't be over %d bytes", maxControlPayload)
+	}
+
+	return c.writeFrame(true, opPing, data)
+}
+
+// Close starts the closing handshake. The peer's answer is picked up by ReadMessage,
+// which closes the connection then, if it doesn't come within closeTimeout the
+// connection is closed anyway.
+func (c *Conn) Close(code int, reason string) error {
+	payload := closePayload(code, reason)
+	if len(payload) > maxControlPayload {
+		return fmt.Errorf("close reason is too long")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return nil
+	}
+
+	err := c.writeFrameLocked(true, opClose, payload)
+	c.closeSent = true
+	time.AfterFunc(closeTimeout, func() { c.conn.Close() })
+
+	return err
+}
+
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// readFrame reads a single frame from the client, protocol violations come back as a
+// *CloseError with the code the connection has to be failed with. messageSize is how
+// much of the current message was read so far.
+func (c *Conn) readFrame(messageSize int) (frame, error) {
+	head := make([]byte, 2)
+	_, err := io.ReadFull(c.reader, head)
+	if err != nil {
+		return frame{}, err
+	}
+
+	f := frame{fin: head[0]&0x80 != 0, opcode: head[0] & 0x0f}
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	if head[0]&0x70 != 0 {
+		return frame{}, &CloseError{Code: CloseProtocolError, Reason: "reserved bits set without an extension"}
+	}
+
+	switch f.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return frame{}, &CloseError{Code: CloseProtocolError, Reason: "unknown opcode"}
+	}
+
+	// clients mask every frame so that intermediaries can't be tricked into treating
+	// the payload as something else, RFC 6455 section 10.3
+	if !masked {
+		return frame{}, &CloseError{Code: CloseProtocolError, Reason: "client frames must be masked"}
+	}
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return frame{}, err
+	}
+
+	if f.opcode >= opClose {
+		if !f.fin || length > maxControlPayload {
+			return frame{}, &CloseError{Code: CloseProtocolError, Reason: "invalid control frame"}
+		}
+	} else if length > uint64(c.opts.maxMessageSize-messageSize) {
+		return frame{}, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	mask := make([]byte, 4)
+	_, err = io.ReadFull(c.reader, mask)
+	if err != nil {
+		return frame{}, err
+	}
+
+	f.payload = make([]byte, length)
+	_, err = io.ReadFull(c.reader, f.payload)
+	if err != nil {
+		return frame{}, err
+	}
+
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+
+	return f, nil
+}
+
+func (c *Conn) writeFrame(fin bool, opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.writeFrameLocked(fin, opcode, payload)
+}
+
+// writeFrameLocked writes an unmasked frame, servers never mask theirs
+func (c *Conn) writeFrameLocked(fin bool, opcode byte, payload []byte) error {
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	head := make([]byte, 2, 10)
+	head[0] = opcode
+	if fin {
+		head[0] |= 0x80
+	}
+
+	switch {
+	case len(payload) <= 125:
+		head[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(len(payload)))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(len(payload)))
+	}
+
+	_, err := c.conn.Write(append(head, payload...))
+	return err
+}
+
+// closeReceived answers the peer's close frame, unless it's the answer to ours,
+// and closes the connection
+func (c *Conn) closeReceived(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+
+	switch {
+	case len(payload) == 1:
+		closeErr = &CloseError{Code: CloseProtocolError, Reason: "invalid close frame"}
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+
+		if !validCloseCode(closeErr.Code) {
+			closeErr = &CloseError{Code: CloseProtocolError, Reason: "invalid close code"}
+		} else if !utf8.ValidString(closeErr.Reason) {
+			closeErr = &CloseError{Code: CloseInvalidPayload, Reason: "close reason isn't valid utf-8"}
+		}
+	}
+
+	if closeErr.Code == CloseProtocolError || closeErr.Code == CloseInvalidPayload {
+		return c.fail(closeErr)
+	}
+
+	c.writeMu.Lock()
+	if !c.closeSent {
+		// the close is echoed back with the same code, no status gets no status back
+		reply := []byte{}
+		if closeErr.Code != CloseNoStatus {
+			reply = closePayload(closeErr.Code, "")
+		}
+
+		c.writeFrameLocked(true, opClose, reply)
+		c.closeSent = true
+	}
+	c.closed = true
+	c.writeMu.Unlock()
+
+	c.conn.Close()
+	return closeErr
+}
+
+// fail closes the connection with closeErr's code after the client broke the protocol
+func (c *Conn) fail(closeErr *CloseError) error {
+	c.writeMu.Lock()
+	if !c.closeSent {
+		c.writeFrameLocked(true, opClose, closePayload(closeErr.Code, closeErr.Reason))
+		c.closeSent = true
+	}
+	c.closed = true
+	c.writeMu.Unlock()
+
+	c.conn.Close()
+	return closeErr
+}
+
+func closePayload(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(payload, reason...)
+}
+
+// validCloseCode reports whether code can be sent in a close frame, 1005, 1006 and 1015
+// only exist to be reported locally
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
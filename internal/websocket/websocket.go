@@ -0,0 +1,154 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/headers"
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+)
+
+// acceptGUID is appended to the client's key before hashing it, RFC 6455 section 1.3
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const supportedVersion = "13"
+
+const defaultMaxMessageSize = 1 << 20
+
+type options struct {
+	subprotocols   []string
+	maxMessageSize int
+	fragmentSize   int
+}
+
+type Option func(*options)
+
+// WithSubprotocols lists the subprotocols the server speaks, the first one the client
+// offers that's on the list is picked. Without it no subprotocol is agreed on.
+func WithSubprotocols(subprotocols ...string) Option {
+	return func(o *options) {
+		o.subprotocols = subprotocols
+	}
+}
+
+// WithMaxMessageSize limits the size of a message read from the client, across all
+// of its fragments. A client that sends more has the connection closed with 1009,
+// Upgrade refuses a negative size.
+func WithMaxMessageSize(size int) Option {
+	return func(o *options) {
+		o.maxMessageSize = size
+	}
+}
+
+// WithFragmentSize splits written messages into frames of at most size bytes,
+// by default every message goes out as a single frame.
+func WithFragmentSize(size int) Option {
+	return func(o *options) {
+		o.fragmentSize = size
+	}
+}
+
+// Upgrade performs the opening handshake from RFC 6455 section 4.2 and takes the
+// connection over from the server. A request that isn't a valid handshake gets the
+// error to return from the handler, the response is a regular http one then.
+func Upgrade(w *response.Writer, r *request.Request, opts ...Option) (*Conn, *server.HandlerError) {
+	o := options{maxMessageSize: defaultMaxMessageSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// a negative cap would wrap around when compared with the length of a frame
+	if o.maxMessageSize < 0 {
+		return nil, handshakeError(response.StatusInternalServerError, "max message size can't be negative")
+	}
+
+	if r.RequestLine.Method != "GET" || r.RequestLine.HttpVersion != "1.1" {
+		return nil, handshakeError(response.StatusBadRequest, "websocket handshake must be a GET over HTTP/1.1")
+	}
+
+	if !headerHasToken(r.Headers, "Upgrade", "websocket") || !headerHasToken(r.Headers, "Connection", "upgrade") {
+		return nil, handshakeError(response.StatusBadRequest, "missing websocket upgrade headers")
+	}
+
+	version, _ := r.Headers.Get("Sec-WebSocket-Version")
+	if strings.TrimSpace(version) != supportedVersion {
+		hErr := handshakeError(response.StatusUpgradeRequired, "unsupported websocket version")
+		hErr.Headers.Set("Sec-WebSocket-Version", supportedVersion)
+		return nil, hErr
+	}
+
+	key, _ := r.Headers.Get("Sec-WebSocket-Key")
+	key = strings.TrimSpace(key)
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return nil, handshakeError(response.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+
+	subprotocol := ""
+	for _, offered := range r.Headers.Values("Sec-WebSocket-Protocol") {
+		for _, name := range strings.Split(offered, ",") {
+			name = strings.TrimSpace(name)
+			if subprotocol == "" && slices.Contains(o.subprotocols, name) {
+				subprotocol = name
+			}
+		}
+	}
+
+	netConn, reader, err := w.Hijack()
+	if err != nil {
+		return nil, handshakeError(response.StatusInternalServerError, err.Error())
+	}
+
+	head := fmt.Sprintf("HTTP/1.1 %d %s\r\n", response.StatusSwitchingProtocols, response.StatusText(response.StatusSwitchingProtocols)) +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n", AcceptKey(key))
+	if subprotocol != "" {
+		head += fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", subprotocol)
+	}
+	head += "\r\n"
+
+	_, err = netConn.Write([]byte(head))
+	if err != nil {
+		// the connection is already taken over, the server ignores this but the handler
+		// still has to know there's no websocket
+		netConn.Close()
+		return nil, handshakeError(response.StatusInternalServerError, "couldn't complete the websocket handshake")
+	}
+
+	return newConn(netConn, reader, subprotocol, o), nil
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a client's Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerHasToken(h headers.Headers, key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func handshakeError(statusCode response.StatusCode, message string) *server.HandlerError {
+	errorHeaders := headers.NewHeaders()
+	errorHeaders.Set("Content-Type", "text/plain")
+
+	return &server.HandlerError{
+		StatusCode: statusCode,
+		Headers:    errorHeaders,
+		Body:       []byte(message),
+	}
+}
@@ -0,0 +1,304 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/magicznykacpur/httpfromtcp/internal/request"
+	"github.com/magicznykacpur/httpfromtcp/internal/response"
+	"github.com/magicznykacpur/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// startEcho runs a server that echoes every message back, the error that ended each
+// connection is sent on the returned channel
+func startEcho(t *testing.T, opts ...Option) (string, chan error) {
+	errs := make(chan error, 1)
+
+	s, err := server.Serve(0, func(w *response.Writer, r *request.Request) *server.HandlerError {
+		conn, hErr := Upgrade(w, r, opts...)
+		if hErr != nil {
+			return hErr
+		}
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return nil
+			}
+
+			conn.WriteMessage(messageType, data)
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port), errs
+}
+
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, addr string, extraHeaders string) (*testClient, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\n%s\r\n", addr, extraHeaders)
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+
+	return &testClient{conn: conn, reader: reader}, res
+}
+
+func upgradeHeaders(extra ...string) string {
+	h := "Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + testKey + "\r\n"
+
+	for _, line := range extra {
+		h += line + "\r\n"
+	}
+
+	return h
+}
+
+func (c *testClient) writeFrame(t *testing.T, fin bool, opcode byte, payload []byte, masked bool) {
+	head := []byte{opcode, 0}
+	if fin {
+		head[0] |= 0x80
+	}
+
+	switch {
+	case len(payload) <= 125:
+		head[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(len(payload)))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(len(payload)))
+	}
+
+	body := append([]byte{}, payload...)
+	if masked {
+		head[1] |= 0x80
+		mask := []byte{1, 2, 3, 4}
+		head = append(head, mask...)
+		for i := range body {
+			body[i] ^= mask[i%4]
+		}
+	}
+
+	_, err := c.conn.Write(append(head, body...))
+	require.NoError(t, err)
+}
+
+func (c *testClient) readFrame(t *testing.T) (bool, byte, []byte) {
+	head := make([]byte, 2)
+	_, err := io.ReadFull(c.reader, head)
+	require.NoError(t, err)
+	require.Zero(t, head[1]&0x80, "server frames mustn't be masked")
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	require.NoError(t, err)
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	require.NoError(t, err)
+
+	return head[0]&0x80 != 0, head[0] & 0x0f, payload
+}
+
+func (c *testClient) readClose(t *testing.T) int {
+	_, opcode, payload := c.readFrame(t)
+	require.Equal(t, opClose, opcode)
+	require.GreaterOrEqual(t, len(payload), 2)
+
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func TestHandshake(t *testing.T) {
+	addr, _ := startEcho(t, WithSubprotocols("chat", "superchat"))
+
+	// Test: Accept key from the RFC example
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey(testKey))
+
+	// Test: Successful upgrade with a subprotocol
+	_, res := dial(t, addr, upgradeHeaders("Sec-WebSocket-Protocol: foo, superchat, chat"))
+	assert.Equal(t, 101, res.StatusCode)
+	assert.Equal(t, "websocket", res.Header.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", res.Header.Get("Connection"))
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "superchat", res.Header.Get("Sec-WebSocket-Protocol"))
+
+	// Test: No subprotocol in common
+	_, res = dial(t, addr, upgradeHeaders("Sec-WebSocket-Protocol: foo"))
+	assert.Equal(t, 101, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Sec-WebSocket-Protocol"))
+
+	// Test: Invalid key
+	_, res = dial(t, addr, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: c2hvcnQ=\r\n")
+	assert.Equal(t, 400, res.StatusCode)
+
+	// Test: Not an upgrade
+	_, res = dial(t, addr, "")
+	assert.Equal(t, 400, res.StatusCode)
+
+	// Test: Unsupported version
+	_, res = dial(t, addr, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: "+testKey+"\r\n")
+	assert.Equal(t, 426, res.StatusCode)
+	assert.Equal(t, "13", res.Header.Get("Sec-WebSocket-Version"))
+
+	// Test: A negative message size is refused before the connection is taken over
+	addr, _ = startEcho(t, WithMaxMessageSize(-1))
+	_, res = dial(t, addr, upgradeHeaders())
+	assert.Equal(t, 500, res.StatusCode)
+}
+
+func TestMessages(t *testing.T) {
+	addr, errs := startEcho(t, WithMaxMessageSize(1024))
+	c, res := dial(t, addr, upgradeHeaders())
+	require.Equal(t, 101, res.StatusCode)
+
+	// Test: Text message
+	c.writeFrame(t, true, opText, []byte("hello"), true)
+	fin, opcode, payload := c.readFrame(t)
+	assert.True(t, fin)
+	assert.Equal(t, opText, opcode)
+	assert.Equal(t, "hello", string(payload))
+
+	// Test: Fragmented binary message with a ping in the middle
+	c.writeFrame(t, false, opBinary, []byte{1, 2}, true)
+	c.writeFrame(t, true, opPing, []byte("are you there"), true)
+	c.writeFrame(t, false, opContinuation, []byte{3}, true)
+	c.writeFrame(t, true, opContinuation, []byte{4, 5}, true)
+	_, opcode, payload = c.readFrame(t)
+	assert.Equal(t, opPong, opcode)
+	assert.Equal(t, "are you there", string(payload))
+	_, opcode, payload = c.readFrame(t)
+	assert.Equal(t, opBinary, opcode)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5}, payload)
+
+	// Test: Message with a 16 bit length
+	long := strings.Repeat("a", 300)
+	c.writeFrame(t, true, opText, []byte(long), true)
+	_, _, payload = c.readFrame(t)
+	assert.Equal(t, long, string(payload))
+
+	// Test: Close handshake
+	c.writeFrame(t, true, opClose, closePayload(CloseNormal, "bye"), true)
+	assert.Equal(t, CloseNormal, c.readClose(t))
+	err := <-errs
+	assert.Equal(t, &CloseError{Code: CloseNormal, Reason: "bye"}, err)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	addr, errs := startEcho(t, WithMaxMessageSize(16))
+
+	cases := []struct {
+		name  string
+		write func(c *testClient)
+		code  int
+	}{
+		{
+			name:  "Unmasked frame",
+			write: func(c *testClient) { c.writeFrame(t, true, opText, []byte("hi"), false) },
+			code:  CloseProtocolError,
+		},
+		{
+			name:  "Message over the size limit",
+			write: func(c *testClient) { c.writeFrame(t, true, opBinary, make([]byte, 17), true) },
+			code:  CloseMessageTooBig,
+		},
+		{
+			name: "Fragments over the size limit",
+			write: func(c *testClient) {
+				c.writeFrame(t, false, opBinary, make([]byte, 10), true)
+				c.writeFrame(t, true, opContinuation, make([]byte, 10), true)
+			},
+			code: CloseMessageTooBig,
+		},
+		{
+			name:  "Invalid utf-8 text",
+			write: func(c *testClient) { c.writeFrame(t, true, opText, []byte{0xff, 0xfe}, true) },
+			code:  CloseInvalidPayload,
+		},
+		{
+			name:  "Continuation without a message",
+			write: func(c *testClient) { c.writeFrame(t, true, opContinuation, []byte("hi"), true) },
+			code:  CloseProtocolError,
+		},
+		{
+			name:  "Fragmented control frame",
+			write: func(c *testClient) { c.writeFrame(t, false, opPing, []byte("hi"), true) },
+			code:  CloseProtocolError,
+		},
+		{
+			name:  "Reserved close code",
+			write: func(c *testClient) { c.writeFrame(t, true, opClose, closePayload(CloseNoStatus, ""), true) },
+			code:  CloseProtocolError,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, res := dial(t, addr, upgradeHeaders())
+			require.Equal(t, 101, res.StatusCode)
+
+			tc.write(c)
+			assert.Equal(t, tc.code, c.readClose(t))
+
+			var closeErr *CloseError
+			require.ErrorAs(t, <-errs, &closeErr)
+			assert.Equal(t, tc.code, closeErr.Code)
+		})
+	}
+}
+
+func TestFragmentedWrites(t *testing.T) {
+	addr, _ := startEcho(t, WithFragmentSize(2))
+	c, res := dial(t, addr, upgradeHeaders())
+	require.Equal(t, 101, res.StatusCode)
+
+	c.writeFrame(t, true, opText, []byte("hello"), true)
+
+	expected := []struct {
+		fin     bool
+		opcode  byte
+		payload string
+	}{
+		{false, opText, "he"},
+		{false, opContinuation, "ll"},
+		{true, opContinuation, "o"},
+	}
+	for _, e := range expected {
+		fin, opcode, payload := c.readFrame(t)
+		assert.Equal(t, e.fin, fin)
+		assert.Equal(t, e.opcode, opcode)
+		assert.Equal(t, e.payload, string(payload))
+	}
+}